@@ -0,0 +1,59 @@
+package FayKV
+
+import "github.com/Kirov7/FayKV/utils"
+
+// WriteBatch collects the writes which are committed atomically, after a crash
+// either all of them or none of them are replayed
+type WriteBatch struct {
+	db      *DB
+	entries []*utils.Entry
+	size    int64
+}
+
+// NewWriteBatch _
+func (db *DB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{db: db}
+}
+
+// Set adds the entry to the batch, it returns ErrBatchTooBig if the batch would exceed
+// MaxBatchCount or MaxBatchSize, the entry is not added then
+func (wb *WriteBatch) Set(data *utils.Entry) error {
+	if data == nil || len(data.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	// Copy the entry, the caller still owns data. The version is set by the writer goroutine
+	entry := &utils.Entry{
+		Key:       append([]byte{}, data.Key...),
+		Value:     append([]byte(nil), data.Value...),
+		ExpiresAt: data.ExpiresAt,
+		Meta:      data.Meta,
+	}
+	// 8 bytes for the version
+	size := wb.size + int64(entry.EstimateSize(int(wb.db.opt.ValueThreshold))+8)
+	if int64(len(wb.entries)+1) > wb.db.opt.MaxBatchCount || size > wb.db.opt.MaxBatchSize {
+		return utils.ErrBatchTooBig
+	}
+	wb.entries = append(wb.entries, entry)
+	wb.size = size
+	return nil
+}
+
+// Delete adds a tombstone of the key to the batch
+func (wb *WriteBatch) Delete(key []byte) error {
+	return wb.Set(&utils.Entry{
+		Key:   key,
+		Value: nil,
+		Meta:  utils.BitDelete,
+	})
+}
+
+// Commit writes the batch, it can be reused afterwards
+func (wb *WriteBatch) Commit() error {
+	if len(wb.entries) == 0 {
+		return nil
+	}
+	defer func() {
+		wb.entries, wb.size = nil, 0
+	}()
+	return wb.db.batchSet(wb.entries)
+}
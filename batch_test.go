@@ -0,0 +1,159 @@
+package FayKV
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Kirov7/FayKV/utils"
+)
+
+func TestWriteBatchCommit(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	mustSet(t, db, key(0), value(0))
+	wb := db.NewWriteBatch()
+	for i := 1; i < 50; i++ {
+		if err := wb.Set(utils.NewEntry(key(i), value(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Delete(key(0)); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is visible before the commit
+	mustMiss(t, db, key(1))
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustMiss(t, db, key(0))
+	var version uint64
+	for i := 1; i < 50; i++ {
+		e, err := db.Get(key(i))
+		if err != nil {
+			t.Fatalf("get %s: %v", key(i), err)
+		}
+		// The batch is one commit, all of its entries share the version
+		if version == 0 {
+			version = e.Version
+		} else if e.Version != version {
+			t.Fatalf("get %s: version %d, want %d", key(i), e.Version, version)
+		}
+	}
+}
+
+func TestWriteBatchCopiesEntries(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	wb := db.NewWriteBatch()
+	k, v := []byte("key"), []byte("value")
+	if err := wb.Set(utils.NewEntry(k, v)); err != nil {
+		t.Fatal(err)
+	}
+	// The caller reuses its buffers before the commit
+	copy(k, "xxx")
+	copy(v, "xxxxx")
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, []byte("key"), []byte("value"))
+	mustMiss(t, db, []byte("xxx"))
+}
+
+func TestWriteBatchTooBig(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.MaxBatchCount = 10
+	db := openTestDB(t, opt)
+	wb := db.NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		if err := wb.Set(utils.NewEntry(key(i), value(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Set(utils.NewEntry(key(10), value(10))); err != utils.ErrBatchTooBig {
+		t.Fatalf("got %v, want ErrBatchTooBig", err)
+	}
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		mustGet(t, db, key(i), value(i))
+	}
+	mustMiss(t, db, key(10))
+}
+
+// TestWriteBatchAtomicReplay a batch is replayed whole after a crash, the db is opened
+// again without being closed
+func TestWriteBatchAtomicReplay(t *testing.T) {
+	dir := t.TempDir()
+	db := Open(testOptions(dir))
+	wb := db.NewWriteBatch()
+	for i := 0; i < 100; i++ {
+		if err := wb.Set(utils.NewEntry(key(i), value(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := openTestDB(t, testOptions(dir))
+	for i := 0; i < 100; i++ {
+		mustGet(t, reopened, key(i), value(i))
+	}
+}
+
+// TestWriteBatchConcurrent the readers never see a part of a batch
+func TestWriteBatchConcurrent(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	const keys = 20
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 50; round++ {
+			wb := db.NewWriteBatch()
+			for i := 0; i < keys; i++ {
+				if err := wb.Set(utils.NewEntry(key(i), value(round))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			if err := wb.Commit(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		close(stop)
+	}()
+	for {
+		select {
+		case <-stop:
+			wg.Wait()
+			return
+		default:
+		}
+		snap := db.NewSnapshot()
+		var first string
+		for i := 0; i < keys; i++ {
+			e, err := snap.Get(key(i))
+			if err == utils.ErrKeyNotFound {
+				if i > 0 && first != "" {
+					t.Fatalf("key %d missing from a committed batch", i)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				first = string(e.Value)
+			} else if string(e.Value) != first {
+				t.Fatalf("key %d: got %q, want %q of the same batch", i, e.Value, first)
+			}
+		}
+		if err := snap.Discard(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -33,7 +33,11 @@ func (f Filter) Contains(bitPos uint32) bool {
 }
 
 func (f Filter) BlContains(key []byte) bool {
-	h := Hash(key)
+	return f.MayContain(Hash(key))
+}
+
+// MayContain is BlContains of a key which the caller has hashed
+func (f Filter) MayContain(h uint32) bool {
 	if len(f) < 2 {
 		return false
 	}
@@ -199,3 +199,15 @@ func Hash(b []byte) uint32 {
 	}
 	return h
 }
+
+// MixedHash Hash followed by the murmur3 finalizer. The low bits of Hash barely depend on the
+// last bytes of a short key, a small filter of short keys like the prefixes needs them mixed in
+func MixedHash(b []byte) uint32 {
+	h := Hash(b)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
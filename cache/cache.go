@@ -56,7 +56,7 @@ func NewCache(size int) *Cache {
 // todo Optimize this method by using generics
 func (c *Cache) Set(key, value interface{}) bool {
 	c.m.Lock()
-	defer c.m.Lock()
+	defer c.m.Unlock()
 	return c.set(key, value)
 }
 
@@ -104,8 +104,9 @@ func (c *Cache) set(key, value interface{}) bool {
 }
 
 func (c *Cache) Get(key interface{}) (interface{}, bool) {
-	c.m.RLock()
-	defer c.m.RUnlock()
+	// get updates the access statistics and the lru lists, so it needs the write lock
+	c.m.Lock()
+	defer c.m.Unlock()
 	return c.get(key)
 }
 
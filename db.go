@@ -1,18 +1,25 @@
 package FayKV
 
 import (
+	"bytes"
+	"github.com/Kirov7/FayKV/cache"
 	"github.com/Kirov7/FayKV/inmemory"
 	"github.com/Kirov7/FayKV/lsm"
+	"github.com/Kirov7/FayKV/persistent"
 	"github.com/Kirov7/FayKV/utils"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type KvAPI interface {
-	Set(data *inmemory.Element) error
+	Set(data *utils.Entry) error
 	Get(key []byte) (*utils.Entry, error)
 	Del(key []byte) error
+	DeleteRange(start, end []byte) error
 	Info() *Stats
-	NewIterator(opt *utils.Options) utils.Iterator
+	NewIterator(opt *utils.Options) *DBIterator
 	Close() error
 }
 
@@ -21,18 +28,43 @@ type DB struct {
 	opt   *Options
 	stats *Stats
 	lsm   *lsm.LSM
+	vlog  *valueLog
+	orc   *oracle
+	// registry the data keys the files are encrypted by
+	registry *persistent.KeyRegistry
+
+	// writeCh the requests of the writers, the writer goroutine commits them in groups
+	writeCh     chan *request
+	blockWrites int32
+	closer      *utils.Closer
+	// writeLock held by the writers from the check of blockWrites to the send, Close takes it
+	// before stopping the writer goroutine so no request is queued after it has drained
+	writeLock sync.RWMutex
 }
 
 func Open(opt *Options) *DB {
-	c := utils.NewCloser()
-	db := &DB{opt: opt}
+	opt.fillDefaults()
+	db := &DB{opt: opt, writeCh: make(chan *request, utils.KVWriteChCapacity), closer: utils.NewCloser()}
+	// The data keys are needed to open any other file
+	registry, err := persistent.OpenKeyRegistry(&persistent.Options{
+		Dir:                 opt.WorkDir,
+		EncryptionKey:       opt.EncryptionKey,
+		KeyRotationDuration: opt.EncryptionKeyRotationDuration,
+	})
+	utils.Panic(err)
+	db.registry = registry
+	// The vlog is opened first, the compaction reports the discarded values to it
+	vlog, err := openValueLog(db, opt)
+	utils.Panic(err)
+	db.vlog = vlog
 	// init LSM structure
 	db.lsm = lsm.NewLSM(&lsm.Options{
 		WorkDir:             opt.WorkDir,
 		MemTableSize:        opt.MemTableSize,
+		NumMemtables:        5,
 		SSTableMaxSize:      opt.SSTableMaxSz,
 		BlockSize:           8 * 1024,
-		BloomFalsePositive:  0, //0.01,
+		BloomFalsePositive:  opt.BloomFalsePositive,
 		BaseLevelSize:       10 << 20,
 		LevelSizeMultiplier: 10,
 		BaseTableSize:       5 << 20,
@@ -40,41 +72,374 @@ func Open(opt *Options) *DB {
 		NumLevelZeroTables:  15,
 		MaxLevelNum:         7,
 		NumCompactors:       1,
+		DiscardStatsCh:      &vlog.discardStats.ch,
+		SyncMode:            opt.SyncMode,
+		Compression:         opt.Compression,
+		KeyRegistry:         registry,
+		DiscardTs: func() uint64 {
+			return db.orc.discardAtOrBelow()
+		},
+		LevelBloomFalsePositive: opt.LevelBloomFalsePositive,
+		PrefixExtractor:         opt.PrefixExtractor,
+		CompactionStrategy:      opt.CompactionStrategy,
+		LevelZeroSlowdownTables: opt.LevelZeroSlowdownTables,
+		LevelZeroStopTables:     opt.LevelZeroStopTables,
+		ImmutablesSlowdown:      opt.ImmutablesSlowdown,
+		PendingBytesSlowdown:    opt.PendingBytesSlowdown,
+		PendingBytesStop:        opt.PendingBytesStop,
+		SlowdownDelay:           opt.SlowdownDelay,
+		VerifyChecksumsOnOpen:   opt.VerifyChecksumsOnOpen,
 	})
+	// The next commit timestamp follows the newest version on the disk
+	db.orc = newOracle(db.lsm.MaxVersion())
 	// Example Initialize statistics
 	db.stats = newStats(opt)
 	// Start the merge compression process for the sstable
-	go db.lsm.StartCompacter()
-	c.Add(1)
-	// todo init worker channel
+	db.lsm.StartCompacter()
+	// All the writes go through one goroutine which groups them
+	db.closer.Add(1)
+	go db.doWrites()
+	if opt.SyncMode == utils.SyncEveryInterval {
+		db.closer.Add(1)
+		go db.runSyncer()
+	}
 
 	return db
 }
-func (db *DB) Set(data *inmemory.Element) error {
-	// todo implement there
-	panic("todo")
+
+func (db *DB) Set(data *utils.Entry) error {
+	if data == nil || len(data.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	// Copy the entry, the caller still owns data. The version is set by the writer goroutine
+	entry := &utils.Entry{
+		Key:       data.Key,
+		Value:     data.Value,
+		ExpiresAt: data.ExpiresAt,
+		Meta:      data.Meta,
+	}
+	return db.batchSet([]*utils.Entry{entry})
 }
 
+// Get returns the latest version of the key
 func (db *DB) Get(key []byte) (*utils.Entry, error) {
-	// todo implement there
-	panic("todo")
+	readTs := db.orc.pinReadTs()
+	defer db.orc.unpinReadTs(readTs)
+	return db.get(key, readTs)
+}
+
+// get returns the newest version of the key at or below readTs, readTs must be pinned
+func (db *DB) get(key []byte, readTs uint64) (*utils.Entry, error) {
+	if len(key) == 0 {
+		return nil, utils.ErrEmptyKey
+	}
+	// The vlog file the entry points to is kept until the read is done
+	db.vlog.incrReaders()
+	defer func() {
+		if err := db.vlog.decrReaders(); err != nil {
+			log.Printf("while deleting the rewritten vlog files: %v", err)
+		}
+	}()
+	entry, err := db.lsm.Get(inmemory.KeyWithTs(key, readTs))
+	if err != nil {
+		return nil, err
+	}
+	// A tombstone or an expired entry hides all the older versions of the key
+	if entry == nil || entry.IsDeletedOrExpired() {
+		return nil, utils.ErrKeyNotFound
+	}
+	e := &utils.Entry{
+		Key:       key,
+		Value:     entry.Value,
+		ExpiresAt: entry.ExpiresAt,
+		Meta:      entry.Meta,
+		Version:   inmemory.ParseTs(entry.Key),
+	}
+	if err := db.vlog.resolve(e); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
 func (db *DB) Del(key []byte) error {
-	// todo implement there
-	panic("todo")
+	// Write a tombstone, the older versions are dropped by the compaction
+	return db.Set(&utils.Entry{
+		Key:   key,
+		Value: nil,
+		Meta:  utils.BitDelete,
+	})
+}
+
+// DeleteRange deletes all the keys in [start, end) with one range tombstone. The deleted
+// versions are dropped by the compaction, the tables holding nothing else without being rewritten.
+// A transaction which read a key of the range before it's committed fails with ErrConflict
+func (db *DB) DeleteRange(start, end []byte) error {
+	if len(start) == 0 {
+		return utils.ErrEmptyKey
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return utils.ErrInvalidRequest
+	}
+	return db.batchSet([]*utils.Entry{{
+		Key:   start,
+		Value: end,
+		Meta:  utils.BitDelete | utils.BitRangeDelete,
+	}})
+}
+
+// RunValueLogGC rewrites the vlog file with the largest part of discarded values if at least
+// discardRatio of it is discarded. It returns ErrNoRewrite if no file is worth collecting
+func (db *DB) RunValueLogGC(discardRatio float64) error {
+	if discardRatio >= 1.0 || discardRatio <= 0.0 {
+		return utils.ErrInvalidRequest
+	}
+	return db.vlog.runGC(discardRatio)
+}
+
+// Sync flushes all the acknowledged writes to the disk, whatever the SyncMode is
+func (db *DB) Sync() error {
+	// The values first, the pointers to them must never be durable alone
+	if err := db.vlog.sync(); err != nil {
+		return err
+	}
+	return db.lsm.Sync()
+}
+
+// Flush writes the memTable to level 0 and waits until every memTable before it is written too
+func (db *DB) Flush() (lsm.CompactionStats, error) {
+	// The values first, the tables must never point to values which are lost by a crash
+	if err := db.vlog.sync(); err != nil {
+		return lsm.CompactionStats{}, err
+	}
+	return db.lsm.Flush()
+}
+
+// CompactRange flushes the memTables and pushes all the tables holding the keys of [start, end)
+// down to the last level, the space of the deleted and the stale versions is reclaimed once it
+// returns. A nil bound leaves the range open
+func (db *DB) CompactRange(start, end []byte) (lsm.CompactionStats, error) {
+	return db.compactRange(start, end, 1)
+}
+
+// Flatten pushes all the tables down to the last level, with up to workers compactions at once
+func (db *DB) Flatten(workers int) (lsm.CompactionStats, error) {
+	return db.compactRange(nil, nil, workers)
+}
+
+func (db *DB) compactRange(start, end []byte, workers int) (lsm.CompactionStats, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return lsm.CompactionStats{}, utils.ErrInvalidRequest
+	}
+	stats, err := db.Flush()
+	if err != nil {
+		return stats, err
+	}
+	compacted, err := db.lsm.CompactRange(start, end, workers)
+	stats.Add(compacted)
+	return stats, err
+}
+
+// runSyncer syncs the writes every SyncInterval in SyncEveryInterval mode
+func (db *DB) runSyncer() {
+	defer db.closer.Done()
+	ticker := time.NewTicker(db.opt.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.Sync(); err != nil {
+				log.Printf("while syncing the writes: %v", err)
+			}
+		case <-db.closer.CloseSignal:
+			return
+		}
+	}
 }
 
 func (db *DB) Info() *Stats {
+	db.stats.WriteSlowdown, db.stats.WriteStop = db.lsm.WriteStalls()
 	return db.stats
 }
 
-func (db *DB) NewIterator(opt *utils.Options) utils.Iterator {
-	// todo implement there
-	panic("todo")
+func (db *DB) Close() error {
+	// Reject the new writes and commit the queued ones
+	db.writeLock.Lock()
+	if atomic.LoadInt32(&db.blockWrites) == 1 {
+		db.writeLock.Unlock()
+		return nil
+	}
+	atomic.StoreInt32(&db.blockWrites, 1)
+	db.writeLock.Unlock()
+	// The queued writes must not wait for the compaction, the writer goroutine is waited for
+	db.lsm.StopStalls()
+	db.closer.Close()
+	// Everything is closed even if the flush failed, the first error is returned
+	var firstErr error
+	for _, closeFn := range []func() error{db.lsm.Close, db.vlog.close, db.registry.Close, db.stats.close} {
+		if err := closeFn(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-func (db *DB) Close() error {
-	// todo implement there
-	panic("todo")
+// RotateEncryptionKey encrypts the data keys of the closed db in dir by newKey instead of oldKey,
+// the files keep their data keys so none of them is rewritten
+func RotateEncryptionKey(dir string, oldKey, newKey []byte) error {
+	return persistent.RotateMasterKey(&persistent.Options{Dir: dir, EncryptionKey: oldKey}, newKey)
+}
+
+// request the entries of one writer, they are committed atomically
+type request struct {
+	entries []*utils.Entry
+	txn     *Txn // set if the request commits a transaction
+	wg      sync.WaitGroup
+	err     error
+}
+
+// batchSet hands the entries to the writer goroutine and waits for the commit
+func (db *DB) batchSet(entries []*utils.Entry) error {
+	return db.sendToWriteCh(&request{entries: entries})
+}
+
+func (db *DB) sendToWriteCh(req *request) error {
+	// Not the lock of the DB, the vlog gc would wait for a writer blocked on a full writeCh
+	db.writeLock.RLock()
+	if atomic.LoadInt32(&db.blockWrites) == 1 {
+		db.writeLock.RUnlock()
+		return utils.ErrBlockedWrites
+	}
+	req.wg.Add(1)
+	db.writeCh <- req
+	db.writeLock.RUnlock()
+	req.wg.Wait()
+	return req.err
+}
+
+// doWrites groups the queued requests up to MaxBatchCount entries or MaxBatchSize bytes
+// and commits every group with one wal append
+func (db *DB) doWrites() {
+	defer db.closer.Done()
+	reqs := make([]*request, 0, 10)
+	var count, size int64
+	// pending the request which didn't fit into the last group
+	var pending *request
+	add := func(r *request) bool {
+		var sz int64
+		for _, e := range r.entries {
+			sz += int64(e.EstimateSize(int(db.opt.ValueThreshold)))
+		}
+		if len(reqs) > 0 && (count+int64(len(r.entries)) > db.opt.MaxBatchCount || size+sz > db.opt.MaxBatchSize) {
+			pending = r
+			return false
+		}
+		reqs = append(reqs, r)
+		count += int64(len(r.entries))
+		size += sz
+		return true
+	}
+	write := func() {
+		db.writeRequests(reqs)
+		reqs, count, size = reqs[:0], 0, 0
+		if pending != nil {
+			add(pending)
+			pending = nil
+		}
+	}
+	for {
+		if len(reqs) == 0 {
+			select {
+			case r := <-db.writeCh:
+				add(r)
+			case <-db.closer.CloseSignal:
+				// Commit what is still queued, no new request comes in after blockWrites
+				for {
+					select {
+					case r := <-db.writeCh:
+						if !add(r) {
+							write()
+						}
+					default:
+						if len(reqs) > 0 {
+							write()
+						}
+						return
+					}
+				}
+			}
+		}
+		// Take what is queued right now, without waiting for more
+	collect:
+		for {
+			select {
+			case r := <-db.writeCh:
+				if !add(r) {
+					break collect
+				}
+			default:
+				break collect
+			}
+		}
+		write()
+	}
+}
+
+// writeRequests writes the requests as one batch and wakes up their writers
+func (db *DB) writeRequests(reqs []*request) {
+	var entries []*utils.Entry
+	var commitTs uint64
+	committed := reqs[:0:0]
+	for _, r := range reqs {
+		// The writes are serialized here, so the check and the commit can't interleave
+		if r.txn != nil && db.orc.hasConflict(r.txn) {
+			r.err = utils.ErrConflict
+			r.wg.Done()
+			continue
+		}
+		// Every request is one commit
+		commitTs = db.orc.newCommitTs()
+		conflictKeys := make(map[uint64]struct{}, len(r.entries))
+		var conflictRanges []conflictRange
+		for _, e := range r.entries {
+			conflictKeys[cache.MemHash(e.Key)] = struct{}{}
+			if e.Meta&utils.BitRangeDelete != 0 {
+				conflictRanges = append(conflictRanges, conflictRange{start: e.Key, end: e.Value})
+			}
+			e.Key = inmemory.KeyWithTs(e.Key, commitTs)
+		}
+		db.orc.addCommitted(commitTs, conflictKeys, conflictRanges)
+		entries = append(entries, r.entries...)
+		committed = append(committed, r)
+	}
+	if len(committed) == 0 {
+		return
+	}
+	err := db.writeEntries(entries)
+	// The group is visible at once, even a failed write must not hold back the next ones
+	db.orc.doneCommit(commitTs)
+	if err != nil {
+		log.Printf("while writing %d requests: %v", len(committed), err)
+	}
+	for _, r := range committed {
+		r.err = err
+		r.wg.Done()
+	}
+}
+
+func (db *DB) writeEntries(entries []*utils.Entry) error {
+	// The vlog gc holds the write lock while it moves the values
+	db.RLock()
+	defer db.RUnlock()
+	// The large values go to the vlog first, the lsm only stores their pointers
+	if err := db.vlog.write(entries); err != nil {
+		return err
+	}
+	if err := db.lsm.SetBatch(entries); err != nil {
+		return err
+	}
+	// One fsync for the whole group
+	if db.opt.SyncMode == utils.SyncEveryWrite {
+		return db.Sync()
+	}
+	return nil
 }
@@ -0,0 +1,500 @@
+package FayKV
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// testOptions small memTables and tables, so that a few hundred keys reach the disk
+func testOptions(dir string) *Options {
+	return &Options{
+		WorkDir:          dir,
+		MemTableSize:     64 << 10,
+		SSTableMaxSz:     1 << 20,
+		ValueThreshold:   1 << 10,
+		ValueLogFileSize: 1 << 20,
+		SyncMode:         utils.SyncNever,
+	}
+}
+
+func openTestDB(t testing.TB, opt *Options) *DB {
+	t.Helper()
+	db := Open(opt)
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	})
+	return db
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+func value(i int) []byte {
+	return []byte(fmt.Sprintf("value%06d", i))
+}
+
+func mustSet(t testing.TB, db *DB, k, v []byte) {
+	t.Helper()
+	if err := db.Set(utils.NewEntry(k, v)); err != nil {
+		t.Fatalf("set %s: %v", k, err)
+	}
+}
+
+func mustGet(t testing.TB, db *DB, k, want []byte) {
+	t.Helper()
+	e, err := db.Get(k)
+	if err != nil {
+		t.Fatalf("get %s: %v", k, err)
+	}
+	if string(e.Value) != string(want) {
+		t.Fatalf("get %s: got %q, want %q", k, e.Value, want)
+	}
+}
+
+func mustMiss(t testing.TB, db *DB, k []byte) {
+	t.Helper()
+	if e, err := db.Get(k); err != utils.ErrKeyNotFound {
+		t.Fatalf("get %s: got %v, %v, want ErrKeyNotFound", k, e, err)
+	}
+}
+
+// scan returns the keys of the iterator in its order
+func scan(t testing.TB, it utils.Iterator) []string {
+	t.Helper()
+	defer it.Close()
+	var keys []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Item().Entry().Key))
+	}
+	return keys
+}
+
+func TestDBSetGetDel(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	for i := 0; i < 100; i++ {
+		mustGet(t, db, key(i), value(i))
+	}
+	if err := db.Del(key(7)); err != nil {
+		t.Fatal(err)
+	}
+	mustMiss(t, db, key(7))
+	mustMiss(t, db, key(1000))
+}
+
+// TestDBReopen the keys written before Close are found after Open, the deleted ones stay
+// deleted and the new writes hide the old versions
+func TestDBReopen(t *testing.T) {
+	dir := t.TempDir()
+	db := Open(testOptions(dir))
+	for i := 0; i < 1000; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	// The deletions are replayed from the wal, the keys come from the tables
+	if _, err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i += 10 {
+		if err := db.Del(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, testOptions(dir))
+	var want []string
+	for i := 0; i < 1000; i++ {
+		if i%10 == 0 {
+			mustMiss(t, db, key(i))
+			continue
+		}
+		mustGet(t, db, key(i), value(i))
+		want = append(want, string(key(i)))
+	}
+	mustKeys(t, scan(t, db.NewIterator(&utils.Options{IsAsc: true})), want)
+	for i := 0; i < 1000; i += 3 {
+		mustSet(t, db, key(i), value(i+1000))
+	}
+	for i := 0; i < 1000; i += 3 {
+		mustGet(t, db, key(i), value(i+1000))
+	}
+}
+
+// TestDBGetAfterCompaction the values returned by Get stay valid once the compaction drops
+// the table they were read from
+func TestDBGetAfterCompaction(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	if _, err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := db.Get(key(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	te, err := txn.Get(key(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Key) != string(key(7)) || string(e.Value) != string(value(7)) {
+		t.Fatalf("get: got %q = %q after the compaction, want %q = %q", e.Key, e.Value, key(7), value(7))
+	}
+	if string(te.Value) != string(value(8)) {
+		t.Fatalf("txn get: got %q after the compaction, want %q", te.Value, value(8))
+	}
+}
+
+// TestDBFlattenStats Flatten reports the flush of the memTable along with the compactions
+func TestDBFlattenStats(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 500; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	stats, err := db.Flatten(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The memTable is flushed to one table of level 0, which is merged down
+	if stats.Compactions == 0 || stats.TablesIn < 2 || stats.TablesOut < 2 || stats.BytesOut == 0 {
+		t.Fatalf("got %+v, want the flush and the compaction of the memTable", stats)
+	}
+	if _, err := db.CompactRange(key(10), key(5)); err != utils.ErrInvalidRequest {
+		t.Fatalf("compact an empty range: got %v, want ErrInvalidRequest", err)
+	}
+	for i := 0; i < 500; i++ {
+		mustGet(t, db, key(i), value(i))
+	}
+}
+
+func TestDBCloseTwice(t *testing.T) {
+	db := Open(testOptions(t.TempDir()))
+	mustSet(t, db, key(1), value(1))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if err := db.Set(utils.NewEntry(key(2), value(2))); err != utils.ErrBlockedWrites {
+		t.Fatalf("set after close: got %v, want ErrBlockedWrites", err)
+	}
+}
+
+// TestDBCloseWithWriters the writers racing with Close either commit or get ErrBlockedWrites,
+// none of them hangs
+func TestDBCloseWithWriters(t *testing.T) {
+	db := Open(testOptions(t.TempDir()))
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				err := db.Set(utils.NewEntry(key(w*100000+i), value(i)))
+				if err == utils.ErrBlockedWrites {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("a writer hangs after Close")
+	}
+}
+
+// TestDBGroupCommit the concurrent writes are all committed with distinct versions
+func TestDBGroupCommit(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	const writers, writes = 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := db.Set(utils.NewEntry(key(w*writes+i), value(i))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	versions := make(map[uint64]bool)
+	for w := 0; w < writers; w++ {
+		for i := 0; i < writes; i++ {
+			e, err := db.Get(key(w*writes + i))
+			if err != nil {
+				t.Fatalf("get %s: %v", key(w*writes+i), err)
+			}
+			if versions[e.Version] {
+				t.Fatalf("version %d committed twice", e.Version)
+			}
+			versions[e.Version] = true
+		}
+	}
+}
+
+func TestDBDeleteRange(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	if err := db.DeleteRange(key(10), key(20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteRange(key(20), key(10)); err != utils.ErrInvalidRequest {
+		t.Fatalf("delete an empty range: got %v, want ErrInvalidRequest", err)
+	}
+	mustSet(t, db, key(15), value(15))
+	check := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if i >= 10 && i < 20 && i != 15 {
+				mustMiss(t, db, key(i))
+			} else {
+				mustGet(t, db, key(i), value(i))
+			}
+		}
+		if got := scan(t, db.NewIterator(&utils.Options{IsAsc: true})); len(got) != 91 {
+			t.Fatalf("scan: got %d keys, want 91", len(got))
+		}
+	}
+	check()
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// bigValue a value larger than ValueThreshold, it's kept in the vlog
+func bigValue(i int) []byte {
+	return bytes.Repeat(value(i), 200)
+}
+
+func TestDBCompressionReopen(t *testing.T) {
+	codecs := []utils.CompressionType{utils.NoCompression, utils.SnappyCompression, utils.ZSTDCompression}
+	for _, ct := range codecs {
+		dir := t.TempDir()
+		opt := testOptions(dir)
+		opt.Compression = ct
+		db := Open(opt)
+		for i := 0; i < 500; i++ {
+			v := value(i)
+			if i%50 == 0 {
+				v = bigValue(i)
+			}
+			mustSet(t, db, key(i), v)
+		}
+		if _, err := db.Flatten(1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Every table records its codec, a different one only applies to the new tables
+		for _, reopenCt := range []utils.CompressionType{ct, codecs[(int(ct)+1)%len(codecs)]} {
+			opt := testOptions(dir)
+			opt.Compression = reopenCt
+			db := Open(opt)
+			for i := 0; i < 500; i++ {
+				want := value(i)
+				if i%50 == 0 {
+					want = bigValue(i)
+				}
+				mustGet(t, db, key(i), want)
+			}
+			if got := scan(t, db.NewIterator(&utils.Options{IsAsc: true})); len(got) != 500 {
+				t.Fatalf("codec %d reopened with %d: got %d keys, want 500", ct, reopenCt, len(got))
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// mustNotContain fails if a file of dir holds the data as it is
+func mustNotContain(t testing.TB, dir string, data []byte) {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		buf, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, data) {
+			t.Fatalf("%s holds %q in plain text", f.Name(), data)
+		}
+	}
+}
+
+func TestDBEncryptionReopen(t *testing.T) {
+	dir := t.TempDir()
+	encryptionKey := bytes.Repeat([]byte("k"), 32)
+	opt := testOptions(dir)
+	opt.EncryptionKey = encryptionKey
+	db := Open(opt)
+	secret := []byte("top-secret-value")
+	for i := 0; i < 500; i++ {
+		v := append(append([]byte{}, secret...), value(i)...)
+		if i%50 == 0 {
+			v = append(v, bigValue(i)...)
+		}
+		mustSet(t, db, key(i), v)
+	}
+	// Some keys in the tables and in the vlog, the rest in the wal
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 500; i < 600; i++ {
+		mustSet(t, db, key(i), append(append([]byte{}, secret...), value(i)...))
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	mustNotContain(t, dir, secret)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mustNotContain(t, dir, secret)
+
+	check := func(opt *Options) {
+		t.Helper()
+		db := Open(opt)
+		defer db.Close()
+		for i := 0; i < 600; i++ {
+			want := append(append([]byte{}, secret...), value(i)...)
+			if i < 500 && i%50 == 0 {
+				want = append(want, bigValue(i)...)
+			}
+			mustGet(t, db, key(i), want)
+		}
+	}
+	check(opt)
+
+	// The db can't be opened without the key, nor with another one
+	for _, wrong := range [][]byte{nil, bytes.Repeat([]byte("x"), 32)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("opened with the key %q", wrong)
+				}
+			}()
+			opt := testOptions(dir)
+			opt.EncryptionKey = wrong
+			Open(opt).Close()
+		}()
+	}
+
+	// Only the data keys are encrypted again by the new master key
+	newKey := bytes.Repeat([]byte("n"), 16)
+	if err := RotateEncryptionKey(dir, encryptionKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	opt = testOptions(dir)
+	opt.EncryptionKey = newKey
+	check(opt)
+}
+
+// crashCopy copies the files of the open db into a new dir, as they would be found after the
+// process died. The manifest is copied first so that every table it holds is copied as well
+func crashCopy(t testing.TB, dir string) string {
+	t.Helper()
+	to := t.TempDir()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() == utils.ManifestFilename })
+	for _, f := range files {
+		buf, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if os.IsNotExist(err) {
+			// Removed by a compaction or a flush meanwhile
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(to, f.Name()), buf, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return to
+}
+
+// TestDBSyncModes the writes acknowledged before Sync are found after a crash in every mode
+func TestDBSyncModes(t *testing.T) {
+	for _, mode := range []utils.SyncMode{utils.SyncEveryInterval, utils.SyncEveryWrite, utils.SyncNever} {
+		dir := t.TempDir()
+		opt := testOptions(dir)
+		opt.SyncMode = mode
+		opt.SyncInterval = 10 * time.Millisecond
+		db := openTestDB(t, opt)
+		for i := 0; i < 500; i++ {
+			v := value(i)
+			if i%50 == 0 {
+				v = bigValue(i)
+			}
+			mustSet(t, db, key(i), v)
+		}
+		if err := db.Del(key(7)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatalf("sync mode %d: %v", mode, err)
+		}
+		reopened := openTestDB(t, testOptions(crashCopy(t, dir)))
+		for i := 0; i < 500; i++ {
+			want := value(i)
+			if i%50 == 0 {
+				want = bigValue(i)
+			}
+			if i == 7 {
+				mustMiss(t, reopened, key(i))
+				continue
+			}
+			mustGet(t, reopened, key(i), want)
+		}
+	}
+}
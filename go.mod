@@ -5,6 +5,8 @@ go 1.18
 require (
 	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/golang/protobuf v1.5.2
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.15.12
 	github.com/pkg/errors v0.9.1
 	golang.org/x/sys v0.1.0
 )
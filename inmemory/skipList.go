@@ -52,7 +52,8 @@ func newNode(memPool *MemPool, key []byte, v utils.ValueStruct, height int) *nod
 
 	node := memPool.getNode(nodeOffset)
 	node.keyOffset = keyOffset
-	node.keySize = uint16(height)
+	node.keySize = uint16(len(key))
+	node.height = uint16(height)
 	node.value = val
 	return node
 }
@@ -199,7 +200,7 @@ func (s *SkipList) Set(e *utils.Entry) {
 			// 如果被占用则直接覆盖重置
 			if prev[i] == next[i] {
 				if i == 0 {
-					log.Fatal("Equality can happen only on base level: %d", i)
+					log.Fatalf("Equality can happen only on base level: %d", i)
 				}
 				vo := s.memPool.putVal(v)
 				encValue := encodeValue(vo, v.EncodedSize())
@@ -259,7 +260,7 @@ func (s *SkipList) Search(key []byte) utils.ValueStruct {
 
 	valOffset, valSize := n.getValueOffset()
 	vs := s.memPool.getVal(valOffset, valSize)
-	vs.ExpiresAt = ParseTs(nextKey)
+	vs.Version = ParseTs(nextKey)
 	return vs
 }
 
@@ -324,6 +325,31 @@ func (s *SkipList) findNear(key []byte, left bool, allowEqual bool) (*node, bool
 	}
 }
 
+// findLast returns the last node of the list, nil if the list is empty
+func (s *SkipList) findLast() *node {
+	n := s.getHead()
+	level := int(s.getHeight()) - 1
+	for {
+		next := s.getNext(n, level)
+		if next != nil {
+			n = next
+			continue
+		}
+		if level == 0 {
+			if n == s.getHead() {
+				return nil
+			}
+			return n
+		}
+		level--
+	}
+}
+
+// Empty returns true if the Skiplist is empty.
+func (s *SkipList) Empty() bool {
+	return s.getNext(s.getHead(), 0) == nil
+}
+
 // MemSize returns the size of the Skiplist in terms of how much memory is used within its internal
 // arena.
 func (s *SkipList) MemSize() int64 { return s.memPool.size() }
@@ -345,8 +371,9 @@ func (s *SkipList) DecrRef() {
 func FastRand() uint32
 
 type SkipListIterator struct {
-	list *SkipList
-	n    *node
+	list     *SkipList
+	n        *node
+	reversed bool // Next moves to the smaller keys, Seek finds the last key <= target
 }
 
 func (s *SkipList) NewSkipListIterator() utils.Iterator {
@@ -354,26 +381,48 @@ func (s *SkipList) NewSkipListIterator() utils.Iterator {
 	return &SkipListIterator{list: s}
 }
 
+// NewIterator returns the iterator of the list in the order of opt.IsAsc
+func (s *SkipList) NewIterator(opt *utils.Options) utils.Iterator {
+	s.IncrRef()
+	return &SkipListIterator{list: s, reversed: !opt.IsAsc}
+}
+
 func (s *SkipListIterator) Next() {
 	AssertTrue(s.Valid())
+	if s.reversed {
+		s.Prev()
+		return
+	}
 	s.n = s.list.getNext(s.n, 0)
 }
 
+// Prev moves to the previous node, the list has no back links so it's searched from the head.
+// A step takes O(log n) where Next takes O(1), a reverse scan of the list takes O(n log n)
+func (s *SkipListIterator) Prev() {
+	AssertTrue(s.Valid())
+	s.n, _ = s.list.findNear(s.Key(), true, false) // find <.
+}
+
 func (s *SkipListIterator) Valid() bool {
 	return s.n != nil
 }
 
 func (s *SkipListIterator) Rewind() {
+	if s.reversed {
+		s.SeekToLast()
+		return
+	}
 	s.SeekToFirst()
 }
 
 func (s *SkipListIterator) Item() utils.Item {
+	vs := s.Value()
 	return &utils.Entry{
 		Key:       s.Key(),
-		Value:     s.Value().Value,
-		ExpiresAt: s.Value().ExpiresAt,
-		Meta:      s.Value().Meta,
-		Version:   s.Value().Version,
+		Value:     vs.Value,
+		ExpiresAt: vs.ExpiresAt,
+		Meta:      vs.Meta,
+		Version:   ParseTs(s.Key()),
 	}
 }
 
@@ -383,9 +432,18 @@ func (s *SkipListIterator) Close() error {
 }
 
 func (s *SkipListIterator) Seek(target []byte) {
+	if s.reversed {
+		s.SeekForPrev(target)
+		return
+	}
 	s.n, _ = s.list.findNear(target, false, true) // find >=.
 }
 
+// SeekForPrev finds the last entry <= target
+func (s *SkipListIterator) SeekForPrev(target []byte) {
+	s.n, _ = s.list.findNear(target, true, true) // find <=.
+}
+
 // Key returns the key at the current position.
 func (s *SkipListIterator) Key() []byte {
 	return s.list.memPool.getKey(s.n.keyOffset, s.n.keySize)
@@ -402,3 +460,9 @@ func (s *SkipListIterator) Value() utils.ValueStruct {
 func (s *SkipListIterator) SeekToFirst() {
 	s.n = s.list.getNext(s.list.getHead(), 0)
 }
+
+// SeekToLast seeks position at the last entry in list.
+// Final state of iterator is Valid() iff list is not empty.
+func (s *SkipListIterator) SeekToLast() {
+	s.n = s.list.findLast()
+}
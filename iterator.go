@@ -0,0 +1,111 @@
+package FayKV
+
+import (
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"math"
+)
+
+// DBIterator the iterator of the db, it reads the values kept in the vlog. A value which
+// can't be read stops the iteration, Err returns why
+type DBIterator struct {
+	iitr   utils.Iterator
+	vlog   *valueLog
+	orc    *oracle
+	readTs uint64
+	// item the current item with its value, nil until Valid reads it
+	item *Item
+	err  error
+}
+
+type Item struct {
+	e *utils.Entry
+}
+
+func (it *Item) Entry() *utils.Entry {
+	return it.e
+}
+
+// NewIterator returns the iterator of the latest versions
+func (db *DB) NewIterator(opt *utils.Options) *DBIterator {
+	return db.newIterator(opt, db.orc.pinReadTs())
+}
+
+// newIterator returns the iterator of the versions visible at readTs, readTs must be pinned
+// and it's unpinned when the iterator is closed
+func (db *DB) newIterator(opt *utils.Options, readTs uint64) *DBIterator {
+	// The vlog files the iterator may point to are kept until it is closed
+	db.vlog.incrReaders()
+	return &DBIterator{
+		iitr:   db.lsm.NewIteratorAt(opt, readTs),
+		vlog:   db.vlog,
+		orc:    db.orc,
+		readTs: readTs,
+	}
+}
+
+func (iter *DBIterator) Next() {
+	iter.item = nil
+	iter.iitr.Next()
+}
+
+// Valid reads the value of the current item, it returns false if the value can't be read
+func (iter *DBIterator) Valid() bool {
+	if iter.err != nil || !iter.iitr.Valid() {
+		return false
+	}
+	if iter.item == nil {
+		iter.item, iter.err = iter.readItem()
+	}
+	return iter.err == nil
+}
+
+func (iter *DBIterator) Rewind() {
+	iter.item, iter.err = nil, nil
+	iter.iitr.Rewind()
+}
+
+// Item returns the current item, it must only be called while the iterator is valid
+func (iter *DBIterator) Item() utils.Item {
+	if iter.item == nil {
+		iter.Valid()
+	}
+	return iter.item
+}
+
+// Err returns the error which stopped the iteration, nil if it ran to the end
+func (iter *DBIterator) Err() error {
+	return iter.err
+}
+
+// readItem returns the current entry with its value read from the vlog
+func (iter *DBIterator) readItem() (*Item, error) {
+	// The lsm iterator hands out a copy, the item stays valid after Next
+	e := iter.iitr.Item().Entry()
+	// Hide the version suffix from the caller
+	item := &Item{e: &utils.Entry{
+		Key:       inmemory.ParseKey(e.Key),
+		Value:     e.Value,
+		ExpiresAt: e.ExpiresAt,
+		Meta:      e.Meta,
+		Version:   inmemory.ParseTs(e.Key),
+	}}
+	if err := iter.vlog.resolve(item.e); err != nil {
+		return nil, errors.WithMessagef(err, "while reading the value of %s from the vlog", item.e.Key)
+	}
+	return item, nil
+}
+
+func (iter *DBIterator) Close() error {
+	if err := iter.iitr.Close(); err != nil {
+		return err
+	}
+	iter.orc.unpinReadTs(iter.readTs)
+	return iter.vlog.decrReaders()
+}
+
+func (iter *DBIterator) Seek(key []byte) {
+	iter.item, iter.err = nil, nil
+	iter.iitr.Seek(inmemory.KeyWithTs(key, math.MaxUint64))
+}
@@ -0,0 +1,295 @@
+package FayKV
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// fillLayers writes n keys spread over the last level, level 0 and the memTable, it returns
+// the value of every key left
+func fillLayers(t testing.TB, db *DB, n int) map[string]string {
+	t.Helper()
+	want := make(map[string]string)
+	for i := 0; i < n; i++ {
+		mustSet(t, db, key(i), value(i))
+		want[string(key(i))] = string(value(i))
+	}
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i += 3 {
+		mustSet(t, db, key(i), value(i+1000))
+		want[string(key(i))] = string(value(i + 1000))
+	}
+	if _, err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i += 5 {
+		if err := db.Del(key(i)); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, string(key(i)))
+	}
+	return want
+}
+
+// sortedKeys returns the keys of [lower, upper) in order, a nil bound leaves the range open
+func sortedKeys(want map[string]string, lower, upper []byte, reverse bool) []string {
+	var keys []string
+	for k := range want {
+		if lower != nil && k < string(lower) || upper != nil && k >= string(upper) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	return keys
+}
+
+func mustKeys(t testing.TB, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d keys, want %d: %v", len(got), len(want), got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("key %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestIteratorValues(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	want := fillLayers(t, db, 300)
+	for _, asc := range []bool{true, false} {
+		it := db.NewIterator(&utils.Options{IsAsc: asc})
+		n := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			e := it.Item().Entry()
+			if v, ok := want[string(e.Key)]; !ok || v != string(e.Value) {
+				t.Fatalf("asc %v: got %s = %q, want %q", asc, e.Key, e.Value, v)
+			}
+			n++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(want) {
+			t.Fatalf("asc %v: got %d keys, want %d", asc, n, len(want))
+		}
+	}
+}
+
+func TestIteratorReverse(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	want := fillLayers(t, db, 300)
+	mustKeys(t, scan(t, db.NewIterator(&utils.Options{IsAsc: true})), sortedKeys(want, nil, nil, false))
+	mustKeys(t, scan(t, db.NewIterator(&utils.Options{IsAsc: false})), sortedKeys(want, nil, nil, true))
+}
+
+// TestIteratorReverseSeek in reverse order Seek moves to the last key at or before the key
+func TestIteratorReverseSeek(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	want := fillLayers(t, db, 300)
+	it := db.NewIterator(&utils.Options{IsAsc: false})
+	defer it.Close()
+	for _, seek := range []int{299, 151, 150, 100, 1, 0} {
+		it.Seek(key(seek))
+		expected := sortedKeys(want, nil, append(key(seek), 0), true)
+		if len(expected) == 0 {
+			if it.Valid() {
+				t.Fatalf("seek %d: got %s, want nothing", seek, it.Item().Entry().Key)
+			}
+			continue
+		}
+		if !it.Valid() || string(it.Item().Entry().Key) != expected[0] {
+			t.Fatalf("seek %d: got valid %v, want %s", seek, it.Valid(), expected[0])
+		}
+		it.Next()
+		if len(expected) > 1 && (!it.Valid() || string(it.Item().Entry().Key) != expected[1]) {
+			t.Fatalf("seek %d then next: got valid %v, want %s", seek, it.Valid(), expected[1])
+		}
+	}
+}
+
+// TestIteratorReverseSnapshot the reverse iteration of a snapshot returns the versions it sees
+func TestIteratorReverseSnapshot(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 50; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	snap := db.NewSnapshot()
+	defer snap.Discard()
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			mustSet(t, db, key(i), value(i+1000))
+		} else if err := db.Del(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustSet(t, db, key(100), value(100))
+	it := snap.NewIterator(&utils.Options{IsAsc: false})
+	i := 49
+	for it.Rewind(); it.Valid(); it.Next() {
+		e := it.Item().Entry()
+		if string(e.Key) != string(key(i)) || string(e.Value) != string(value(i)) {
+			t.Fatalf("got %s = %q, want %s = %q", e.Key, e.Value, key(i), value(i))
+		}
+		i--
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if i != -1 {
+		t.Fatalf("the scan stopped before key %d", i)
+	}
+}
+
+func TestIteratorBounds(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	want := fillLayers(t, db, 300)
+	bounds := []struct{ lower, upper []byte }{
+		{key(50), key(150)},
+		{key(50), nil},
+		{nil, key(150)},
+		// Bounds which are not keys
+		{[]byte("key000049x"), []byte("key000149x")},
+		{key(150), key(150)},
+		{key(400), nil},
+	}
+	for _, b := range bounds {
+		for _, asc := range []bool{true, false} {
+			opt := &utils.Options{IsAsc: asc, LowerBound: b.lower, UpperBound: b.upper}
+			got := scan(t, db.NewIterator(opt))
+			mustKeys(t, got, sortedKeys(want, b.lower, b.upper, !asc))
+		}
+	}
+}
+
+// TestIteratorBoundsSeek Seek never leaves the bounds
+func TestIteratorBoundsSeek(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 300; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	lower, upper := key(100), key(200)
+	asc := db.NewIterator(&utils.Options{IsAsc: true, LowerBound: lower, UpperBound: upper})
+	defer asc.Close()
+	asc.Seek(key(10))
+	if !asc.Valid() || string(asc.Item().Entry().Key) != string(lower) {
+		t.Fatalf("seek before the range: got valid %v, want %s", asc.Valid(), lower)
+	}
+	asc.Seek(key(250))
+	if asc.Valid() {
+		t.Fatalf("seek after the range: got %s, want nothing", asc.Item().Entry().Key)
+	}
+	desc := db.NewIterator(&utils.Options{IsAsc: false, LowerBound: lower, UpperBound: upper})
+	defer desc.Close()
+	desc.Seek(key(250))
+	if !desc.Valid() || string(desc.Item().Entry().Key) != string(key(199)) {
+		t.Fatalf("reverse seek after the range: got valid %v, want %s", desc.Valid(), key(199))
+	}
+	desc.Seek(key(10))
+	if desc.Valid() {
+		t.Fatalf("reverse seek before the range: got %s, want nothing", desc.Item().Entry().Key)
+	}
+}
+
+// TestIteratorItemAfterNext an item stays valid once the iterator moves on
+func TestIteratorItemAfterNext(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 300; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	if _, err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, asc := range []bool{true, false} {
+		it := db.NewIterator(&utils.Options{IsAsc: asc, LowerBound: key(10)})
+		var items []utils.Item
+		for it.Rewind(); it.Valid(); it.Next() {
+			items = append(items, it.Item())
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 290 {
+			t.Fatalf("asc %v: got %d items, want 290", asc, len(items))
+		}
+		for i, item := range items {
+			n := 10 + i
+			if !asc {
+				n = 299 - i
+			}
+			if e := item.Entry(); string(e.Key) != string(key(n)) || string(e.Value) != string(value(n)) {
+				t.Fatalf("asc %v: item %d is %s = %q, want %s = %q", asc, i, e.Key, e.Value, key(n), value(n))
+			}
+		}
+	}
+}
+
+// TestIteratorVlogError a value which can't be read from the vlog stops the iteration,
+// it's never returned as an empty value
+func TestIteratorVlogError(t *testing.T) {
+	dir := t.TempDir()
+	opt := testOptions(dir)
+	opt.VerifyValueChecksum = true
+	db := openTestDB(t, opt)
+	for i := 0; i < 10; i++ {
+		mustSet(t, db, key(i), bigValue(i))
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the value of key 5 in the vlog
+	files, err := filepath.Glob(filepath.Join(dir, "*"+utils.VlogFileExt))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got the vlog files %v, %v, want one", files, err)
+	}
+	buf, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := bytes.Index(buf, bigValue(5))
+	if off < 0 {
+		t.Fatal("the value is not in the vlog")
+	}
+	f, err := os.OpenFile(files[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), int64(off)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	it := db.NewIterator(&utils.Options{IsAsc: true})
+	var n int
+	for it.Rewind(); it.Valid(); it.Next() {
+		if e := it.Item().Entry(); string(e.Value) != string(bigValue(n)) {
+			t.Fatalf("%s: got a value of %d bytes, want %d", e.Key, len(e.Value), len(bigValue(n)))
+		}
+		n++
+	}
+	if n != 5 || it.Err() == nil {
+		t.Fatalf("got %d keys and the error %v, want 5 keys and an error", n, it.Err())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(key(5)); err == nil {
+		t.Fatal("get the corrupted value: got no error")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"math"
 	"os"
 	"sort"
+	"time"
 	"unsafe"
 )
 
@@ -23,10 +24,18 @@ type tableBuilder struct {
 	blockList     []*block
 	keyCount      uint32
 	keyHashes     []uint32
+	prefixHashes  []uint32 // The hashes of the distinct prefixes of the keys
+	lastPrefix    []byte
 	maxVersion    uint64
 	baseKey       []byte
 	staleDataSize int
 	estimateSz    int64
+	dataKey       *pb.DataKey // The blocks and the index are encrypted by it if it's not nil
+	falsePositive float64     // The false positive rate of the bloom filter, 0 builds none
+	// rangeTombstones the range deletions of the entries, they are kept in the index as well
+	rangeTombstones []*pb.RangeTombstone
+	// createdAt the time the data of the table was written, kept in the index
+	createdAt time.Time
 }
 
 type buildData struct {
@@ -46,6 +55,7 @@ type block struct {
 	entryOffsets      []uint32 // the offset of each key
 	end               int
 	estimateSz        int64
+	iv                []byte // The iv of the encrypted block
 }
 
 type header struct {
@@ -65,13 +75,34 @@ func (h header) encode() []byte {
 	return b[:]
 }
 
-func newTableBuilder(opt *Options) *tableBuilder {
+// newTableBuilder returns the builder of a table of the level
+func newTableBuilder(opt *Options, level int) *tableBuilder {
+	return newTableBuilderWithSSTSize(opt, opt.SSTableMaxSize, level)
+}
+
+func newTableBuilderWithSSTSize(opt *Options, size int64, level int) *tableBuilder {
+	// The new tables are encrypted by the latest data key
+	dk, err := opt.KeyRegistry.LatestDataKey()
+	utils.Panic(err)
 	return &tableBuilder{
-		opt:     opt,
-		sstSize: opt.SSTableMaxSize,
+		opt:           opt,
+		sstSize:       size,
+		dataKey:       dk,
+		falsePositive: opt.bloomFalsePositive(level),
+		createdAt:     time.Now(),
 	}
 }
 
+// empty returns true if no key has been added
+func (tb *tableBuilder) empty() bool {
+	return len(tb.keyHashes) == 0
+}
+
+// ReachedCapacity returns true if the blocks written so far exceed the expected table size
+func (tb *tableBuilder) ReachedCapacity() bool {
+	return tb.estimateSz > tb.sstSize
+}
+
 func (tb *tableBuilder) flush(lm *levelManager, tableName string) (t *table, err error) {
 	bd := tb.done()
 	t = &table{lm: lm, fid: utils.FID(tableName)}
@@ -80,6 +111,7 @@ func (tb *tableBuilder) flush(lm *levelManager, tableName string) (t *table, err
 		Dir:      lm.opt.WorkDir,
 		Flag:     os.O_CREATE | os.O_RDWR,
 		MaxSize:  bd.size,
+		DataKey:  tb.dataKey,
 	})
 	buf := make([]byte, bd.size)
 	written := bd.Copy(buf)
@@ -90,6 +122,13 @@ func (tb *tableBuilder) flush(lm *levelManager, tableName string) (t *table, err
 	}
 	// copy to the mmap buf
 	copy(dst, buf)
+	// The table must be durable before the manifest refers to it
+	if err := t.sst.Sync(); err != nil {
+		return nil, err
+	}
+	if err := persistent.SyncDir(lm.opt.WorkDir); err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
@@ -103,13 +142,16 @@ func (tb *tableBuilder) done() buildData {
 		blockList: tb.blockList,
 	}
 
-	var f faycache.Filter
-	if tb.opt.BloomFalsePositive > 0 {
-		f = faycache.BuildBloomFilter(tb.keyHashes, tb.opt.BloomFalsePositive)
+	var f, pf faycache.Filter
+	if tb.falsePositive > 0 {
+		f = faycache.BuildBloomFilter(tb.keyHashes, tb.falsePositive)
+		if len(tb.prefixHashes) > 0 {
+			pf = faycache.BuildBloomFilter(tb.prefixHashes, tb.falsePositive)
+		}
 	}
 
 	// when all the block are finish, then build the index of the SST
-	index, dataSize := tb.buildIndex(f)
+	index, dataSize := tb.buildIndex(f, pf)
 	checksum := tb.calculateChecksum(index)
 	bd.index = index
 	bd.checksum = checksum
@@ -127,20 +169,30 @@ func (tb *tableBuilder) add(entry *utils.Entry, isStale bool) {
 		ExpiresAt: entry.ExpiresAt,
 	}
 	// Check if new blocks are needed
+	if isStale {
+		// The entry is only kept until a compaction can drop it
+		tb.staleDataSize += len(key) + int(val.EncodedSize()) + 4 + 4
+	}
 	if tb.tryFinishBlock(entry) {
-		// check if cold block
-		if isStale {
-			tb.staleDataSize += len(key) + 4 + 4
-		}
 		tb.finishBlock()
 		// create new block and start writing
 		tb.curBlock = &block{data: make([]byte, tb.opt.BlockSize)}
 	}
-	// Parse delete ts, add to the hash list, all the key will save a hash value
+	// The filter holds the user keys, a lookup of any version of the key passes it
 	tb.keyHashes = append(tb.keyHashes, faycache.Hash(inmemory.ParseKey(key)))
+	if tb.opt.PrefixExtractor != nil {
+		// The keys are sorted, so the keys of a prefix are next to each other
+		if prefix := tb.opt.PrefixExtractor.Prefix(inmemory.ParseKey(key)); prefix != nil && !bytes.Equal(prefix, tb.lastPrefix) {
+			tb.prefixHashes = append(tb.prefixHashes, faycache.MixedHash(prefix))
+			tb.lastPrefix = append(tb.lastPrefix[:0], prefix...)
+		}
+	}
 	if version := inmemory.ParseTs(key); version > tb.maxVersion {
 		tb.maxVersion = version
 	}
+	if rt := newRangeTombstone(entry); rt != nil {
+		tb.rangeTombstones = append(tb.rangeTombstones, rt)
+	}
 
 	var diffKey []byte
 	if len(tb.curBlock.baseKey) == 0 {
@@ -201,12 +253,30 @@ func (tb *tableBuilder) finishBlock() {
 	tb.append(utils.U32SliceToBytes(tb.curBlock.entryOffsets))
 	tb.append(utils.U32ToBytes(uint32(len(tb.curBlock.entryOffsets))))
 
+	blockSz := tb.curBlock.estimateSz
+	if tb.opt.Compression != utils.NoCompression {
+		// The entries and their index are compressed, the checksum covers the compressed bytes
+		data, err := utils.Compress(tb.opt.Compression, tb.curBlock.data[:tb.curBlock.end])
+		utils.Panic(err)
+		tb.curBlock.data = data
+		tb.curBlock.end = len(data)
+		blockSz = int64(len(data)) + 8 + 4
+	}
+	if tb.dataKey != nil {
+		// Encrypted after the compression, the compression gains nothing on random bytes
+		iv, err := utils.GenerateIV()
+		utils.Panic(err)
+		data, err := utils.XORBlockAllocate(tb.curBlock.data[:tb.curBlock.end], tb.dataKey.Data, iv)
+		utils.Panic(err)
+		tb.curBlock.data = data
+		tb.curBlock.iv = iv
+	}
 	checksum := tb.calculateChecksum(tb.curBlock.data[:tb.curBlock.end])
 
 	// Append the block checksum and its length.
 	tb.append(checksum)
 	tb.append(utils.U32ToBytes(uint32(len(checksum))))
-	tb.estimateSz += tb.curBlock.estimateSz
+	tb.estimateSz += blockSz
 	tb.blockList = append(tb.blockList, tb.curBlock)
 	// add the key's num for statistic meta
 	tb.keyCount += uint32(len(tb.curBlock.entryOffsets))
@@ -214,13 +284,21 @@ func (tb *tableBuilder) finishBlock() {
 	return
 }
 
-func (tb tableBuilder) buildIndex(bloom []byte) ([]byte, uint32) {
+func (tb tableBuilder) buildIndex(bloom, prefixBloom []byte) ([]byte, uint32) {
 	tableIndex := &pb.TableIndex{}
 	if len(bloom) > 0 {
 		tableIndex.BloomFilter = bloom
 	}
+	if len(prefixBloom) > 0 {
+		tableIndex.PrefixBloomFilter = prefixBloom
+		tableIndex.PrefixExtractor = tb.opt.PrefixExtractor.Name()
+	}
 	tableIndex.KeyCount = tb.keyCount
 	tableIndex.MaxVersion = tb.maxVersion
+	tableIndex.StaleDataSize = uint32(tb.staleDataSize)
+	tableIndex.Compression = uint32(tb.opt.Compression)
+	tableIndex.RangeTombstones = tb.rangeTombstones
+	tableIndex.CreatedAt = tb.createdAt.UnixNano()
 	tableIndex.Offsets = tb.writeBlockOffsets(tableIndex)
 	var dataSize uint32
 	for i := range tb.blockList {
@@ -228,6 +306,13 @@ func (tb tableBuilder) buildIndex(bloom []byte) ([]byte, uint32) {
 	}
 	data, err := tableIndex.Marshal()
 	utils.Panic(err)
+	if tb.dataKey != nil {
+		// | encrypted index | iv |
+		iv, err := utils.GenerateIV()
+		utils.Panic(err)
+		utils.Panic(utils.XORBlock(data, data, tb.dataKey.Data, iv))
+		data = append(data, iv...)
+	}
 	return data, dataSize
 }
 
@@ -247,6 +332,7 @@ func (tb *tableBuilder) writeBlockOffset(bl *block, startOffset uint32) *pb.Bloc
 	offset.Key = bl.baseKey
 	offset.Len = uint32(bl.end)
 	offset.Offset = startOffset
+	offset.Iv = bl.iv
 	return offset
 }
 
@@ -338,28 +424,23 @@ func (itr *blockIterator) setBlock(b *block) {
 }
 
 func (itr *blockIterator) Next() {
-	//TODO implement me
-	panic("implement me")
+	itr.setIdx(itr.idx + 1)
 }
 
 func (itr *blockIterator) Valid() bool {
-	//TODO implement me
-	panic("implement me")
+	return itr.err != io.EOF
 }
 
 func (itr *blockIterator) Rewind() {
-	//TODO implement me
-	panic("implement me")
+	itr.seekToFirst()
 }
 
 func (itr *blockIterator) Item() utils.Item {
-	//TODO implement me
-	panic("implement me")
+	return itr.it
 }
 
 func (itr *blockIterator) Close() error {
-	//TODO implement me
-	panic("implement me")
+	return nil
 }
 
 func (itr *blockIterator) Seek(key []byte) {
@@ -378,6 +459,21 @@ func (itr *blockIterator) Seek(key []byte) {
 
 }
 
+// seekForPrev brings us to the last element <= key
+func (itr *blockIterator) seekForPrev(key []byte) {
+	itr.err = nil
+	foundEntryIdx := sort.Search(len(itr.entryOffsets), func(idx int) bool {
+		itr.setIdx(idx)
+		return inmemory.CompareKeys(itr.key, key) > 0
+	})
+	itr.setIdx(foundEntryIdx - 1)
+}
+
+// prev brings us to the previous element, io.EOF before the first one
+func (itr *blockIterator) prev() {
+	itr.setIdx(itr.idx - 1)
+}
+
 func (itr *blockIterator) Error() error {
 	return itr.err
 }
@@ -1,12 +1,942 @@
 package lsm
 
+import (
+	"bytes"
+	"fmt"
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/pb"
+	"github.com/Kirov7/FayKV/persistent"
+	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// compactStatus records the tables and key ranges under compaction on every level,
+// so that the compacters never pick the same tables at the same time
 type compactStatus struct {
+	sync.RWMutex
+	levels []*levelCompactStatus
+	tables map[uint64]struct{}
+}
+
+type levelCompactStatus struct {
+	ranges  []keyRange
+	delSize int64
+}
+
+type compactionPriority struct {
+	level    int
+	score    float64
+	adjusted float64
+	t        targets
+}
+
+// targets the expected size of every level and the file size of the tables written to it
+type targets struct {
+	baseLevel int
+	targetSz  []int64
+	fileSz    []int64
+}
+
+type compactDef struct {
+	compactorId int
+	t           targets
+	p           compactionPriority
+	thisLevel   *levelHandler
+	nextLevel   *levelHandler
+
+	top []*table
+	bot []*table
+
+	thisRange keyRange
+	nextRange keyRange
+
+	thisSize int64
+
+	// runs the levels other than thisLevel which some of the top tables come from,
+	// the tiered strategy merges the runs of several levels at once
+	runs []*levelHandler
+}
+
+type thisAndNextLevelRLocked struct{}
+
+type levelHandlerRLocked struct{}
+
+func (cd *compactDef) lockLevels() {
+	cd.thisLevel.RLock()
+	if cd.nextLevel != cd.thisLevel {
+		cd.nextLevel.RLock()
+	}
+}
+
+func (cd *compactDef) unlockLevels() {
+	if cd.nextLevel != cd.thisLevel {
+		cd.nextLevel.RUnlock()
+	}
+	cd.thisLevel.RUnlock()
 }
 
 func (lsm *LSM) newCompactStatus() *compactStatus {
-	panic("todo")
+	cs := &compactStatus{
+		levels: make([]*levelCompactStatus, 0, lsm.option.MaxLevelNum),
+		tables: make(map[uint64]struct{}),
+	}
+	for i := 0; i < lsm.option.MaxLevelNum; i++ {
+		cs.levels = append(cs.levels, &levelCompactStatus{})
+	}
+	return cs
 }
 
+// runCompacter starts a compacter, it checks the levels periodically until the LSM is closed
 func (lm *levelManager) runCompacter(id int) {
-	panic("todo")
+	defer lm.lsm.closer.Done()
+	// Spread the compacters out so that they don't start at the same time
+	randomDelay := time.NewTimer(time.Duration(rand.Int31n(1000)) * time.Millisecond)
+	select {
+	case <-randomDelay.C:
+	case <-lm.lsm.closer.CloseSignal:
+		randomDelay.Stop()
+		return
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lm.runOnce(id)
+		case <-lm.lsm.closer.CloseSignal:
+			return
+		}
+	}
+}
+
+// runOnce runs the compaction the strategy finds the most urgent
+func (lm *levelManager) runOnce(id int) bool {
+	if id == 0 {
+		// The tables hidden by a range deletion are dropped before anything is rewritten
+		lm.dropCoveredTables()
+	}
+	defer lm.updateDebt()
+	return lm.opt.CompactionStrategy.compact(lm, id)
+}
+
+func (lm *levelManager) run(id int, p compactionPriority) bool {
+	err := lm.doCompact(id, p)
+	switch err {
+	case nil:
+		return true
+	case utils.ErrFillTables:
+		// Nothing can be compacted right now
+	default:
+		log.Printf("[taskID:%d] While running doCompact: %v\n ", id, err)
+	}
+	return false
+}
+
+func moveL0toFront(prios []compactionPriority) []compactionPriority {
+	idx := -1
+	for i, p := range prios {
+		if p.level == 0 {
+			idx = i
+			break
+		}
+	}
+	// If idx == -1, we didn't find L0.
+	// If idx == 0, then we don't need to do anything. L0 is already at the front.
+	if idx > 0 {
+		out := append([]compactionPriority{}, prios[idx])
+		out = append(out, prios[:idx]...)
+		out = append(out, prios[idx+1:]...)
+		return out
+	}
+	return prios
+}
+
+// levelTargets calculates the target size of every level, the last level is used as
+// the base and every upper level is LevelSizeMultiplier times smaller.
+func (lm *levelManager) levelTargets() targets {
+	adjust := func(sz int64) int64 {
+		if sz < lm.opt.BaseLevelSize {
+			return lm.opt.BaseLevelSize
+		}
+		return sz
+	}
+
+	t := targets{
+		targetSz: make([]int64, len(lm.levels)),
+		fileSz:   make([]int64, len(lm.levels)),
+	}
+	// The size of the db is approximately the size of the last level
+	dbSize := lm.lastLevel().getTotalSize()
+	for i := len(lm.levels) - 1; i > 0; i-- {
+		levelTargetSize := adjust(dbSize)
+		t.targetSz[i] = levelTargetSize
+		// The first level from the bottom whose target fits in BaseLevelSize is the base level
+		if t.baseLevel == 0 && levelTargetSize <= lm.opt.BaseLevelSize {
+			t.baseLevel = i
+		}
+		dbSize /= int64(lm.opt.LevelSizeMultiplier)
+	}
+
+	tsz := lm.opt.BaseTableSize
+	for i := 0; i < len(lm.levels); i++ {
+		if i == 0 {
+			// L0 is compacted by the number of tables, the tables are flushed memTables
+			t.fileSz[i] = lm.opt.MemTableSize
+		} else if i <= t.baseLevel {
+			t.fileSz[i] = tsz
+		} else {
+			tsz *= int64(lm.opt.TableSizeMultiplier)
+			t.fileSz[i] = tsz
+		}
+	}
+
+	// Bring the base level down to the last empty level.
+	for i := t.baseLevel + 1; i < len(lm.levels)-1; i++ {
+		if lm.levels[i].getTotalSize() > 0 {
+			break
+		}
+		t.baseLevel = i
+	}
+
+	// If the base level is empty and the next level size is less than the
+	// target size, pick the next level as the base level.
+	b := t.baseLevel
+	lvl := lm.levels
+	if b < len(lvl)-1 && lvl[b].getTotalSize() == 0 && lvl[b+1].getTotalSize() < t.targetSz[b+1] {
+		t.baseLevel++
+	}
+	return t
+}
+
+// pickCompactLevels scores every level and returns the ones that need a compaction,
+// the most urgent first
+func (lm *levelManager) pickCompactLevels() (prios []compactionPriority) {
+	t := lm.levelTargets()
+	addPriority := func(level int, score float64) {
+		pri := compactionPriority{
+			level:    level,
+			score:    score,
+			adjusted: score,
+			t:        t,
+		}
+		prios = append(prios, pri)
+	}
+
+	// L0 is scored by the number of tables
+	addPriority(0, float64(lm.levels[0].numTables())/float64(lm.opt.NumLevelZeroTables))
+
+	// L1+ are scored by the size, excluding the tables already under compaction
+	for i := 1; i < len(lm.levels); i++ {
+		delSize := lm.compactState.delSize(i)
+		l := lm.levels[i]
+		sz := l.getTotalSize() - delSize
+		addPriority(i, float64(sz)/float64(t.targetSz[i]))
+	}
+	utils.CondPanic(len(prios) != len(lm.levels), errors.New("[pickCompactLevels] len(prios) != len(lm.levels)"))
+
+	// Divide the score of a level by the score of the level below it. A level that is
+	// only over its target because the next level is over its own target gets a lower
+	// priority, the next level should be compacted first.
+	var prevLevel int
+	for level := t.baseLevel; level < len(lm.levels); level++ {
+		if prios[prevLevel].adjusted >= 1 {
+			// Avoid absurdly large scores by placing a floor on the score that we'll
+			// adjust a level by. The value of 0.01 was chosen somewhat arbitrarily
+			const minScore = 0.01
+			if prios[level].score >= minScore {
+				prios[prevLevel].adjusted /= prios[level].adjusted
+			} else {
+				prios[prevLevel].adjusted /= minScore
+			}
+		}
+		prevLevel = level
+	}
+
+	// Pick all the levels whose original score is >= 1.0, irrespective of their adjusted score.
+	// The last level is never compacted into itself.
+	out := prios[:0]
+	for _, p := range prios[:len(prios)-1] {
+		if p.score >= 1.0 {
+			out = append(out, p)
+		}
+	}
+	prios = out
+
+	sort.Slice(prios, func(i, j int) bool {
+		return prios[i].adjusted > prios[j].adjusted
+	})
+	return prios
+}
+
+func (lm *levelManager) lastLevel() *levelHandler {
+	return lm.levels[len(lm.levels)-1]
+}
+
+// doCompact picks some table on level l and compacts it to the next level
+func (lm *levelManager) doCompact(id int, p compactionPriority) error {
+	l := p.level
+	utils.CondPanic(l >= lm.opt.MaxLevelNum, errors.New("[doCompact] Sanity check. l >= lm.opt.MaxLevelNum")) // Sanity check.
+	if p.t.baseLevel == 0 {
+		p.t = lm.levelTargets()
+	}
+	cd := compactDef{
+		compactorId: id,
+		p:           p,
+		t:           p.t,
+		thisLevel:   lm.levels[l],
+	}
+
+	if l == 0 {
+		// L0 is always compacted to the base level
+		cd.nextLevel = lm.levels[p.t.baseLevel]
+		if !lm.fillTablesL0(&cd) {
+			return utils.ErrFillTables
+		}
+	} else {
+		cd.nextLevel = cd.thisLevel
+		if !cd.thisLevel.isLastLevel() {
+			cd.nextLevel = lm.levels[l+1]
+		}
+		if !lm.fillTables(&cd) {
+			return utils.ErrFillTables
+		}
+	}
+	// Release the key ranges once the compaction is finished
+	defer lm.compactState.delete(cd)
+
+	if _, err := lm.runCompactDef(id, l, cd); err != nil {
+		// This compaction couldn't be done successfully.
+		log.Printf("[Compactor: %d] LOG Compact FAILED with error: %+v: %+v", id, err, cd)
+		return err
+	}
+	return nil
+}
+
+// fillTablesL0 picks the tables of level 0 for the compaction
+func (lm *levelManager) fillTablesL0(cd *compactDef) bool {
+	utils.CondPanic(cd.nextLevel.levelNum == 0, errors.New("base level can't be zero"))
+	// If the priority has been adjusted, make sure that the adjusted score is at least 1.0
+	if cd.p.adjusted > 0.0 && cd.p.adjusted < 1.0 {
+		// Do not compact to Lbase if adjusted score is less than 1.0.
+		return false
+	}
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	top := cd.thisLevel.tables
+	if len(top) == 0 {
+		return false
+	}
+
+	var out []*table
+	var kr keyRange
+	// top[0] is the oldest table, start from it and take every newer table overlapping with
+	// the ones picked so far. A newer table can't be compacted before an older one with the
+	// same keys.
+	for _, t := range top {
+		dkr := getKeyRange(t)
+		if kr.overlapsWith(dkr) {
+			out = append(out, t)
+			kr.extend(dkr)
+		} else {
+			break
+		}
+	}
+	cd.thisRange = getKeyRange(out...)
+	cd.top = out
+
+	left, right := cd.nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+	cd.bot = make([]*table, right-left)
+	copy(cd.bot, cd.nextLevel.tables[left:right])
+
+	if len(cd.bot) == 0 {
+		cd.nextRange = cd.thisRange
+	} else {
+		cd.nextRange = getKeyRange(cd.bot...)
+	}
+	return lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd)
+}
+
+// fillTables picks one table of level n and its overlapping tables of level n+1
+func (lm *levelManager) fillTables(cd *compactDef) bool {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	tables := make([]*table, len(cd.thisLevel.tables))
+	copy(tables, cd.thisLevel.tables)
+	if len(tables) == 0 {
+		return false
+	}
+	// The last level is never compacted into itself
+	if cd.thisLevel.isLastLevel() {
+		return false
+	}
+	// We pick tables, so we compact older tables first. This is similar to
+	// kOldestLargestSeqFirst in RocksDB.
+	lm.sortByHeuristic(tables, cd)
+
+	for _, t := range tables {
+		cd.thisSize = t.Size()
+		cd.thisRange = getKeyRange(t)
+		// If we're already compacting this range, don't do anything.
+		if lm.compactState.overlapsWith(cd.thisLevel.levelNum, cd.thisRange) {
+			continue
+		}
+		cd.top = []*table{t}
+		left, right := cd.nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+
+		cd.bot = make([]*table, right-left)
+		copy(cd.bot, cd.nextLevel.tables[left:right])
+
+		if len(cd.bot) == 0 {
+			cd.bot = []*table{}
+			cd.nextRange = cd.thisRange
+			if !lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+				continue
+			}
+			return true
+		}
+		cd.nextRange = getKeyRange(cd.bot...)
+
+		if lm.compactState.overlapsWith(cd.nextLevel.levelNum, cd.nextRange) {
+			continue
+		}
+		if !lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// sortByHeuristic sorts tables in increasing order of MaxVersion, so we
+// compact older tables first.
+func (lm *levelManager) sortByHeuristic(tables []*table, cd *compactDef) {
+	if len(tables) == 0 || cd.nextLevel == nil {
+		return
+	}
+
+	// Sort tables by max version. This is what RocksDB does.
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].sst.Indexs().MaxVersion < tables[j].sst.Indexs().MaxVersion
+	})
+}
+
+// runCompactDef merges the picked tables and installs the result
+func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (stats CompactionStats, err error) {
+	if len(cd.t.fileSz) == 0 {
+		return stats, errors.New("Filesizes cannot be zero. Targets are not set")
+	}
+	timeStart := time.Now()
+
+	thisLevel := cd.thisLevel
+	nextLevel := cd.nextLevel
+
+	// The sizes are taken while the tables are still referenced by the levels
+	stats.Compactions = 1
+	stats.TablesIn = len(cd.top) + len(cd.bot)
+	for _, t := range append(cd.top[:len(cd.top):len(cd.top)], cd.bot...) {
+		stats.BytesIn += t.Size()
+	}
+	newTables, decr, err := lm.compactBuildTables(l, cd)
+	if err != nil {
+		return stats, err
+	}
+	stats.TablesOut = len(newTables)
+	for _, t := range newTables {
+		stats.BytesOut += t.Size()
+	}
+	defer func() {
+		// Only assign to err, if it's not already nil.
+		if decErr := decr(); err == nil {
+			err = decErr
+		}
+	}()
+	changeSet := buildChangeSet(&cd, newTables)
+
+	// The manifest is updated before the tables are replaced, so the old tables are deleted
+	// only after the new ones have been recorded
+	if err := lm.manifestFile.AddChanges(changeSet.Changes); err != nil {
+		return stats, err
+	}
+
+	toDel := cd.bot
+	if thisLevel == nextLevel {
+		// The tables are rewritten within the level, they are swapped at once so that the
+		// level never holds two tables of the same keys
+		toDel = append(cd.top[:len(cd.top):len(cd.top)], cd.bot...)
+	}
+	if err := nextLevel.replaceTables(toDel, newTables); err != nil {
+		return stats, err
+	}
+	if err := thisLevel.deleteTables(cd.top); err != nil {
+		return stats, err
+	}
+	for _, lh := range cd.runs {
+		if err := lh.deleteTables(cd.top); err != nil {
+			return stats, err
+		}
+	}
+
+	from := append(tablesToString(cd.top), tablesToString(cd.bot)...)
+	to := tablesToString(newTables)
+	if dur := time.Since(timeStart); dur > 2*time.Second {
+		log.Printf("[%d] LOG Compact %d->%d (%d, %d -> %d tables)."+
+			" [%s] -> [%s], took %v\n",
+			id, thisLevel.levelNum, nextLevel.levelNum, len(cd.top), len(cd.bot),
+			len(newTables), strings.Join(from, " "), strings.Join(to, " "),
+			dur.Round(time.Millisecond))
+	}
+	stats.Duration = time.Since(timeStart)
+	return stats, nil
+}
+
+// compactBuildTables merges the tables of the two levels and writes the result into new tables
+// of the next level. The returned func must be called once the new tables are installed.
+func (lm *levelManager) compactBuildTables(lev int, cd compactDef) ([]*table, func() error, error) {
+	topTables := cd.top
+	botTables := cd.bot
+	iterOpt := &utils.Options{
+		IsAsc: true,
+	}
+	var iters []utils.Iterator
+	switch {
+	case lev == 0 || len(cd.runs) > 0:
+		// The newer tables are at the end of level 0 and after the older runs, they go first
+		iters = append(iters, iteratorsReversed(topTables, iterOpt)...)
+	case len(topTables) > 0:
+		iters = []utils.Iterator{NewConcatIterator(topTables, iterOpt)}
+	}
+	iters = append(iters, NewConcatIterator(botTables, iterOpt))
+	it := NewMergeIterator(iters, false).(*MergeIterator)
+	// subcompact drops the duplicates itself
+	it.keepDups = true
+	defer it.Close() // Important to close the iterator to do ref counting.
+
+	newTables, err := lm.subcompact(it, cd)
+	if err != nil {
+		// Drop the tables already written, they are not referenced by the manifest
+		_ = decrRefs(newTables)
+		return nil, nil, err
+	}
+	// Sorting them by key so that they are installed in order
+	sort.Slice(newTables, func(i, j int) bool {
+		return inmemory.CompareKeys(newTables[i].sst.MaxKey(), newTables[j].sst.MaxKey()) < 0
+	})
+	return newTables, func() error { return decrRefs(newTables) }, nil
+}
+
+// subcompact writes the entries of the iterator into tables of the target file size.
+// The versions newer than the discard timestamp are kept, and the newest version at or
+// below it, the older ones can't be seen by any reader. That version is dropped as well
+// if it's a tombstone and no level below holds the key, or if a range deletion at or below
+// the discard timestamp hides it. A range deletion is kept until no other table holds its keys.
+func (lm *levelManager) subcompact(it utils.Iterator, cd compactDef) ([]*table, error) {
+	var newTables []*table
+	var lastKey []byte
+	var lastVersion uint64
+	// skipKey the rest of the versions of lastKey are dropped
+	var skipKey bool
+	discardTs := lm.discardTs()
+	rangeTombstones := lm.rangeTombstones(discardTs)
+	dropTombstones := !lm.checkOverlap(append(cd.top[:len(cd.top):len(cd.top)], cd.bot...), cd.nextLevel.levelNum+1)
+	// discardStats the bytes of the vlog files which are not referenced any more
+	discardStats := make(map[uint32]int64)
+	updateStats := func(e *utils.Entry) {
+		if utils.IsValuePtr(e) {
+			var vp utils.ValuePtr
+			vp.Decode(e.Value)
+			discardStats[vp.Fid] += int64(vp.Len)
+		}
+	}
+	addKeys := func(builder *tableBuilder) {
+		for ; it.Valid(); it.Next() {
+			entry := it.Item().Entry()
+			if !inmemory.SameKey(entry.Key, lastKey) {
+				// A new table only starts at the boundary of two keys, all the versions of
+				// a key stay in the same table
+				if len(lastKey) > 0 && builder.ReachedCapacity() {
+					break
+				}
+				lastKey = append(lastKey[:0], entry.Key...)
+				skipKey = false
+			} else {
+				// An older version of the key which is hidden, a range deletion is never hidden
+				hidden := skipKey && entry.Meta&utils.BitRangeDelete == 0
+				// A stale copy of the same version
+				stale := inmemory.ParseTs(entry.Key) == lastVersion
+				if hidden || stale {
+					updateStats(entry)
+					continue
+				}
+			}
+			lastVersion = inmemory.ParseTs(entry.Key)
+			if rt := newRangeTombstone(entry); rt != nil {
+				// Even an older version of the start key, the range goes beyond it
+				if lastVersion <= discardTs {
+					skipKey = true
+				}
+				if lastVersion > discardTs || lm.overlapsOutside(rt, cd) {
+					builder.add(entry, false)
+				}
+				continue
+			}
+			if coveredBy(rangeTombstones, inmemory.ParseKey(entry.Key), lastVersion) {
+				// No reader sees the key, nor any older version of it
+				updateStats(entry)
+				skipKey = true
+				continue
+			}
+			expired := entry.Meta&utils.BitDelete == 0 && entry.IsDeletedOrExpired()
+			if lastVersion <= discardTs {
+				skipKey = true
+				if dropTombstones && entry.IsDeletedOrExpired() {
+					// Nothing older is left for it to hide
+					if expired {
+						updateStats(entry)
+					}
+					continue
+				}
+			}
+			if expired {
+				// The value is dropped, a tombstone keeps hiding the older versions
+				updateStats(entry)
+				entry = &utils.Entry{Key: entry.Key, Meta: utils.BitDelete, ExpiresAt: entry.ExpiresAt}
+			}
+			builder.add(entry, expired)
+		}
+	}
+
+	it.Rewind()
+	for it.Valid() {
+		builder := newTableBuilderWithSSTSize(lm.opt, cd.t.fileSz[cd.nextLevel.levelNum], cd.nextLevel.levelNum)
+		// The data is as old as the newest table merged
+		builder.createdAt = newestCreatedAt(append(cd.top, cd.bot...))
+		addKeys(builder)
+		if builder.empty() {
+			// All the remaining keys have been dropped
+			continue
+		}
+		fileID := atomic.AddUint64(&lm.maxFID, 1)
+		t := openTable(lm, persistent.FileNameSSTable(lm.opt.WorkDir, fileID), builder)
+		if t == nil {
+			return newTables, errors.Errorf("failed to build table %d", fileID)
+		}
+		newTables = append(newTables, t)
+	}
+	lm.updateDiscardStats(discardStats)
+	return newTables, nil
+}
+
+// newestCreatedAt returns the time the newest of the tables was written
+func newestCreatedAt(tables []*table) time.Time {
+	var newest time.Time
+	for _, t := range tables {
+		if c := t.sst.CreatedAt(); c.After(newest) {
+			newest = c
+		}
+	}
+	return newest
+}
+
+// checkOverlap returns true if a level from lev on holds some of the keys of the tables
+func (lm *levelManager) checkOverlap(tables []*table, lev int) bool {
+	kr := getKeyRange(tables...)
+	for i := lev; i < len(lm.levels); i++ {
+		lh := lm.levels[i]
+		lh.RLock()
+		left, right := lh.overlappingTables(levelHandlerRLocked{}, kr)
+		lh.RUnlock()
+		if right-left > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// discardTs the timestamp at or below which only the newest version of a key is kept
+func (lm *levelManager) discardTs() uint64 {
+	if lm.opt.DiscardTs == nil {
+		return math.MaxUint64
+	}
+	return lm.opt.DiscardTs()
+}
+
+// updateDiscardStats reports the discarded bytes of the vlog files to the value log
+func (lm *levelManager) updateDiscardStats(discardStats map[uint32]int64) {
+	if len(discardStats) == 0 || lm.opt.DiscardStatsCh == nil {
+		return
+	}
+	select {
+	case *lm.opt.DiscardStatsCh <- discardStats:
+	case <-lm.lsm.closer.CloseSignal:
+	}
+}
+
+// iteratorsReversed returns the iterators of the tables in the reverse order
+func iteratorsReversed(th []*table, opt *utils.Options) []utils.Iterator {
+	out := make([]utils.Iterator, 0, len(th))
+	for i := len(th) - 1; i >= 0; i-- {
+		// This will increment the reference of the table handler.
+		out = append(out, th[i].NewIterator(opt))
+	}
+	return out
+}
+
+func buildChangeSet(cd *compactDef, newTables []*table) pb.ManifestChangeSet {
+	changes := []*pb.ManifestChange{}
+	for _, table := range newTables {
+		changes = append(changes, persistent.NewCreateChange(table.fid, cd.nextLevel.levelNum, table.sst.Checksum(), table.sst.KeyID()))
+	}
+	for _, table := range cd.top {
+		changes = append(changes, persistent.NewDeleteChange(table.fid))
+	}
+	for _, table := range cd.bot {
+		changes = append(changes, persistent.NewDeleteChange(table.fid))
+	}
+	return pb.ManifestChangeSet{Changes: changes}
+}
+
+// dropTables removes the top tables of the compaction from the manifest and from the level
+// without rewriting them
+func (lm *levelManager) dropTables(cd compactDef) error {
+	changes := make([]*pb.ManifestChange, 0, len(cd.top))
+	for _, t := range cd.top {
+		changes = append(changes, persistent.NewDeleteChange(t.fid))
+	}
+	if err := lm.manifestFile.AddChanges(changes); err != nil {
+		return err
+	}
+	// The values the tables point to are not referenced any more
+	discardStats := make(map[uint32]int64)
+	for _, t := range cd.top {
+		it := t.NewIterator(&utils.Options{IsAsc: true})
+		for it.Rewind(); it.Valid(); it.Next() {
+			if e := it.Item().Entry(); utils.IsValuePtr(e) {
+				var vp utils.ValuePtr
+				vp.Decode(e.Value)
+				discardStats[vp.Fid] += int64(vp.Len)
+			}
+		}
+		if err := it.Close(); err != nil {
+			return err
+		}
+	}
+	lm.updateDiscardStats(discardStats)
+	return cd.thisLevel.deleteTables(cd.top)
+}
+
+func tablesToString(tables []*table) []string {
+	var res []string
+	for _, t := range tables {
+		res = append(res, fmt.Sprintf("%05d", t.fid))
+	}
+	res = append(res, ".")
+	return res
+}
+
+// keyRange the range of the keys [left, right], the versions of the keys are ignored
+type keyRange struct {
+	left  []byte
+	right []byte
+	inf   bool
+}
+
+func (r keyRange) isEmpty() bool {
+	return len(r.left) == 0 && len(r.right) == 0 && !r.inf
+}
+
+func (r keyRange) String() string {
+	return fmt.Sprintf("[left=%x, right=%x, inf=%v]", r.left, r.right, r.inf)
+}
+
+func (r keyRange) equals(dst keyRange) bool {
+	return bytes.Equal(r.left, dst.left) &&
+		bytes.Equal(r.right, dst.right) &&
+		r.inf == dst.inf
+}
+
+func (r *keyRange) extend(kr keyRange) {
+	if kr.isEmpty() {
+		return
+	}
+	if r.isEmpty() {
+		*r = kr
+	}
+	if len(r.left) == 0 || inmemory.CompareKeys(kr.left, r.left) < 0 {
+		r.left = kr.left
+	}
+	if len(r.right) == 0 || inmemory.CompareKeys(kr.right, r.right) > 0 {
+		r.right = kr.right
+	}
+	if kr.inf {
+		r.inf = true
+	}
+}
+
+func (r keyRange) overlapsWith(dst keyRange) bool {
+	// Empty keyRange always overlaps.
+	if r.isEmpty() {
+		return true
+	}
+	// Empty dst doesn't overlap with anything.
+	if dst.isEmpty() {
+		return false
+	}
+	if r.inf || dst.inf {
+		return true
+	}
+
+	// [dst.left, dst.right] ... [r.left, r.right]
+	// If my left is greater than dst right, we have no overlap.
+	if inmemory.CompareKeys(r.left, dst.right) > 0 {
+		return false
+	}
+	// [r.left, r.right] ... [dst.left, dst.right]
+	// If my right is less than dst left, we have no overlap.
+	if inmemory.CompareKeys(r.right, dst.left) < 0 {
+		return false
+	}
+	// We have overlap.
+	return true
+}
+
+// getKeyRange returns the smallest and the biggest keys of the tables, the left key carries
+// the biggest version and the right key the smallest one so that every version is covered
+func getKeyRange(tables ...*table) keyRange {
+	if len(tables) == 0 {
+		return keyRange{}
+	}
+	smallest := tables[0].sst.MinKey()
+	biggest := tables[0].sst.MaxKey()
+	for i := 1; i < len(tables); i++ {
+		if inmemory.CompareKeys(tables[i].sst.MinKey(), smallest) < 0 {
+			smallest = tables[i].sst.MinKey()
+		}
+		if inmemory.CompareKeys(tables[i].sst.MaxKey(), biggest) > 0 {
+			biggest = tables[i].sst.MaxKey()
+		}
+	}
+
+	// We pick all the versions of the smallest and the biggest key. Note that version zero would
+	// be the rightmost key, considering versions are default sorted in descending order.
+	return keyRange{
+		left:  inmemory.KeyWithTs(inmemory.ParseKey(smallest), math.MaxUint64),
+		right: inmemory.KeyWithTs(inmemory.ParseKey(biggest), 0),
+	}
+}
+
+func (cs *compactStatus) overlapsWith(level int, this keyRange) bool {
+	cs.RLock()
+	defer cs.RUnlock()
+
+	thisLevel := cs.levels[level]
+	return thisLevel.overlapsWith(this)
+}
+
+func (cs *compactStatus) delSize(l int) int64 {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.levels[l].delSize
+}
+
+// delete releases the key ranges and the tables of a finished compaction
+func (cs *compactStatus) delete(cd compactDef) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	tl := cd.thisLevel.levelNum
+
+	thisLevel := cs.levels[cd.thisLevel.levelNum]
+	nextLevel := cs.levels[cd.nextLevel.levelNum]
+
+	thisLevel.delSize -= cd.thisSize
+	found := thisLevel.remove(cd.thisRange)
+	if cd.thisLevel != cd.nextLevel && !cd.nextRange.isEmpty() {
+		found = nextLevel.remove(cd.nextRange) && found
+	}
+
+	if !found {
+		log.Fatalf("keyRange not found, looking for %s in level %d:\n%s\nand for %s in level %d:\n%s",
+			cd.thisRange, tl, thisLevel.debug(), cd.nextRange, cd.nextLevel.levelNum, nextLevel.debug())
+	}
+	for _, t := range append(cd.top, cd.bot...) {
+		_, ok := cs.tables[t.fid]
+		utils.CondPanic(!ok, fmt.Errorf("cs.tables is nil"))
+		delete(cs.tables, t.fid)
+	}
+}
+
+// compareAndAdd registers the compaction if its key ranges don't overlap with any running one
+func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef) bool {
+	cs.Lock()
+	defer cs.Unlock()
+
+	tl := cd.thisLevel.levelNum
+	utils.CondPanic(tl >= len(cs.levels), fmt.Errorf("Got level %d. Max levels: %d", tl, len(cs.levels)))
+	thisLevel := cs.levels[cd.thisLevel.levelNum]
+	nextLevel := cs.levels[cd.nextLevel.levelNum]
+
+	if thisLevel.overlapsWith(cd.thisRange) {
+		return false
+	}
+	if nextLevel.overlapsWith(cd.nextRange) {
+		return false
+	}
+	for _, t := range append(cd.top, cd.bot...) {
+		if _, ok := cs.tables[t.fid]; ok {
+			return false
+		}
+	}
+	// Check whether this level really needs compaction or not. Otherwise, we'll end up
+	// running parallel compactions for the same level.
+	// Update: We should not be checking size here. Compaction priority already did the size checks.
+	// Here we should just be executing the wish of others.
+
+	thisLevel.ranges = append(thisLevel.ranges, cd.thisRange)
+	nextLevel.ranges = append(nextLevel.ranges, cd.nextRange)
+	thisLevel.delSize += cd.thisSize
+	for _, t := range append(cd.top, cd.bot...) {
+		cs.tables[t.fid] = struct{}{}
+	}
+	return true
+}
+
+func (lcs *levelCompactStatus) overlapsWith(dst keyRange) bool {
+	for _, r := range lcs.ranges {
+		if r.overlapsWith(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+func (lcs *levelCompactStatus) remove(dst keyRange) bool {
+	final := lcs.ranges[:0]
+	var found bool
+	for _, r := range lcs.ranges {
+		if !r.equals(dst) {
+			final = append(final, r)
+		} else {
+			found = true
+		}
+	}
+	lcs.ranges = final
+	return found
+}
+
+func (lcs *levelCompactStatus) debug() string {
+	var b bytes.Buffer
+	for _, r := range lcs.ranges {
+		b.WriteString(r.String())
+	}
+	return b.String()
 }
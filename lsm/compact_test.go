@@ -0,0 +1,203 @@
+package lsm
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// withDiscardTs sets the discard timestamp of the lsm to the value of ts, it can be changed later
+func withDiscardTs(opt *Options, ts *uint64) *Options {
+	opt.DiscardTs = func() uint64 {
+		return atomic.LoadUint64(ts)
+	}
+	return opt
+}
+
+// tableVersions returns the versions of the key held by the tables, the newest first
+func tableVersions(t testing.TB, lsm *LSM, k []byte) []uint64 {
+	t.Helper()
+	var versions []uint64
+	for _, lh := range lsm.levels.levels {
+		lh.RLock()
+		for _, tbl := range lh.tables {
+			it := tbl.NewIterator(&utils.Options{IsAsc: true})
+			for it.Rewind(); it.Valid(); it.Next() {
+				if e := it.Item().Entry(); bytes.Equal(inmemory.ParseKey(e.Key), k) {
+					versions = append(versions, inmemory.ParseTs(e.Key))
+				}
+			}
+			if err := it.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		lh.RUnlock()
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+	return versions
+}
+
+func mustVersions(t testing.TB, lsm *LSM, k []byte, want ...uint64) {
+	t.Helper()
+	got := tableVersions(t, lsm, k)
+	if len(got) != len(want) {
+		t.Fatalf("versions of %s: got %v, want %v", k, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("versions of %s: got %v, want %v", k, got, want)
+		}
+	}
+}
+
+// compactAll flushes the memTables and compacts all the tables into the last level
+func compactAll(t testing.TB, lsm *LSM) CompactionStats {
+	t.Helper()
+	mustFlush(t, lsm)
+	stats, err := lsm.CompactRange(nil, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestCompactionDropsTombstones(t *testing.T) {
+	discardTs := uint64(math.MaxUint64)
+	lsm := openTestLSM(t, withDiscardTs(testOptions(t.TempDir()), &discardTs))
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	mustSet(t, lsm, &utils.Entry{Key: inmemory.KeyWithTs(key(7), 2), Meta: utils.BitDelete})
+	mustFlush(t, lsm)
+	// The tombstone hides the key before any compaction
+	mustGet(t, lsm, key(7), 2, nil)
+	mustVersions(t, lsm, key(7), 2, 1)
+	compactAll(t, lsm)
+	// Nothing is left below the last level for the tombstone to hide
+	mustVersions(t, lsm, key(7))
+	mustGet(t, lsm, key(7), 2, nil)
+	mustGet(t, lsm, key(8), 2, value(8))
+}
+
+// TestCompactionKeepsTombstonesAbove a tombstone is kept as long as a level below holds the key
+func TestCompactionKeepsTombstonesAbove(t *testing.T) {
+	discardTs := uint64(math.MaxUint64)
+	lsm := openTestLSM(t, withDiscardTs(testOptions(t.TempDir()), &discardTs))
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	compactAll(t, lsm)
+	mustSet(t, lsm, &utils.Entry{Key: inmemory.KeyWithTs(key(7), 2), Meta: utils.BitDelete})
+	mustFlush(t, lsm)
+	// Level 0 into level 1 only, the last level still holds the old version
+	lm := lsm.levels
+	cd := compactDef{
+		t:         lm.levelTargets(),
+		thisLevel: lm.levels[0],
+		nextLevel: lm.levels[1],
+		top:       append([]*table{}, lm.levels[0].tables...),
+	}
+	cd.thisRange = getKeyRange(cd.top...)
+	cd.nextRange = cd.thisRange
+	if !lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, cd) {
+		t.Fatal("the compaction can't be registered")
+	}
+	_, err := lm.runCompactDef(0, 0, cd)
+	lm.compactState.delete(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustVersions(t, lsm, key(7), 2, 1)
+	mustGet(t, lsm, key(7), 2, nil)
+}
+
+func TestCompactionDropsExpired(t *testing.T) {
+	discardTs := uint64(1)
+	lsm := openTestLSM(t, withDiscardTs(testOptions(t.TempDir()), &discardTs))
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	expired := uint64(time.Now().Add(-time.Minute).Unix())
+	mustSet(t, lsm, &utils.Entry{Key: inmemory.KeyWithTs(key(7), 2), Value: value(1007), ExpiresAt: expired})
+	mustSet(t, lsm, entry(8, 2).WithTTL(time.Hour))
+	// The expired version hides the older ones
+	mustGet(t, lsm, key(7), 2, nil)
+	mustGet(t, lsm, key(7), 1, value(7))
+
+	// A reader at version 1 still sees the older version, the expired one keeps hiding it
+	// from the newer readers without its value
+	compactAll(t, lsm)
+	mustVersions(t, lsm, key(7), 2, 1)
+	mustGet(t, lsm, key(7), 2, nil)
+	mustGet(t, lsm, key(7), 1, value(7))
+
+	atomic.StoreUint64(&discardTs, math.MaxUint64)
+	compactAll(t, lsm)
+	mustVersions(t, lsm, key(7))
+	mustGet(t, lsm, key(7), 2, nil)
+	// The ttl of the newer version of key 8 has not passed
+	mustVersions(t, lsm, key(8), 2)
+	mustGet(t, lsm, key(8), 2, value(8))
+}
+
+// TestCompactionKeepsSnapshotVersions the versions a reader at or above the discard timestamp
+// sees are kept, the older ones are dropped
+func TestCompactionKeepsSnapshotVersions(t *testing.T) {
+	discardTs := uint64(3)
+	lsm := openTestLSM(t, withDiscardTs(testOptions(t.TempDir()), &discardTs))
+	for v := uint64(1); v <= 5; v++ {
+		mustSet(t, lsm, utils.NewEntry(inmemory.KeyWithTs(key(1), v), value(int(v))))
+	}
+	compactAll(t, lsm)
+	mustVersions(t, lsm, key(1), 5, 4, 3)
+	for v := uint64(3); v <= 5; v++ {
+		mustGet(t, lsm, key(1), v, value(int(v)))
+	}
+
+	atomic.StoreUint64(&discardTs, 5)
+	compactAll(t, lsm)
+	mustVersions(t, lsm, key(1), 5)
+	mustGet(t, lsm, key(1), 5, value(5))
+}
+
+// TestCompacterInBackground the compacters keep level 0 below NumLevelZeroTables while the
+// writes go on, the keys stay readable through the compactions
+func TestCompacterInBackground(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.NumCompactors = 2
+	lsm := openTestLSM(t, opt)
+	lsm.StartCompacter()
+	for v := uint64(1); v <= 8; v++ {
+		for i := 0; i < 1000; i++ {
+			mustSet(t, lsm, entry(i, v))
+		}
+		mustFlush(t, lsm)
+		for i := 0; i < 1000; i += 7 {
+			mustGet(t, lsm, key(i), v, value(i))
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for lsm.levels.levels[0].numTables() >= opt.NumLevelZeroTables {
+		if time.Now().After(deadline) {
+			t.Fatalf("level 0 still holds %d tables", lsm.levels.levels[0].numTables())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mustSortedRuns(t, lsm)
+	var below int
+	for _, lh := range lsm.levels.levels[1:] {
+		below += lh.numTables()
+	}
+	if below == 0 {
+		t.Fatal("no table was compacted below level 0")
+	}
+	for i := 0; i < 1000; i++ {
+		mustGet(t, lsm, key(i), 8, value(i))
+	}
+}
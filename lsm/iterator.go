@@ -1,11 +1,33 @@
 package lsm
 
-import "github.com/Kirov7/FayKV/utils"
+import (
+	"bytes"
+	"container/heap"
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/pb"
+	"github.com/Kirov7/FayKV/utils"
+	"math"
+	"sort"
+)
 
+// Iterator the iterator of the whole LSM. It merges the memTables and the levels, and only
+// returns the newest version at or below readTs of every key which is neither deleted nor expired.
 type Iterator struct {
-	it    Item
-	iters []utils.Iterator
+	opt     *utils.Options
+	readTs  uint64
+	mi      utils.Iterator // the merge of all the sources, in the order of opt.IsAsc
+	lastKey []byte         // the last key seen, the older versions of it are skipped
+	done    bool           // the iterator has left the range
+	// lower, upper the range of the user keys, the bounds of opt narrowed to the prefix.
+	// A nil bound leaves the range open
+	lower, upper []byte
+	// rangeTombstones the range deletions visible at readTs, the keys they hide are skipped
+	rangeTombstones []*pb.RangeTombstone
+	// cur the entry in descending order. The versions of a key come from the oldest to the
+	// newest, so the visible one is only known once the merge has moved past the key
+	cur *utils.Entry
 }
+
 type Item struct {
 	e *utils.Entry
 }
@@ -14,24 +36,451 @@ func (it *Item) Entry() *utils.Entry {
 	return it.e
 }
 
+// NewIterators returns the iterators of the memTables and the levels, the newest first
 func (lsm *LSM) NewIterators(opt *utils.Options) []utils.Iterator {
-	panic("todo")
+	lsm.RLock()
+	defer lsm.RUnlock()
+	iters := make([]utils.Iterator, 0, len(lsm.immutables)+1)
+	iters = append(iters, lsm.memTable.NewIterator(opt))
+	for i := len(lsm.immutables) - 1; i >= 0; i-- {
+		iters = append(iters, lsm.immutables[i].NewIterator(opt))
+	}
+	return append(iters, lsm.levels.iterators(opt)...)
+}
+
+// NewIterator returns the iterator of the latest versions
+func (lsm *LSM) NewIterator(opt *utils.Options) utils.Iterator {
+	return lsm.NewIteratorAt(opt, math.MaxUint64)
+}
+
+// NewIteratorAt returns the iterator of the versions visible at readTs
+func (lsm *LSM) NewIteratorAt(opt *utils.Options, readTs uint64) utils.Iterator {
+	lower, upper := opt.LowerBound, opt.UpperBound
+	if len(opt.Prefix) > 0 {
+		if lower == nil || bytes.Compare(opt.Prefix, lower) > 0 {
+			lower = opt.Prefix
+		}
+		if end := prefixEnd(opt.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+			upper = end
+		}
+	}
+	mergeOpt := &utils.Options{Prefix: opt.Prefix, IsAsc: opt.IsAsc, LowerBound: lower, UpperBound: upper}
+	return &Iterator{
+		opt:             opt,
+		readTs:          readTs,
+		mi:              NewMergeIterator(lsm.NewIterators(mergeOpt), !opt.IsAsc),
+		rangeTombstones: lsm.rangeTombstones(readTs),
+		lower:           lower,
+		upper:           upper,
+	}
 }
+
 func (iter *Iterator) Next() {
-	iter.iters[0].Next()
+	if !iter.opt.IsAsc {
+		// The merge iterator is at the oldest version of the next key already
+		iter.findPrevVisible()
+		return
+	}
+	iter.mi.Next()
+	iter.findVisible()
 }
+
 func (iter *Iterator) Valid() bool {
-	return iter.iters[0].Valid()
+	if !iter.opt.IsAsc {
+		return iter.cur != nil
+	}
+	return !iter.done && iter.mi.Valid()
 }
+
 func (iter *Iterator) Rewind() {
-	iter.iters[0].Rewind()
+	iter.lastKey = iter.lastKey[:0]
+	iter.done = false
+	if !iter.opt.IsAsc {
+		// Start from the last key of the range
+		if iter.upper != nil {
+			iter.mi.Seek(inmemory.KeyWithTs(iter.upper, math.MaxUint64))
+		} else {
+			iter.mi.Rewind()
+		}
+		iter.findPrevVisible()
+		return
+	}
+	if iter.lower != nil {
+		iter.mi.Seek(inmemory.KeyWithTs(iter.lower, math.MaxUint64))
+	} else {
+		iter.mi.Rewind()
+	}
+	iter.findVisible()
 }
+
 func (iter *Iterator) Item() utils.Item {
-	return iter.iters[0].Item()
+	if !iter.opt.IsAsc {
+		return &Item{e: iter.cur}
+	}
+	return &Item{e: copyEntry(iter.mi.Item().Entry())}
 }
+
 func (iter *Iterator) Close() error {
-	return nil
+	return iter.mi.Close()
 }
 
+// Seek in ascending order it moves to the first key >= key, in descending order
+// to the last key <= key
 func (iter *Iterator) Seek(key []byte) {
+	iter.lastKey = iter.lastKey[:0]
+	iter.done = false
+	userKey := inmemory.ParseKey(key)
+	if !iter.opt.IsAsc {
+		if iter.lower != nil && bytes.Compare(userKey, iter.lower) < 0 {
+			// Nothing of the range is at or before the key, no table is read
+			iter.cur = nil
+			return
+		}
+		// Never start after the range
+		if iter.upper != nil && bytes.Compare(userKey, iter.upper) >= 0 {
+			iter.mi.Seek(inmemory.KeyWithTs(iter.upper, math.MaxUint64))
+		} else {
+			// Version 0 is the last version of the key, all of them are taken
+			iter.mi.Seek(inmemory.KeyWithTs(userKey, 0))
+		}
+		iter.findPrevVisible()
+		return
+	}
+	if iter.upper != nil && bytes.Compare(userKey, iter.upper) >= 0 {
+		// Nothing of the range is at or after the key
+		iter.done = true
+		return
+	}
+	// Never start before the range
+	if iter.lower != nil && bytes.Compare(userKey, iter.lower) < 0 {
+		key = inmemory.KeyWithTs(iter.lower, math.MaxUint64)
+	}
+	iter.mi.Seek(key)
+	iter.findVisible()
+}
+
+// findVisible moves the merge iterator to the newest visible version of the next key,
+// skipping the newer and the older versions, the tombstones and the expired entries
+func (iter *Iterator) findVisible() {
+	for ; iter.mi.Valid(); iter.mi.Next() {
+		e := iter.mi.Item().Entry()
+		if iter.upper != nil && bytes.Compare(inmemory.ParseKey(e.Key), iter.upper) >= 0 {
+			// Every key from here on is after the range
+			iter.done = true
+			return
+		}
+		if inmemory.ParseTs(e.Key) > iter.readTs {
+			// Written after the read started
+			continue
+		}
+		if len(iter.lastKey) > 0 && inmemory.SameKey(e.Key, iter.lastKey) {
+			// An older version of the key
+			continue
+		}
+		iter.lastKey = append(iter.lastKey[:0], e.Key...)
+		if iter.hidden(e) {
+			// The older versions are hidden by it as well
+			continue
+		}
+		return
+	}
+}
+
+// findPrevVisible moves to the previous key which has a visible version. The merge iterator
+// returns the versions of a key from the oldest to the newest, the last one at or below readTs
+// is the visible one. The merge iterator is left at the oldest version of the key before it
+func (iter *Iterator) findPrevVisible() {
+	iter.cur = nil
+	for iter.mi.Valid() {
+		e := iter.mi.Item().Entry()
+		userKey := inmemory.ParseKey(e.Key)
+		if iter.lower != nil && bytes.Compare(userKey, iter.lower) < 0 {
+			// Every key from here on is before the range
+			return
+		}
+		if iter.upper != nil && bytes.Compare(userKey, iter.upper) >= 0 {
+			iter.mi.Next()
+			continue
+		}
+		iter.lastKey = append(iter.lastKey[:0], e.Key...)
+		var visible *utils.Entry
+		for ; iter.mi.Valid(); iter.mi.Next() {
+			v := iter.mi.Item().Entry()
+			if !inmemory.SameKey(v.Key, iter.lastKey) {
+				break
+			}
+			if inmemory.ParseTs(v.Key) <= iter.readTs {
+				visible = copyEntry(v)
+			}
+		}
+		if visible != nil && !iter.hidden(visible) {
+			iter.cur = visible
+			return
+		}
+	}
+}
+
+// copyEntry returns a copy of the entry, the block iterators reuse their buffers and the blocks
+// may be slices of the mmap of the table, so an entry is only valid until Next otherwise
+func copyEntry(e *utils.Entry) *utils.Entry {
+	return &utils.Entry{
+		Key:       append([]byte{}, e.Key...),
+		Value:     append([]byte{}, e.Value...),
+		ExpiresAt: e.ExpiresAt,
+		Meta:      e.Meta,
+		Version:   e.Version,
+	}
+}
+
+// hidden returns true if the version is a tombstone, it's expired or it's deleted by a range
+func (iter *Iterator) hidden(e *utils.Entry) bool {
+	return e.IsDeletedOrExpired() ||
+		coveredBy(iter.rangeTombstones, inmemory.ParseKey(e.Key), inmemory.ParseTs(e.Key))
+}
+
+// prefixEnd returns the smallest key after all the keys starting with the prefix,
+// nil if the prefix is empty or there is no such key
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// MergeIterator merges several sorted iterators into one. The iterators are given from
+// the newest to the oldest, when some of them are positioned at the same key only the
+// newest one is visible.
+type MergeIterator struct {
+	nodes []*mergeNode
+	h     mergeHeap
+	// curKey the key of the current entry, kept to skip the shadowed duplicates
+	curKey []byte
+	// keepDups the shadowed duplicates are returned as well, after the newest one.
+	// The compaction needs them to report the discarded values
+	keepDups bool
+}
+
+type mergeNode struct {
+	iter utils.Iterator
+	idx  int    // position in the input, smaller means newer
+	key  []byte // the key the iterator is positioned at
+}
+
+type mergeHeap struct {
+	nodes   []*mergeNode
+	reverse bool
+}
+
+func (h mergeHeap) Len() int { return len(h.nodes) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	cmp := inmemory.CompareKeys(h.nodes[i].key, h.nodes[j].key)
+	if cmp == 0 {
+		return h.nodes[i].idx < h.nodes[j].idx
+	}
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h mergeHeap) Swap(i, j int) { h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.nodes = append(h.nodes, x.(*mergeNode)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	n := h.nodes[len(h.nodes)-1]
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	return n
+}
+
+// NewMergeIterator the iterators must be ordered from the newest to the oldest
+func NewMergeIterator(iters []utils.Iterator, reverse bool) utils.Iterator {
+	mi := &MergeIterator{
+		nodes: make([]*mergeNode, 0, len(iters)),
+		h:     mergeHeap{nodes: make([]*mergeNode, 0, len(iters)), reverse: reverse},
+	}
+	for i, it := range iters {
+		mi.nodes = append(mi.nodes, &mergeNode{iter: it, idx: i})
+	}
+	return mi
+}
+
+// rebuild puts all the valid iterators back into the heap
+func (mi *MergeIterator) rebuild() {
+	mi.h.nodes = mi.h.nodes[:0]
+	for _, n := range mi.nodes {
+		if n.iter.Valid() {
+			n.key = n.iter.Item().Entry().Key
+			mi.h.nodes = append(mi.h.nodes, n)
+		}
+	}
+	heap.Init(&mi.h)
+}
+
+func (mi *MergeIterator) Next() {
+	if !mi.Valid() {
+		return
+	}
+	mi.curKey = append(mi.curKey[:0], mi.h.nodes[0].key...)
+	// Move every iterator positioned at the current key, the older ones are shadowed
+	for moved := false; len(mi.h.nodes) > 0 && bytes.Equal(mi.h.nodes[0].key, mi.curKey); moved = true {
+		if moved && mi.keepDups {
+			break
+		}
+		n := mi.h.nodes[0]
+		n.iter.Next()
+		if n.iter.Valid() {
+			n.key = n.iter.Item().Entry().Key
+			heap.Fix(&mi.h, 0)
+		} else {
+			heap.Pop(&mi.h)
+		}
+	}
+}
+
+func (mi *MergeIterator) Valid() bool {
+	return len(mi.h.nodes) > 0
+}
+
+func (mi *MergeIterator) Rewind() {
+	for _, n := range mi.nodes {
+		n.iter.Rewind()
+	}
+	mi.rebuild()
+}
+
+func (mi *MergeIterator) Item() utils.Item {
+	return mi.h.nodes[0].iter.Item()
+}
+
+func (mi *MergeIterator) Close() error {
+	var err error
+	for _, n := range mi.nodes {
+		if cerr := n.iter.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (mi *MergeIterator) Seek(key []byte) {
+	for _, n := range mi.nodes {
+		n.iter.Seek(key)
+	}
+	mi.rebuild()
+}
+
+// ConcatIterator concatenates the iterators of sorted tables which don't overlap,
+// the tables of level n for example
+type ConcatIterator struct {
+	idx     int // Which iterator is active now.
+	cur     utils.Iterator
+	iters   []utils.Iterator // Corresponds to tables.
+	tables  []*table         // The tables in ascending order
+	options *utils.Options
+}
+
+// NewConcatIterator the iterators of the tables are created when they are needed,
+// the tables are referenced until the iterator is closed
+func NewConcatIterator(tbls []*table, opt *utils.Options) *ConcatIterator {
+	for _, t := range tbls {
+		t.IncrRef()
+	}
+	return &ConcatIterator{
+		options: opt,
+		iters:   make([]utils.Iterator, len(tbls)),
+		tables:  tbls,
+		idx:     -1, // Not really necessary because s.it.Valid()=false, but good to have.
+	}
+}
+
+func (s *ConcatIterator) setIdx(idx int) {
+	s.idx = idx
+	if idx < 0 || idx >= len(s.iters) {
+		s.cur = nil
+		return
+	}
+	if s.iters[idx] == nil {
+		s.iters[idx] = s.tables[idx].NewIterator(s.options)
+	}
+	s.cur = s.iters[idx]
+}
+
+func (s *ConcatIterator) Rewind() {
+	if len(s.iters) == 0 {
+		return
+	}
+	if s.options.IsAsc {
+		s.setIdx(0)
+	} else {
+		s.setIdx(len(s.iters) - 1)
+	}
+	s.cur.Rewind()
+	s.skipEmpty()
+}
+
+func (s *ConcatIterator) Valid() bool {
+	return s.cur != nil && s.cur.Valid()
+}
+
+func (s *ConcatIterator) Item() utils.Item {
+	return s.cur.Item()
+}
+
+// Seek brings us to element >= key, in descending order to element <= key
+func (s *ConcatIterator) Seek(key []byte) {
+	var idx int
+	if s.options.IsAsc {
+		idx = sort.Search(len(s.tables), func(i int) bool {
+			return inmemory.CompareKeys(s.tables[i].sst.MaxKey(), key) >= 0
+		})
+	} else {
+		// The last table starting at or before the key
+		idx = sort.Search(len(s.tables), func(i int) bool {
+			return inmemory.CompareKeys(s.tables[i].sst.MinKey(), key) > 0
+		}) - 1
+	}
+	if idx < 0 || idx >= len(s.tables) {
+		s.setIdx(-1)
+		return
+	}
+	s.setIdx(idx)
+	s.cur.Seek(key)
+	s.skipEmpty()
+}
+
+func (s *ConcatIterator) Next() {
+	s.cur.Next()
+	s.skipEmpty()
+}
+
+// skipEmpty moves to the next table once the current one is exhausted
+func (s *ConcatIterator) skipEmpty() {
+	for s.cur != nil && !s.cur.Valid() {
+		if s.options.IsAsc {
+			s.setIdx(s.idx + 1)
+		} else {
+			s.setIdx(s.idx - 1)
+		}
+		if s.cur != nil {
+			s.cur.Rewind()
+		}
+	}
+}
+
+func (s *ConcatIterator) Close() error {
+	for _, it := range s.iters {
+		if it == nil {
+			continue
+		}
+		if err := it.Close(); err != nil {
+			return err
+		}
+	}
+	return decrRefs(s.tables)
 }
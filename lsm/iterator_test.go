@@ -0,0 +1,264 @@
+package lsm
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// TestTablesOfBounds the tables out of the bounds of the iteration are skipped
+func TestTablesOfBounds(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for i := 0; i < 2000; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	compactAll(t, lsm)
+	tables := lsm.levels.lastLevel().tables
+	if len(tables) < 2 {
+		t.Fatalf("got %d tables in the last level, want several", len(tables))
+	}
+	if got := tablesOf(tables, &utils.Options{}); len(got) != len(tables) {
+		t.Fatalf("no bounds: got %d tables, want %d", len(got), len(tables))
+	}
+	if got := tablesOf(tables, &utils.Options{LowerBound: key(10), UpperBound: key(11)}); len(got) != 1 {
+		t.Fatalf("one key: got %d tables, want 1", len(got))
+	}
+	if got := tablesOf(tables, &utils.Options{LowerBound: key(5000)}); len(got) != 0 {
+		t.Fatalf("after the last key: got %d tables, want 0", len(got))
+	}
+	if got := tablesOf(tables, &utils.Options{UpperBound: key(0)}); len(got) != 0 {
+		t.Fatalf("before the first key: got %d tables, want 0", len(got))
+	}
+}
+
+func TestIteratorBoundsAcrossTables(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for i := 0; i < 2000; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	compactAll(t, lsm)
+	for _, asc := range []bool{true, false} {
+		it := lsm.NewIterator(&utils.Options{IsAsc: asc, LowerBound: key(500), UpperBound: key(1500)})
+		n := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			want := 500 + n
+			if !asc {
+				want = 1499 - n
+			}
+			if k := inmemory.ParseKey(it.Item().Entry().Key); string(k) != string(key(want)) {
+				t.Fatalf("asc %v: got %s, want %s", asc, k, key(want))
+			}
+			n++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("asc %v: got %d keys, want 1000", asc, n)
+		}
+	}
+}
+
+// TestIteratorMergesLayers the newest version of a key wins whichever layer holds it: the
+// memTable, an immutable memTable, level 0 or the last level
+func TestIteratorMergesLayers(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	const n = 600
+	// version v of key i holds value(i + 1000*v), every layer a newer version of some keys
+	layer := func(v uint64, every int) {
+		for i := 0; i < n; i += every {
+			mustSet(t, lsm, utils.NewEntry(inmemory.KeyWithTs(key(i), v), value(i+1000*int(v))))
+		}
+	}
+	layer(1, 1)
+	compactAll(t, lsm)
+	layer(2, 2)
+	mustFlush(t, lsm)
+	layer(3, 3)
+	// Seal the memTable without queueing it, it stays immutable until it's handed to the flusher
+	lsm.Lock()
+	sealed := lsm.memTable
+	lsm.immutables = append(lsm.immutables, sealed)
+	lsm.memTable = lsm.NewMemTable()
+	lsm.Unlock()
+	// Close flushes it, the cleanups run the last registered first
+	t.Cleanup(func() { lsm.flushChan <- sealed })
+	layer(4, 5)
+	for i := 0; i < n; i += 7 {
+		mustSet(t, lsm, &utils.Entry{Key: inmemory.KeyWithTs(key(i), 5), Meta: utils.BitDelete})
+	}
+	if lsm.levels.lastLevel().numTables() == 0 || lsm.levels.levels[0].numTables() == 0 {
+		t.Fatal("the last level or level 0 holds no tables")
+	}
+
+	// newest returns the value of key i at readTs, nil if it's deleted
+	newest := func(i int, readTs uint64) []byte {
+		if readTs >= 5 && i%7 == 0 {
+			return nil
+		}
+		switch {
+		case readTs >= 4 && i%5 == 0:
+			return value(i + 4000)
+		case readTs >= 3 && i%3 == 0:
+			return value(i + 3000)
+		case readTs >= 2 && i%2 == 0:
+			return value(i + 2000)
+		}
+		return value(i + 1000)
+	}
+	for _, readTs := range []uint64{5, 3} {
+		for _, asc := range []bool{true, false} {
+			var want []int
+			for i := 0; i < n; i++ {
+				if newest(i, readTs) != nil {
+					want = append(want, i)
+				}
+			}
+			if !asc {
+				sort.Sort(sort.Reverse(sort.IntSlice(want)))
+			}
+			it := lsm.NewIteratorAt(&utils.Options{IsAsc: asc}, readTs)
+			var got int
+			for it.Rewind(); it.Valid(); it.Next() {
+				if got >= len(want) {
+					t.Fatalf("readTs %d asc %v: got more than %d keys", readTs, asc, len(want))
+				}
+				i := want[got]
+				e := it.Item().Entry()
+				if k := inmemory.ParseKey(e.Key); string(k) != string(key(i)) || string(e.Value) != string(newest(i, readTs)) {
+					t.Fatalf("readTs %d asc %v: got %s = %q, want %s = %q", readTs, asc, k, e.Value, key(i), newest(i, readTs))
+				}
+				got++
+			}
+			if err := it.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got != len(want) {
+				t.Fatalf("readTs %d asc %v: got %d keys, want %d", readTs, asc, got, len(want))
+			}
+		}
+	}
+}
+
+// fillPrefixes writes the keys of the even prefixes of [0, n), the first 8 bytes of key(i)
+// group the keys by i/10, rounds times, every round is flushed to level 0
+func fillPrefixes(t testing.TB, lsm *LSM, n, rounds int) {
+	t.Helper()
+	for v := 1; v <= rounds; v++ {
+		for i := 0; i < n; i++ {
+			if (i/10)%2 == 0 {
+				mustSet(t, lsm, entry(i, uint64(v)))
+			}
+		}
+		mustFlush(t, lsm)
+	}
+}
+
+// TestTablesOfPrefix the tables whose range holds a prefix but whose prefix filter doesn't
+// are skipped
+func TestTablesOfPrefix(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.PrefixExtractor = utils.NewFixedPrefixExtractor(8)
+	lsm := openTestLSM(t, opt)
+	fillPrefixes(t, lsm, 1000, 2)
+	tables := lsm.levels.levels[0].tables
+	if len(tables) < 2 {
+		t.Fatalf("got %d tables in level 0, want several", len(tables))
+	}
+	present, missing := key(500)[:8], key(510)[:8]
+	if got := tablesOf(tables, &utils.Options{Prefix: present}); len(got) == 0 {
+		t.Fatal("the present prefix: got no tables")
+	}
+	skipped := len(tables) - len(tablesOf(tables, &utils.Options{Prefix: missing}))
+	// Only a false positive of the filter keeps a table
+	if skipped < len(tables)-1 {
+		t.Fatalf("the missing prefix: %d of %d tables skipped", skipped, len(tables))
+	}
+
+	for _, p := range []struct {
+		prefix []byte
+		want   int
+	}{{present, 10}, {missing, 0}} {
+		it := lsm.NewIterator(&utils.Options{IsAsc: true, Prefix: p.prefix})
+		n := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != p.want {
+			t.Fatalf("prefix %s: got %d keys, want %d", p.prefix, n, p.want)
+		}
+	}
+}
+
+// TestTablesOfPrefixOtherExtractor a filter built by another extractor is ignored
+func TestTablesOfPrefixOtherExtractor(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.PrefixExtractor = utils.NewFixedPrefixExtractor(8)
+	lsm := openTestLSM(t, opt)
+	fillPrefixes(t, lsm, 1000, 1)
+	lsm.option.PrefixExtractor = utils.NewFixedPrefixExtractor(7)
+	tables := lsm.levels.levels[0].tables
+	if got := tablesOf(tables, &utils.Options{Prefix: key(510)[:8]}); len(got) == 0 {
+		t.Fatal("the tables are skipped by the filter of another extractor")
+	}
+}
+
+// BenchmarkPrefixScanMissing scans the prefixes which fall into the range of every table of
+// level 0 but are in none of them, only the prefix filters spare seeking every table
+func BenchmarkPrefixScanMissing(b *testing.B) {
+	for _, n := range []int{0, 8} {
+		b.Run(fmt.Sprintf("prefix=%d", n), func(b *testing.B) {
+			opt := testOptions(b.TempDir())
+			if n > 0 {
+				opt.PrefixExtractor = utils.NewFixedPrefixExtractor(n)
+			}
+			opt.NumLevelZeroTables = 100
+			lsm := openTestLSM(b, opt)
+			fillPrefixes(b, lsm, 4000, 8)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				it := lsm.NewIterator(&utils.Options{IsAsc: true, Prefix: key(10 * (2*(i%200) + 1))[:8]})
+				if it.Rewind(); it.Valid() {
+					b.Fatalf("found a key of the missing prefix %s", key(10 * (2*(i%200) + 1))[:8])
+				}
+				if err := it.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSkipListScan scans a memTable in both orders, a step back searches the list from
+// the head where a step forward follows a link
+func BenchmarkSkipListScan(b *testing.B) {
+	const n = 10000
+	sl := inmemory.NewSkipList(1 << 20)
+	defer sl.DecrRef()
+	for i := 0; i < n; i++ {
+		sl.Set(entry(i, 1))
+	}
+	for _, asc := range []bool{true, false} {
+		b.Run(fmt.Sprintf("asc=%v", asc), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				it := sl.NewIterator(&utils.Options{IsAsc: asc})
+				var got int
+				for it.Rewind(); it.Valid(); it.Next() {
+					got++
+				}
+				if err := it.Close(); err != nil {
+					b.Fatal(err)
+				}
+				if got != n {
+					b.Fatalf("scanned %d keys, want %d", got, n)
+				}
+			}
+		})
+	}
+}
@@ -3,15 +3,26 @@ package lsm
 import (
 	"bytes"
 	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/pb"
 	"github.com/Kirov7/FayKV/persistent"
 	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"log"
 	"sort"
 	"sync"
 	"sync/atomic"
 )
 
 type levelManager struct {
-	maxFID       uint64
+	maxFID uint64
+	// debtTables, debtBytes the debt of the compaction strategy, refreshed after every flush
+	// and every round of the compacters. The writers are throttled by it, atomic
+	debtTables int64
+	debtBytes  int64
+	// numRangeTombstones the range deletions of all the levels, the reads skip the levels
+	// while there is none, atomic
+	numRangeTombstones int64
+
 	opt          *Options
 	cache        *TableCache
 	manifestFile *persistent.ManifestFile
@@ -26,7 +37,8 @@ func (lsm *LSM) initLevelManager(opt *Options) *levelManager {
 	lm.opt = opt
 	// Read the index information of the manifest file
 	utils.Panic(lm.loadManifest())
-	lm.build()
+	utils.Panic(lm.build())
+	lm.updateDebt()
 	return lm
 }
 
@@ -46,7 +58,11 @@ func (lm *levelManager) close() error {
 }
 
 func (lm *levelManager) loadManifest() (err error) {
-	lm.manifestFile, err = persistent.OpenManifestFile(&persistent.Options{Dir: lm.opt.WorkDir})
+	lm.manifestFile, err = persistent.OpenManifestFile(&persistent.Options{
+		Dir:         lm.opt.WorkDir,
+		SyncMode:    lm.opt.SyncMode,
+		KeyRegistry: lm.opt.KeyRegistry,
+	})
 	return err
 }
 
@@ -75,9 +91,14 @@ func (lm *levelManager) build() error {
 		if fID > maxFID {
 			maxFID = fID
 		}
+		if err := verifyTable(fileName, tableInfo.Checksum, lm.opt.VerifyChecksumsOnOpen); err != nil {
+			return err
+		}
 		t := openTable(lm, fileName, nil)
+		if t == nil {
+			return errors.Errorf("failed to open table %d", fID)
+		}
 		lm.levels[tableInfo.Level].add(t)
-		lm.levels[tableInfo.Level].addSize(t) // Records the total file size of a level
 	}
 	// Sort each layer
 	for i := 0; i < lm.opt.MaxLevelNum; i++ {
@@ -88,30 +109,83 @@ func (lm *levelManager) build() error {
 	return nil
 }
 
+// legacyChecksum the placeholder the manifests held before the checksums of the tables were recorded
+var legacyChecksum = []byte{'m', 'o', 'c', 'k'}
+
+// verifyTable checks the checksum the manifest holds for the table, the whole file is only read
+// if verify is set. The blocks verify their own checksums once they are read anyway
+func verifyTable(fileName string, checksum []byte, verify bool) error {
+	switch {
+	case bytes.Equal(checksum, legacyChecksum):
+		return nil
+	case len(checksum) != 8:
+		return errors.Wrapf(utils.ErrBadChecksum, "table: %s, a checksum of %d bytes", fileName, len(checksum))
+	case !verify:
+		return nil
+	}
+	return persistent.VerifyTableChecksum(fileName, checksum)
+}
+
 // flush flush memtable to sstable ondisk
 func (lm *levelManager) flush(immutable *memTable) error {
 	// Assign a fid
 	fid := immutable.wal.Fid()
 	sstName := persistent.FileNameSSTable(lm.opt.WorkDir, fid)
 	// Create a builder by ranging the immutable
-	builder := newTableBuilder(lm.opt)
+	builder := newTableBuilder(lm.opt, 0)
 	iter := immutable.sl.NewSkipListIterator()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		entry := iter.Item().Entry()
-		builder.add(entry, false)
+		// The expired entries are kept as long as they hide the older versions
+		builder.add(entry, entry.IsDeletedOrExpired() && entry.Meta&utils.BitDelete == 0)
 	}
 	// Create a table instance
 	table := openTable(lm, sstName, builder)
+	if table == nil {
+		return errors.Errorf("failed to build table %d", fid)
+	}
 	err := lm.manifestFile.AddTableMeta(0, &persistent.TableMeta{
 		ID:       fid,
-		Checksum: []byte{'m', 'o', 'c', 'k'},
+		Checksum: table.sst.Checksum(),
+		KeyID:    table.sst.KeyID(),
 	})
-	utils.Panic(err)
+	if err != nil {
+		// The flusher retries, the table is written again then
+		if derr := table.DecrRef(); derr != nil {
+			log.Printf("while removing the table %d: %v", fid, derr)
+		}
+		return err
+	}
 	// The metadata must be updated after the data has been successfully written to the file
 	lm.levels[0].add(table)
+	lm.updateDebt()
 	return nil
 }
 
+// maxVersion returns the newest version in the tables
+func (lm *levelManager) maxVersion() uint64 {
+	var maxVersion uint64
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			if v := t.sst.Indexs().MaxVersion; v > maxVersion {
+				maxVersion = v
+			}
+		}
+		lh.RUnlock()
+	}
+	return maxVersion
+}
+
+// iterators returns the iterators of all the levels, the newest first
+func (lm *levelManager) iterators(opt *utils.Options) []utils.Iterator {
+	itrs := make([]utils.Iterator, 0, len(lm.levels))
+	for _, level := range lm.levels {
+		itrs = level.appendIterators(itrs, opt)
+	}
+	return itrs
+}
+
 func (lm *levelManager) Get(key []byte) (*utils.Entry, error) {
 	// query in l0
 	if entry, err := lm.levels[0].Get(key); entry != nil {
@@ -134,6 +208,8 @@ type levelHandler struct {
 	totalSize      int64
 	totalStaleSize int64
 	lm             *levelManager
+	// rangeTombstones the range deletions of the tables, kept along with them
+	rangeTombstones []*pb.RangeTombstone
 }
 
 func (lh *levelHandler) close() error {
@@ -144,13 +220,33 @@ func (lh *levelHandler) close() error {
 	}
 	return nil
 }
+
+// add appends the table and records its size
 func (lh *levelHandler) add(t *table) {
 	lh.Lock()
 	defer lh.Unlock()
 	lh.tables = append(lh.tables, t)
+	lh.addSize(t)
+	if rts := t.sst.Indexs().RangeTombstones; len(rts) > 0 {
+		lh.rangeTombstones = append(lh.rangeTombstones, rts...)
+		atomic.AddInt64(&lh.lm.numRangeTombstones, int64(len(rts)))
+	}
+}
+
+// updateRangeTombstones collects the range deletions of the tables once they are replaced,
+// lh.Lock must be held
+func (lh *levelHandler) updateRangeTombstones() {
+	var rts []*pb.RangeTombstone
+	for _, t := range lh.tables {
+		rts = append(rts, t.sst.Indexs().RangeTombstones...)
+	}
+	atomic.AddInt64(&lh.lm.numRangeTombstones, int64(len(rts)-len(lh.rangeTombstones)))
+	lh.rangeTombstones = rts
 }
 
 func (lh *levelHandler) Get(key []byte) (*utils.Entry, error) {
+	lh.RLock()
+	defer lh.RUnlock()
 	if lh.levelNum == 0 {
 		return lh.searchL0SST(key)
 	} else {
@@ -158,6 +254,21 @@ func (lh *levelHandler) Get(key []byte) (*utils.Entry, error) {
 	}
 }
 
+// appendIterators the tables of level 0 overlap, every one of them gets its own iterator
+func (lh *levelHandler) appendIterators(iters []utils.Iterator, opt *utils.Options) []utils.Iterator {
+	lh.RLock()
+	defer lh.RUnlock()
+	// The tables which can't hold a key of the iteration are not iterated at all
+	tables := tablesOf(lh.tables, opt)
+	if lh.levelNum == 0 {
+		return append(iters, iteratorsReversed(tables, opt)...)
+	}
+	if len(tables) == 0 {
+		return iters
+	}
+	return append(iters, NewConcatIterator(tables, opt))
+}
+
 func (lh *levelHandler) Sort() {
 	lh.Lock()
 	defer lh.Unlock()
@@ -180,10 +291,115 @@ func (lh *levelHandler) addSize(t *table) {
 	lh.totalStaleSize += int64(t.StaleDataSize())
 }
 
+func (lh *levelHandler) subtractSize(t *table) {
+	lh.totalSize -= t.Size()
+	lh.totalStaleSize -= int64(t.StaleDataSize())
+}
+
+func (lh *levelHandler) getTotalSize() int64 {
+	lh.RLock()
+	defer lh.RUnlock()
+	return lh.totalSize
+}
+
+func (lh *levelHandler) numTables() int {
+	lh.RLock()
+	defer lh.RUnlock()
+	return len(lh.tables)
+}
+
+func (lh *levelHandler) isLastLevel() bool {
+	return lh.levelNum == lh.lm.opt.MaxLevelNum-1
+}
+
+// replaceTables removes toDel from the level and adds toAdd, keeping the tables sorted by key
+// It must be called _after_ writing the update to the manifest.
+func (lh *levelHandler) replaceTables(toDel, toAdd []*table) error {
+	// Need to re-search the range of tables in this level to be replaced as other goroutines might
+	// be changing it as well.  (They can't touch our tables, but if they add/remove other tables,
+	// the indices get shifted around.)
+	lh.Lock() // We lh.Unlock() below.
+
+	toDelMap := make(map[uint64]struct{})
+	for _, t := range toDel {
+		toDelMap[t.fid] = struct{}{}
+	}
+	var newTables []*table
+	for _, t := range lh.tables {
+		_, found := toDelMap[t.fid]
+		if !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		lh.subtractSize(t)
+	}
+
+	// Increase totalSize first.
+	for _, t := range toAdd {
+		lh.addSize(t)
+		t.IncrRef()
+		newTables = append(newTables, t)
+	}
+
+	// Assign tables.
+	lh.tables = newTables
+	sort.Slice(lh.tables, func(i, j int) bool {
+		return inmemory.CompareKeys(lh.tables[i].sst.MinKey(), lh.tables[j].sst.MinKey()) < 0
+	})
+	lh.updateRangeTombstones()
+	lh.Unlock() // lh.Unlock before we DecrRef tables -- that can be slow.
+	return decrRefs(toDel)
+}
+
+// deleteTables removes the tables of toDel held by the level and drops the reference held by it
+func (lh *levelHandler) deleteTables(toDel []*table) error {
+	lh.Lock() // lh.Unlock() below
+
+	toDelMap := make(map[uint64]struct{})
+	for _, t := range toDel {
+		toDelMap[t.fid] = struct{}{}
+	}
+
+	// Make a copy as iterators might be keeping a slice of tables.
+	var newTables, deleted []*table
+	for _, t := range lh.tables {
+		_, found := toDelMap[t.fid]
+		if !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		lh.subtractSize(t)
+		deleted = append(deleted, t)
+	}
+	lh.tables = newTables
+	lh.updateRangeTombstones()
+
+	lh.Unlock() // Unlock lh _before_ we DecrRef our tables, which can be slow.
+
+	return decrRefs(deleted)
+}
+
+// overlappingTables returns the tables that intersect with key range. Returns a half-interval.
+// This function should already have acquired a read lock, and this is so important the caller must
+// pass an empty parameter declaring such.
+func (lh *levelHandler) overlappingTables(_ levelHandlerRLocked, kr keyRange) (int, int) {
+	if len(kr.left) == 0 || len(kr.right) == 0 {
+		return 0, 0
+	}
+	left := sort.Search(len(lh.tables), func(i int) bool {
+		return inmemory.CompareKeys(kr.left, lh.tables[i].sst.MaxKey()) <= 0
+	})
+	right := sort.Search(len(lh.tables), func(i int) bool {
+		return inmemory.CompareKeys(kr.right, lh.tables[i].sst.MinKey()) < 0
+	})
+	return left, right
+}
+
 func (lh *levelHandler) searchL0SST(key []byte) (*utils.Entry, error) {
 	var version uint64
-	for _, table := range lh.tables {
-		if entry, err := table.Search(key, &version); err != nil {
+	// Newer tables are at the end of level 0, so search from back to front
+	for i := len(lh.tables) - 1; i >= 0; i-- {
+		if entry, err := lh.tables[i].Search(key, &version); err == nil {
 			return entry, nil
 		}
 	}
@@ -196,17 +412,20 @@ func (lh *levelHandler) searchLNSST(key []byte) (*utils.Entry, error) {
 	if table == nil {
 		return nil, utils.ErrKeyNotFound
 	}
-	if entry, err := table.Search(key, &version); err != nil {
+	if entry, err := table.Search(key, &version); err == nil {
 		return entry, nil
 	}
 	return nil, utils.ErrKeyNotFound
 }
 
+// getTable returns the only table in level n whose key range may contain the key
 func (lh *levelHandler) getTable(key []byte) *table {
-	for i := len(lh.tables); i >= 0; i-- {
-		if bytes.Compare(key, lh.tables[i].sst.MinKey()) > -1 && bytes.Compare(key, lh.tables[i].sst.MaxKey()) < 1 {
-			return lh.tables[i]
-		}
+	userKey := inmemory.ParseKey(key)
+	idx := sort.Search(len(lh.tables), func(i int) bool {
+		return bytes.Compare(userKey, inmemory.ParseKey(lh.tables[i].sst.MaxKey())) <= 0
+	})
+	if idx >= len(lh.tables) || bytes.Compare(userKey, inmemory.ParseKey(lh.tables[idx].sst.MinKey())) < 0 {
+		return nil
 	}
-	return nil
+	return lh.tables[idx]
 }
@@ -0,0 +1,80 @@
+package lsm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Kirov7/FayKV/persistent"
+	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+)
+
+func TestVerifyTable(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	mustSet(t, lsm, entry(1, 1))
+	mustFlush(t, lsm)
+	tbl := lsm.levels.levels[0].tables[0]
+	name := persistent.FileNameSSTable(lsm.option.WorkDir, tbl.fid)
+	if err := verifyTable(name, tbl.sst.Checksum(), true); err != nil {
+		t.Fatal(err)
+	}
+	// The manifests written before the checksums were recorded
+	if err := verifyTable(name, legacyChecksum, true); err != nil {
+		t.Fatalf("the placeholder: %v", err)
+	}
+	for _, checksum := range [][]byte{nil, []byte("bad"), make([]byte, 9)} {
+		if err := verifyTable(name, checksum, false); errors.Cause(err) != utils.ErrBadChecksum {
+			t.Fatalf("the checksum %v: got %v, want ErrBadChecksum", checksum, err)
+		}
+	}
+}
+
+// TestVerifyChecksumsOnOpen a corrupted table is only found on open if it's asked for,
+// the block is verified once it's read otherwise
+func TestVerifyChecksumsOnOpen(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	mustFlush(t, lsm)
+	copied := crashCopy(t, lsm)
+	files, err := filepath.Glob(filepath.Join(copied, "*.sst"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("got the tables %v, %v", files, err)
+	}
+	// The first byte is in the first block
+	f, err := os.OpenFile(files[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("opened the corrupted table with VerifyChecksumsOnOpen")
+			}
+		}()
+		opt := testOptions(copied)
+		opt.VerifyChecksumsOnOpen = true
+		registry, err := persistent.OpenKeyRegistry(&persistent.Options{Dir: copied})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer registry.Close()
+		opt.KeyRegistry = registry
+		NewLSM(opt)
+	}()
+	openTestLSM(t, testOptions(copied))
+}
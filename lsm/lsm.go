@@ -3,23 +3,49 @@ package lsm
 import (
 	"github.com/Kirov7/FayKV/persistent"
 	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type LSM struct {
-	memTable   *memTable
-	immutables []*memTable
-	levels     *levelManager
-	option     *Options
-	closer     *utils.Closer
-	maxMemFID  uint32
+	// slowdownNanos, stopNanos the time the writes were delayed and blocked, atomic
+	slowdownNanos int64
+	stopNanos     int64
+
+	sync.RWMutex // Guards the memTable and the immutables
+	memTable     *memTable
+	immutables   []*memTable
+	levels       *levelManager
+	option       *Options
+	closer       *utils.Closer
+	maxMemFID    uint32
+
+	// flushChan the sealed memTables waiting for the flusher, the oldest first
+	flushChan   chan *memTable
+	flushCloser *utils.Closer
+	// stopStalls closed once the writes must not wait for the flush or the compaction any more
+	stopStalls     chan struct{}
+	stopStallsOnce sync.Once
+
+	// flushErr the error the flusher gave up with, the writes fail with it from then on.
+	// Guarded by the lock
+	flushErr error
+
+	// closeOnce a second Close returns the result of the first one
+	closeOnce sync.Once
+	closeErr  error
 }
 
 type Options struct {
 	WorkDir             string
 	SSTableMaxSize      int64
 	MemTableSize        int64
+	NumMemtables        int // The max number of immutables waiting for the flush
 	BlockSize           int
-	BloomFalsePositive  float64
+	BloomFalsePositive  float64 // The false positive rate of the bloom filters, 0 builds none
 	NumCompactors       int
 	BaseLevelSize       int64
 	LevelSizeMultiplier int
@@ -28,13 +54,63 @@ type Options struct {
 	NumLevelZeroTables  int
 	MaxLevelNum         int
 	DiscardStatsCh      *chan map[uint32]int64
+	SyncMode            utils.SyncMode
+	Compression         utils.CompressionType   // The codec of the blocks of the new tables
+	KeyRegistry         *persistent.KeyRegistry // The data keys of the files, nil disables the encryption
+	// DiscardTs returns the timestamp at or below which only the newest version of a key
+	// is visible to the readers, the compaction drops the older ones. Nil keeps only the newest
+	DiscardTs func() uint64
+	// LevelBloomFalsePositive overrides BloomFalsePositive for the tables of a level,
+	// 0 builds no filter for the level
+	LevelBloomFalsePositive map[int]float64
+	// PrefixExtractor the prefixes of the keys are put into a second filter of the tables,
+	// the prefix scans skip the tables it excludes. Nil builds no prefix filter
+	PrefixExtractor utils.PrefixExtractor
+	// VerifyChecksumsOnOpen reads every table in full on open to verify its checksum,
+	// otherwise only the blocks read are verified
+	VerifyChecksumsOnOpen bool
+	// CompactionStrategy picks the tables to compact, NewLeveledCompaction by default
+	CompactionStrategy CompactionStrategy
+	// The writes are delayed by SlowdownDelay each once level 0 holds LevelZeroSlowdownTables
+	// tables, ImmutablesSlowdown memTables wait for the flush or the compaction is
+	// PendingBytesSlowdown bytes behind. They are blocked until the compaction catches up
+	// once level 0 holds LevelZeroStopTables tables or it's PendingBytesStop bytes behind,
+	// and until the flusher does once NumMemtables wait for it. A threshold of 0 or less is disabled
+	LevelZeroSlowdownTables int
+	LevelZeroStopTables     int
+	ImmutablesSlowdown      int
+	PendingBytesSlowdown    int64
+	PendingBytesStop        int64
+	SlowdownDelay           time.Duration
+}
+
+// bloomFalsePositive the false positive rate of the filters of the tables of the level
+func (opt *Options) bloomFalsePositive(level int) float64 {
+	if fp, ok := opt.LevelBloomFalsePositive[level]; ok {
+		return fp
+	}
+	return opt.BloomFalsePositive
 }
 
 func NewLSM(opt *Options) *LSM {
-	lsm := &LSM{option: opt}
+	if opt.NumMemtables <= 0 {
+		opt.NumMemtables = 1
+	}
+	if opt.CompactionStrategy == nil {
+		opt.CompactionStrategy = NewLeveledCompaction()
+	}
+	lsm := &LSM{option: opt, stopStalls: make(chan struct{})}
 	lsm.levels = lsm.initLevelManager(opt)
 	lsm.memTable, lsm.immutables = lsm.recovery()
 	lsm.closer = utils.NewCloser()
+	lsm.flushChan = make(chan *memTable, opt.NumMemtables)
+	lsm.flushCloser = utils.NewCloser()
+	lsm.flushCloser.Add(1)
+	go lsm.runFlusher()
+	// The recovered immutables are flushed in the order of their wal
+	for _, mt := range lsm.immutables {
+		lsm.flushChan <- mt
+	}
 	return lsm
 }
 
@@ -45,55 +121,265 @@ func (lsm *LSM) Set(entry *utils.Entry) (err error) {
 	lsm.closer.Add(1)
 	defer lsm.closer.Done()
 
-	if int64(lsm.memTable.wal.Size())+int64(persistent.EstimateWalCodecSize(entry)) > lsm.option.MemTableSize {
-		lsm.Seal()
+	lsm.throttleWrites()
+	if err := lsm.lockForWrite(int64(persistent.EstimateWalCodecSize(entry))); err != nil {
+		return err
+	}
+	err = lsm.memTable.set(entry)
+	lsm.Unlock()
+	return err
+}
+
+// SetBatch writes the entries into the same memTable with one wal record,
+// so that the replay applies all of them or none
+func (lsm *LSM) SetBatch(entries []*utils.Entry) (err error) {
+	var sz int64
+	for _, entry := range entries {
+		if entry == nil || len(entry.Key) == 0 {
+			return utils.ErrEmptyKey
+		}
+		sz += int64(persistent.EstimateWalCodecSize(entry))
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	lsm.closer.Add(1)
+	defer lsm.closer.Done()
+
+	lsm.throttleWrites()
+	if err := lsm.lockForWrite(sz); err != nil {
+		return err
+	}
+	err = lsm.memTable.setBatch(entries)
+	lsm.Unlock()
+	return err
+}
+
+// MaxVersion returns the newest version in the memTables and the tables
+func (lsm *LSM) MaxVersion() uint64 {
+	lsm.RLock()
+	defer lsm.RUnlock()
+	maxVersion := lsm.memTable.maxVersion
+	for _, mt := range lsm.immutables {
+		if mt.maxVersion > maxVersion {
+			maxVersion = mt.maxVersion
+		}
 	}
-	if err = lsm.memTable.set(entry); err != nil {
+	if v := lsm.levels.maxVersion(); v > maxVersion {
+		maxVersion = v
+	}
+	return maxVersion
+}
+
+// Sync flushes the wal of the memTable and of the immutables waiting for the flush,
+// and the manifest, to the disk
+func (lsm *LSM) Sync() error {
+	// The flusher only closes an immutable after it has dropped it from the list
+	lsm.RLock()
+	defer lsm.RUnlock()
+	if err := lsm.memTable.wal.Sync(); err != nil {
 		return err
 	}
-	for _, immutable := range lsm.immutables {
-		if err = lsm.levels.flush(immutable); err != nil {
+	for _, mt := range lsm.immutables {
+		if err := mt.wal.Sync(); err != nil {
 			return err
 		}
-		err = immutable.close()
-		utils.Panic(err)
 	}
-	if len(lsm.immutables) != 0 {
-		lsm.immutables = make([]*memTable, 0)
+	return lsm.levels.manifestFile.Sync()
+}
+
+// lockForWrite takes lsm.Lock once the memTable has room for sz more bytes. It returns
+// ErrBlockedWrites without the lock if the stalls are stopped while it waits for the flusher,
+// and the error of the flusher if it gave up
+func (lsm *LSM) lockForWrite(sz int64) error {
+	lsm.Lock()
+	var start time.Time
+	defer func() {
+		if !start.IsZero() {
+			atomic.AddInt64(&lsm.stopNanos, int64(time.Since(start)))
+		}
+	}()
+	for {
+		if err := lsm.flushErr; err != nil {
+			lsm.Unlock()
+			return err
+		}
+		if lsm.ensureRoomForWrite(sz) {
+			return nil
+		}
+		// Too many immutables are queued, wait for the flusher to catch up
+		if start.IsZero() {
+			start = time.Now()
+		}
+		lsm.Unlock()
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-lsm.stopStalls:
+			return utils.ErrBlockedWrites
+		}
+		lsm.Lock()
+	}
+}
+
+// flushError returns the error the flusher gave up with, nil while it works
+func (lsm *LSM) flushError() error {
+	lsm.RLock()
+	defer lsm.RUnlock()
+	return lsm.flushErr
+}
+
+// ensureRoomForWrite seals the memTable when it can't hold sz more bytes. It returns false
+// if the memTable needs to be sealed but the flush queue is full, lsm.Lock must be held
+func (lsm *LSM) ensureRoomForWrite(sz int64) bool {
+	// A write larger than a whole memTable goes into an empty one
+	if lsm.memTable.wal.Empty() || int64(lsm.memTable.wal.Size())+sz <= lsm.option.MemTableSize {
+		return true
+	}
+	return lsm.seal()
+}
+
+// seal hands the memTable to the flusher without blocking, lsm.Lock must be held
+func (lsm *LSM) seal() bool {
+	select {
+	case lsm.flushChan <- lsm.memTable:
+		// The flusher takes the lock before it drops the immutable, so it always sees it here
+		lsm.immutables = append(lsm.immutables, lsm.memTable)
+		lsm.memTable = lsm.NewMemTable()
+		return true
+	default:
+		return false
 	}
-	return err
 }
 
-func (lsm LSM) Get(key []byte) (*utils.Entry, error) {
+// Seal seals the active memTable if it's not empty and queues it for the flush. It returns
+// the error of the flusher if it gave up
+func (lsm *LSM) Seal() error {
+	lsm.Lock()
+	defer lsm.Unlock()
+	// Never block on the channel with the lock held, the flusher needs it to make room
+	for lsm.flushErr == nil && !lsm.memTable.sl.Empty() && !lsm.seal() {
+		lsm.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lsm.Lock()
+	}
+	return lsm.flushErr
+}
+
+// runFlusher writes the sealed memTables to l0 one by one. The wal of a memTable is only
+// removed once its sstable and the manifest entry are written. Once a memTable can't be
+// flushed the flusher gives up, the memTables after it are left to the replay of the next open
+func (lsm *LSM) runFlusher() {
+	defer lsm.flushCloser.Done()
+	for mt := range lsm.flushChan {
+		if lsm.flushError() != nil {
+			continue
+		}
+		if err := lsm.flushMemTable(mt); err != nil {
+			log.Printf("[flusher] gave up on memTable %d: %v", mt.wal.Fid(), err)
+			lsm.Lock()
+			lsm.flushErr = err
+			lsm.Unlock()
+		}
+	}
+}
+
+// flushMemTable writes the memTable to l0, up to FlushRetries times, then drops it from
+// the immutables and removes its wal
+func (lsm *LSM) flushMemTable(mt *memTable) error {
+	var err error
+	for i := 0; i < utils.FlushRetries; i++ {
+		if i > 0 {
+			time.Sleep(utils.FlushRetryDelay)
+		}
+		if err = lsm.levels.flush(mt); err == nil {
+			break
+		}
+		log.Printf("[flusher] while flushing memTable %d: %v", mt.wal.Fid(), err)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "while flushing memTable %d", mt.wal.Fid())
+	}
+	lsm.Lock()
+	utils.CondPanic(len(lsm.immutables) == 0 || lsm.immutables[0] != mt,
+		errors.New("the flushed memTable is not the oldest immutable"))
+	lsm.immutables = lsm.immutables[1:]
+	lsm.Unlock()
+	// The table is in the manifest already, the next open removes a wal left behind
+	return mt.close()
+}
+
+func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
 	if len(key) == 0 {
 		return nil, utils.ErrEmptyKey
 	}
 	lsm.closer.Add(1)
 	defer lsm.closer.Done()
+	entry, err := lsm.getFromMemTables(key)
+	if entry == nil {
+		// If not found, query the sst. A memTable is only dropped after its table is in l0,
+		// so nothing is missed in between
+		entry, err = lsm.levels.Get(key)
+	}
+	// An expired version hides the older ones, the search stops at it
+	if entry != nil && entry.Meta&utils.BitDelete == 0 && entry.IsDeletedOrExpired() {
+		return nil, utils.ErrKeyNotFound
+	}
+	// The version found may be hidden by a newer range deletion the reader sees
+	if entry != nil && lsm.rangeDeleted(key, entry) {
+		return nil, utils.ErrKeyNotFound
+	}
+	return entry, err
+}
+
+func (lsm *LSM) getFromMemTables(key []byte) (*utils.Entry, error) {
+	lsm.RLock()
+	defer lsm.RUnlock()
 	// Start by querying in the active table
-	if entry, err := lsm.memTable.Get(key); entry != nil && entry.Value != nil {
+	if entry, err := lsm.memTable.Get(key); entry != nil {
 		return entry, err
 	}
 	// Otherwise, query in the seal table (need to traverse from back to front)
 	for i := len(lsm.immutables) - 1; i >= 0; i-- {
-		if entry, err := lsm.immutables[i].Get(key); entry != nil && entry.Value != nil {
+		if entry, err := lsm.immutables[i].Get(key); entry != nil {
 			return entry, err
 		}
 	}
-	// If not found, query the sst
-	return lsm.levels.Get(key)
+	return nil, utils.ErrKeyNotFound
 }
 
 func (lsm *LSM) Close() error {
+	lsm.closeOnce.Do(func() {
+		lsm.closeErr = lsm.close()
+	})
+	return lsm.closeErr
+}
+
+func (lsm *LSM) close() error {
+	lsm.StopStalls()
+	// Stop the compacters and wait for the running requests
 	lsm.closer.Close()
-	// TODO 需要加锁保证并发安全
-	if lsm.memTable != nil {
-		if err := lsm.memTable.close(); err != nil {
-			return err
+	// Queue the active memTable and wait until every immutable is flushed
+	lsm.Seal()
+	close(lsm.flushChan)
+	lsm.flushCloser.Close()
+	if lsm.flushErr != nil {
+		// The memTables which were not flushed keep their wal for the replay of the next open
+		for _, mt := range append(lsm.immutables, lsm.memTable) {
+			closeMt := mt.wal.CloseAndKeep
+			if mt.sl.Empty() {
+				closeMt = mt.close
+			}
+			if err := closeMt(); err != nil {
+				log.Printf("while closing memTable %d: %v", mt.wal.Fid(), err)
+			}
+		}
+		if err := lsm.levels.close(); err != nil {
+			log.Printf("while closing the levels: %v", err)
 		}
+		return lsm.flushErr
 	}
-	for i := range lsm.immutables {
-		if err := lsm.immutables[i].close(); err != nil {
+	if lsm.memTable != nil {
+		if err := lsm.memTable.close(); err != nil {
 			return err
 		}
 	}
@@ -111,9 +397,3 @@ func (lsm *LSM) StartCompacter() {
 		go lsm.levels.runCompacter(i)
 	}
 }
-
-// Seal seal the full memTable
-func (lsm *LSM) Seal() {
-	lsm.immutables = append(lsm.immutables, lsm.memTable)
-	lsm.memTable = lsm.NewMemTable()
-}
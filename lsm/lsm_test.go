@@ -0,0 +1,322 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/persistent"
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// testOptions small memTables, tables and levels, so that a few thousand keys fill some levels
+func testOptions(dir string) *Options {
+	return &Options{
+		WorkDir:             dir,
+		SSTableMaxSize:      1 << 20,
+		MemTableSize:        32 << 10,
+		NumMemtables:        5,
+		BlockSize:           1 << 10,
+		BloomFalsePositive:  0.01,
+		NumCompactors:       1,
+		BaseLevelSize:       64 << 10,
+		LevelSizeMultiplier: 4,
+		TableSizeMultiplier: 2,
+		BaseTableSize:       16 << 10,
+		NumLevelZeroTables:  4,
+		MaxLevelNum:         5,
+		SyncMode:            utils.SyncNever,
+	}
+}
+
+// openTestLSM opens the lsm of opt.WorkDir without starting the compacters, the tests
+// compact with CompactRange
+func openTestLSM(t testing.TB, opt *Options) *LSM {
+	t.Helper()
+	registry, err := persistent.OpenKeyRegistry(&persistent.Options{Dir: opt.WorkDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt.KeyRegistry = registry
+	lsm := NewLSM(opt)
+	t.Cleanup(func() {
+		if err := lsm.Close(); err != nil {
+			t.Errorf("close: %v", err)
+		}
+		if err := registry.Close(); err != nil {
+			t.Errorf("close the key registry: %v", err)
+		}
+	})
+	return lsm
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+func value(i int) []byte {
+	return []byte(fmt.Sprintf("value%06d", i))
+}
+
+func entry(i int, version uint64) *utils.Entry {
+	return utils.NewEntry(inmemory.KeyWithTs(key(i), version), value(i))
+}
+
+func mustSet(t testing.TB, lsm *LSM, e *utils.Entry) {
+	t.Helper()
+	if err := lsm.Set(e); err != nil {
+		t.Fatalf("set %s: %v", inmemory.ParseKey(e.Key), err)
+	}
+}
+
+// get returns the value of the version of the key visible at readTs, nil if there is none
+func get(t testing.TB, lsm *LSM, k []byte, readTs uint64) []byte {
+	t.Helper()
+	e, err := lsm.Get(inmemory.KeyWithTs(k, readTs))
+	if err == utils.ErrKeyNotFound || e == nil || e.IsDeletedOrExpired() {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("get %s: %v", k, err)
+	}
+	return e.Value
+}
+
+func mustGet(t testing.TB, lsm *LSM, k []byte, readTs uint64, want []byte) {
+	t.Helper()
+	if got := get(t, lsm, k, readTs); string(got) != string(want) {
+		t.Fatalf("get %s at %d: got %q, want %q", k, readTs, got, want)
+	}
+}
+
+func mustFlush(t testing.TB, lsm *LSM) {
+	t.Helper()
+	if _, err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crashCopy copies the files of the open lsm into a new dir, as they would be found after
+// the process died. Level 0 is locked meanwhile, a running flush stops before it removes the
+// wal, and the manifest is copied first so that every table it holds is copied as well
+func crashCopy(t testing.TB, lsm *LSM) string {
+	t.Helper()
+	if err := lsm.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	l0 := lsm.levels.levels[0]
+	l0.Lock()
+	defer l0.Unlock()
+	dir := t.TempDir()
+	copyFile(t, lsm.option.WorkDir, dir, utils.ManifestFilename)
+	files, err := os.ReadDir(lsm.option.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name() != utils.ManifestFilename {
+			copyFile(t, lsm.option.WorkDir, dir, f.Name())
+		}
+	}
+	return dir
+}
+
+func copyFile(t testing.TB, from, to, name string) {
+	t.Helper()
+	src, err := os.Open(filepath.Join(from, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(to, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWalReplay(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	// A second version of the first keys, in batches
+	for i := 0; i < 50; i += 10 {
+		var batch []*utils.Entry
+		for j := i; j < i+10; j++ {
+			batch = append(batch, utils.NewEntry(inmemory.KeyWithTs(key(j), 2), value(j+1000)))
+		}
+		if err := lsm.SetBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replayed := openTestLSM(t, testOptions(crashCopy(t, lsm)))
+	for i := 0; i < 100; i++ {
+		want := value(i)
+		if i < 50 {
+			want = value(i + 1000)
+		}
+		mustGet(t, replayed, key(i), 2, want)
+		mustGet(t, replayed, key(i), 1, value(i))
+	}
+	if v := replayed.MaxVersion(); v != 2 {
+		t.Fatalf("max version: got %d, want 2", v)
+	}
+}
+
+// TestFlusherRemovesWal the sealed memTables are written to level 0 in the background, the wal of
+// each is removed once its table is, only the wal of the active memTable is left
+func TestFlusherRemovesWal(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	lsm := openTestLSM(t, opt)
+	const n = 3000
+	for i := 0; i < n; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	mustFlush(t, lsm)
+	lsm.RLock()
+	immutables, active := len(lsm.immutables), lsm.memTable.wal.Fid()
+	lsm.RUnlock()
+	if immutables != 0 {
+		t.Fatalf("got %d immutables after the flush, want 0", immutables)
+	}
+	if tables := lsm.levels.levels[0].numTables(); tables < 2 {
+		t.Fatalf("level 0 holds %d tables, want one for every sealed memTable", tables)
+	}
+	wals, err := filepath.Glob(filepath.Join(opt.WorkDir, "*"+persistent.WalFileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wals) != 1 || wals[0] != mtFilePath(opt.WorkDir, active) {
+		t.Fatalf("got the wal files %v, want only the one of memTable %d", wals, active)
+	}
+	for i := 0; i < n; i++ {
+		mustGet(t, lsm, key(i), 1, value(i))
+	}
+}
+
+// TestWalReplayManyMemTables the sealed memTables which were not flushed yet are replayed
+// in order, along with the active one
+func TestWalReplayManyMemTables(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	lsm := openTestLSM(t, opt)
+	const n = 3000
+	for i := 0; i < n; i++ {
+		mustSet(t, lsm, entry(i%500, uint64(i+1)))
+	}
+	replayed := openTestLSM(t, testOptions(crashCopy(t, lsm)))
+	for i := n - 500; i < n; i++ {
+		mustGet(t, replayed, key(i%500), n, value(i%500))
+	}
+	if v := replayed.MaxVersion(); v != n {
+		t.Fatalf("max version: got %d, want %d", v, n)
+	}
+}
+
+// TestWalReplayTornBatch a batch whose record is torn by the crash is dropped whole,
+// the records before it are kept
+func TestWalReplayTornBatch(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	mustSet(t, lsm, entry(0, 1))
+	batch := []*utils.Entry{entry(1, 2), entry(2, 2), entry(3, 2)}
+	if err := lsm.SetBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	lsm.RLock()
+	wal, end := filepath.Base(lsm.memTable.wal.Name()), int64(lsm.memTable.wal.Size())
+	lsm.RUnlock()
+	dir := crashCopy(t, lsm)
+	// Flip the last byte of the batch, its checksum
+	f, err := os.OpenFile(filepath.Join(dir, wal), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, end-1); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, end-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	replayed := openTestLSM(t, testOptions(dir))
+	mustGet(t, replayed, key(0), 2, value(0))
+	for i := 1; i <= 3; i++ {
+		mustGet(t, replayed, key(i), 2, nil)
+	}
+}
+
+// TestFlushError the flusher gives up on a memTable it can't flush, the writes, the flushes and
+// Close fail with its error instead of waiting for it, and the wal is replayed by the next open
+func TestFlushError(t *testing.T) {
+	dir := t.TempDir()
+	opt := testOptions(dir)
+	registry, err := persistent.OpenKeyRegistry(&persistent.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt.KeyRegistry = registry
+	lsm := NewLSM(opt)
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	// The manifest entry of the table can't be written
+	if err := lsm.levels.manifestFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, flushErr := lsm.Flush()
+	if flushErr == nil {
+		t.Fatal("flush: got no error")
+	}
+	if err := lsm.Set(entry(100, 2)); err != flushErr {
+		t.Fatalf("set: got %v, want %v", err, flushErr)
+	}
+	if err := lsm.SetBatch([]*utils.Entry{entry(101, 2)}); err != flushErr {
+		t.Fatalf("set a batch: got %v, want %v", err, flushErr)
+	}
+	if err := lsm.Close(); err != flushErr {
+		t.Fatalf("close: got %v, want %v", err, flushErr)
+	}
+	if err := registry.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestLSM(t, testOptions(dir))
+	for i := 0; i < 100; i++ {
+		mustGet(t, reopened, key(i), 1, value(i))
+	}
+	mustGet(t, reopened, key(100), 2, nil)
+}
+
+// TestWalReplayTombstone the meta of the entries is replayed, a tombstone is never mistaken
+// for an empty value
+func TestWalReplayTombstone(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	mustSet(t, lsm, entry(1, 1))
+	mustSet(t, lsm, entry(2, 1))
+	mustSet(t, lsm, &utils.Entry{Key: inmemory.KeyWithTs(key(1), 2), Meta: utils.BitDelete})
+	mustSet(t, lsm, &utils.Entry{Key: inmemory.KeyWithTs(key(2), 2)})
+	replayed := openTestLSM(t, testOptions(crashCopy(t, lsm)))
+	for _, l := range []*LSM{lsm, replayed} {
+		e, err := l.Get(inmemory.KeyWithTs(key(1), 2))
+		if err != nil || e.Meta&utils.BitDelete == 0 {
+			t.Fatalf("get the tombstone: got %+v, %v", e, err)
+		}
+		e, err = l.Get(inmemory.KeyWithTs(key(2), 2))
+		if err != nil || e.Meta&utils.BitDelete != 0 || len(e.Value) != 0 {
+			t.Fatalf("get the empty value: got %+v, %v", e, err)
+		}
+		mustGet(t, l, key(1), 1, value(1))
+	}
+}
@@ -0,0 +1,230 @@
+package lsm
+
+import (
+	"github.com/Kirov7/FayKV/utils"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CompactionStats the work done by a flush or a manual compaction
+type CompactionStats struct {
+	Compactions int           // The compactions run
+	TablesIn    int           // The tables merged, or the memTables flushed
+	TablesOut   int           // The tables written
+	BytesIn     int64         // The size of the tables merged, or of the wal of the memTables flushed
+	BytesOut    int64         // The size of the tables written
+	Duration    time.Duration // The time the work took
+}
+
+// Add adds the work of o to s
+func (s *CompactionStats) Add(o CompactionStats) {
+	s.Compactions += o.Compactions
+	s.TablesIn += o.TablesIn
+	s.TablesOut += o.TablesOut
+	s.BytesIn += o.BytesIn
+	s.BytesOut += o.BytesOut
+	s.Duration += o.Duration
+}
+
+// Flush seals the memTable and waits until it and all the immutables before it are written to level 0
+func (lsm *LSM) Flush() (CompactionStats, error) {
+	lsm.closer.Add(1)
+	defer lsm.closer.Done()
+	start := time.Now()
+	var stats CompactionStats
+	if err := lsm.Seal(); err != nil {
+		return stats, err
+	}
+	lsm.RLock()
+	pending := append([]*memTable{}, lsm.immutables...)
+	for _, mt := range pending {
+		stats.TablesIn++
+		stats.TablesOut++
+		stats.BytesIn += int64(mt.wal.Size())
+	}
+	lsm.RUnlock()
+	if len(pending) == 0 {
+		return stats, nil
+	}
+	// The flusher drops the immutables in order, the last one is gone once all of them are
+	for last := pending[len(pending)-1]; lsm.isImmutable(last); {
+		if err := lsm.flushError(); err != nil {
+			return stats, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// isImmutable returns true if the memTable is still waiting for the flush
+func (lsm *LSM) isImmutable(mt *memTable) bool {
+	lsm.RLock()
+	defer lsm.RUnlock()
+	for _, imm := range lsm.immutables {
+		if imm == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// CompactRange pushes the tables holding the keys of [start, end) down to the last level, and
+// rewrites the ones of the last level, so that the deleted and the stale versions are dropped.
+// A nil bound leaves the range open. The levels are compacted from the top, up to workers
+// compactions of a level run at once. The tables written after a level is started are left
+// alone, and the memTables are not flushed
+func (lsm *LSM) CompactRange(start, end []byte, workers int) (CompactionStats, error) {
+	lsm.closer.Add(1)
+	defer lsm.closer.Done()
+	if workers < 1 {
+		workers = 1
+	}
+	lm := lsm.levels
+	// The writes stopped by the debt go on once the levels are compacted
+	defer lm.updateDebt()
+	var stats CompactionStats
+	// The tables written into the last level by the call are not rewritten again
+	lastFID := atomic.LoadUint64(&lm.maxFID)
+	for l := 0; l < len(lm.levels); l++ {
+		// The tables of the level written from now on are left alone, the compaction
+		// would never end with a busy level otherwise
+		maxFID := lastFID
+		if !lm.levels[l].isLastLevel() {
+			maxFID = atomic.LoadUint64(&lm.maxFID)
+		}
+		for {
+			select {
+			case <-lsm.closer.CloseSignal:
+				return stats, utils.ErrCompactionStop
+			default:
+			}
+			cds, pending := lm.rangeCompactDefs(l, start, end, maxFID, workers)
+			if len(cds) == 0 && !pending {
+				break
+			}
+			if len(cds) == 0 {
+				// Some of the tables are under compaction already
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var firstErr error
+			for _, cd := range cds {
+				wg.Add(1)
+				go func(cd compactDef) {
+					defer wg.Done()
+					defer lm.compactState.delete(cd)
+					s, err := lm.runCompactDef(cd.compactorId, l, cd)
+					mu.Lock()
+					defer mu.Unlock()
+					stats.Add(s)
+					if err != nil && firstErr == nil {
+						firstErr = err
+					}
+				}(cd)
+			}
+			wg.Wait()
+			if firstErr != nil {
+				log.Printf("while compacting the range on level %d: %v", l, firstErr)
+				return stats, firstErr
+			}
+		}
+	}
+	return stats, nil
+}
+
+// rangeCompactDefs registers at most workers compactions of the tables of level l holding keys
+// of [start, end) and written at or before maxFID. It returns pending if some of the tables
+// can't be compacted now because they are under compaction already
+func (lm *levelManager) rangeCompactDefs(l int, start, end []byte, maxFID uint64, workers int) (cds []compactDef, pending bool) {
+	t := lm.levelTargets()
+	lm.rlockLevels()
+	defer lm.runlockLevels()
+	thisLevel := lm.levels[l]
+	var top []*table
+	for i, tbl := range thisLevel.tables {
+		if tbl.fid > maxFID || !tbl.overlapsRange(start, end) {
+			continue
+		}
+		if l == 0 {
+			// A table of level 0 is never compacted without the older ones
+			top = append([]*table{}, thisLevel.tables[:i+1]...)
+		} else {
+			top = append(top, tbl)
+		}
+	}
+	if len(top) == 0 {
+		return nil, false
+	}
+	// Each group of the tables is compacted on its own, they share no table of the next level
+	var groups [][]*table
+	nextLevel := thisLevel
+	switch {
+	case thisLevel.isLastLevel():
+		// The tables of the last level are rewritten one by one
+		for _, tbl := range top {
+			groups = append(groups, []*table{tbl})
+		}
+	case l == 0:
+		nextLevel = lm.nextRangeLevel(l, getKeyRange(top...))
+		groups = [][]*table{top}
+	default:
+		nextLevel = lm.nextRangeLevel(l, getKeyRange(top...))
+		lastRight := -1
+		for _, tbl := range top {
+			left, right := nextLevel.overlappingTables(levelHandlerRLocked{}, getKeyRange(tbl))
+			if len(groups) > 0 && left < lastRight {
+				groups[len(groups)-1] = append(groups[len(groups)-1], tbl)
+			} else {
+				groups = append(groups, []*table{tbl})
+			}
+			if right > lastRight {
+				lastRight = right
+			}
+		}
+	}
+	for _, group := range groups {
+		if len(cds) == workers {
+			break
+		}
+		cd := compactDef{
+			compactorId: len(cds),
+			t:           t,
+			thisLevel:   thisLevel,
+			nextLevel:   nextLevel,
+			top:         group,
+			thisRange:   getKeyRange(group...),
+		}
+		if nextLevel != thisLevel {
+			left, right := nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+			cd.bot = append([]*table{}, nextLevel.tables[left:right]...)
+		}
+		if len(cd.bot) == 0 {
+			cd.nextRange = cd.thisRange
+		} else {
+			cd.nextRange = getKeyRange(cd.bot...)
+		}
+		if !lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, cd) {
+			pending = true
+			continue
+		}
+		cds = append(cds, cd)
+	}
+	return cds, pending
+}
+
+// nextRangeLevel returns the first level below l holding some keys of the range, the last level
+// if there is none. The levels in between are skipped, they hold nothing the tables would have
+// to be merged with. The levels must be read locked
+func (lm *levelManager) nextRangeLevel(l int, kr keyRange) *levelHandler {
+	for i := l + 1; i < len(lm.levels)-1; i++ {
+		if left, right := lm.levels[i].overlappingTables(levelHandlerRLocked{}, kr); right > left {
+			return lm.levels[i]
+		}
+	}
+	return lm.lastLevel()
+}
@@ -0,0 +1,77 @@
+package lsm
+
+import "testing"
+
+// levelStats returns the number of tables of the level and their size
+func levelStats(lh *levelHandler) (int, int64) {
+	lh.RLock()
+	defer lh.RUnlock()
+	return len(lh.tables), lh.getTotalSize()
+}
+
+// TestFlushStats Flush reports the memTables it waited for, a table written for each of them
+func TestFlushStats(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for i := 0; i < 500; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	stats, err := lsm.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TablesIn != 1 || stats.TablesOut != 1 || stats.BytesIn == 0 {
+		t.Fatalf("got %+v, want one memTable flushed", stats)
+	}
+	if n, _ := levelStats(lsm.levels.levels[0]); n != 1 {
+		t.Fatalf("level 0 holds %d tables, want 1", n)
+	}
+	// Nothing is left to flush
+	if stats, err = lsm.Flush(); err != nil || stats != (CompactionStats{}) {
+		t.Fatalf("flush of an empty memTable: got %+v, %v, want no work", stats, err)
+	}
+}
+
+// TestCompactRangeStats CompactRange reports every table it merged and wrote, the tables of the
+// last level are rewritten one by one
+func TestCompactRangeStats(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for v := uint64(1); v <= 3; v++ {
+		for i := 0; i < 2000; i++ {
+			mustSet(t, lsm, entry(i, v))
+		}
+		mustFlush(t, lsm)
+	}
+	l0Tables, l0Bytes := levelStats(lsm.levels.levels[0])
+	stats := compactAll(t, lsm)
+	if stats.Compactions == 0 || stats.TablesIn < l0Tables || stats.BytesIn < l0Bytes {
+		t.Fatalf("got %+v, want at least the %d tables and %d bytes of level 0", stats, l0Tables, l0Bytes)
+	}
+	for _, lh := range lsm.levels.levels[:len(lsm.levels.levels)-1] {
+		if n, _ := levelStats(lh); n != 0 {
+			t.Fatalf("level %d holds %d tables after the compaction", lh.levelNum, n)
+		}
+	}
+
+	lastTables, lastBytes := levelStats(lsm.levels.lastLevel())
+	stats, err := lsm.CompactRange(nil, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outTables, outBytes := levelStats(lsm.levels.lastLevel())
+	if stats.Compactions != lastTables || stats.TablesIn != lastTables || stats.BytesIn != lastBytes ||
+		stats.TablesOut != outTables || stats.BytesOut != outBytes {
+		t.Fatalf("got %+v, want %d tables of %d bytes in and %d tables of %d bytes out",
+			stats, lastTables, lastBytes, outTables, outBytes)
+	}
+
+	// Only the table holding the range is rewritten
+	if stats, err = lsm.CompactRange(key(0), key(1), 1); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Compactions != 1 || stats.TablesIn != 1 {
+		t.Fatalf("got %+v, want the one table of the range", stats)
+	}
+	for i := 0; i < 2000; i++ {
+		mustGet(t, lsm, key(i), 3, value(i))
+	}
+}
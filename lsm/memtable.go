@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/pb"
 	"github.com/Kirov7/FayKV/persistent"
 	"github.com/Kirov7/FayKV/utils"
 	"github.com/pkg/errors"
@@ -22,36 +23,45 @@ type memTable struct {
 	sl         *inmemory.SkipList
 	buf        *bytes.Buffer
 	maxVersion uint64
+	// rangeTombstones the range deletions written into the memTable, guarded by the lock of the LSM
+	rangeTombstones []*pb.RangeTombstone
 }
 
 func (lsm *LSM) NewMemTable() *memTable {
 	newFid := atomic.AddUint64(&(lsm.levels.maxFID), 1)
 	fileOpt := &persistent.Options{
-		FID:      newFid,
-		FileName: mtFilePath(lsm.option.WorkDir, newFid),
-		Dir:      lsm.option.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSize:  int(lsm.option.MemTableSize),
+		FID:         newFid,
+		FileName:    mtFilePath(lsm.option.WorkDir, newFid),
+		Dir:         lsm.option.WorkDir,
+		Flag:        os.O_CREATE | os.O_RDWR,
+		MaxSize:     int(lsm.option.MemTableSize),
+		KeyRegistry: lsm.option.KeyRegistry,
 	}
-	return &memTable{wal: persistent.OpenWalFile(fileOpt), sl: inmemory.NewSkipList(int64(1 << 20)), lsm: lsm}
+	wal, err := persistent.OpenWalFile(fileOpt)
+	utils.Panic(err)
+	return &memTable{wal: wal, sl: inmemory.NewSkipList(arenaSize(lsm.option)), lsm: lsm}
 }
 
 func (lsm *LSM) openMemTable(fid uint64) (*memTable, error) {
 	fileOpt := &persistent.Options{
-		Dir:      lsm.option.WorkDir,
-		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSize:  int(lsm.option.MemTableSize),
-		FID:      fid,
-		FileName: mtFilePath(lsm.option.WorkDir, fid),
+		Dir:         lsm.option.WorkDir,
+		Flag:        os.O_CREATE | os.O_RDWR,
+		MaxSize:     int(lsm.option.MemTableSize),
+		FID:         fid,
+		FileName:    mtFilePath(lsm.option.WorkDir, fid),
+		KeyRegistry: lsm.option.KeyRegistry,
 	}
-	s := inmemory.NewSkipList(int64(1 << 20))
+	s := inmemory.NewSkipList(arenaSize(lsm.option))
 	mt := &memTable{
 		sl:  s,
 		buf: &bytes.Buffer{},
 		lsm: lsm,
 	}
-	mt.wal = persistent.OpenWalFile(fileOpt)
-	err := mt.UpdateSkipList()
+	var err error
+	if mt.wal, err = persistent.OpenWalFile(fileOpt); err != nil {
+		return nil, err
+	}
+	err = mt.UpdateSkipList()
 	utils.CondPanic(err != nil, errors.WithMessage(err, "while updating skiplist"))
 	return mt, nil
 }
@@ -63,13 +73,57 @@ func (m *memTable) set(entry *utils.Entry) error {
 	}
 	// Write to memtable
 	m.sl.Set(entry)
+	m.updateMaxVersion(entry)
+	m.addRangeTombstone(entry)
+	return nil
+}
+
+func (m *memTable) updateMaxVersion(entry *utils.Entry) {
+	if ts := inmemory.ParseTs(entry.Key); ts > m.maxVersion {
+		m.maxVersion = ts
+	}
+}
+
+// addRangeTombstone records the range deletion of the entry, the entry itself is in the skiplist
+// as well and hides the start key
+func (m *memTable) addRangeTombstone(entry *utils.Entry) {
+	if rt := newRangeTombstone(entry); rt != nil {
+		m.rangeTombstones = append(m.rangeTombstones, rt)
+	}
+}
+
+// appendRangeTombstones appends the range deletions written at or below readTs to rts
+func (m *memTable) appendRangeTombstones(rts []*pb.RangeTombstone, readTs uint64) []*pb.RangeTombstone {
+	for _, rt := range m.rangeTombstones {
+		if rt.Version <= readTs {
+			rts = append(rts, rt)
+		}
+	}
+	return rts
+}
+
+func (m *memTable) setBatch(entries []*utils.Entry) error {
+	// The whole batch is one wal record
+	if err := m.wal.WriteBatch(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		m.sl.Set(entry)
+		m.updateMaxVersion(entry)
+		m.addRangeTombstone(entry)
+	}
 	return nil
 }
 
 func (m *memTable) Get(key []byte) (*utils.Entry, error) {
 	vs := m.sl.Search(key)
+	// Search fills the version from the matched key, a zero version means there is no such key
+	if vs.Version == 0 {
+		return nil, utils.ErrKeyNotFound
+	}
+	// The version found is the newest one at or below the version of the key
 	e := &utils.Entry{
-		Key:       key,
+		Key:       inmemory.KeyWithTs(inmemory.ParseKey(key), vs.Version),
 		Value:     vs.Value,
 		ExpiresAt: vs.ExpiresAt,
 		Meta:      vs.Meta,
@@ -78,6 +132,10 @@ func (m *memTable) Get(key []byte) (*utils.Entry, error) {
 	return e, nil
 }
 
+func (m *memTable) NewIterator(opt *utils.Options) utils.Iterator {
+	return m.sl.NewIterator(opt)
+}
+
 func (m *memTable) close() error {
 	if err := m.wal.Close(); err != nil {
 		return err
@@ -118,11 +176,18 @@ func (lsm *LSM) recovery() (*memTable, []*memTable) {
 	})
 	imms := []*memTable{}
 	// Iterate over fid and decode into memTable
+	tables := lsm.levels.manifestFile.GetManifest().Tables
 	for _, fid := range fids {
+		if _, ok := tables[fid]; ok {
+			// The memTable was flushed, the crash came before its wal was removed
+			utils.Panic(os.Remove(mtFilePath(lsm.option.WorkDir, fid)))
+			continue
+		}
 		mt, err := lsm.openMemTable(fid)
 		utils.CondPanic(err != nil, err)
-		if mt.sl.MemSize() == 0 {
-			// mt.DecrRef()
+		if mt.sl.Empty() {
+			// Nothing to replay, just drop the empty wal
+			utils.Panic(mt.close())
 			continue
 		}
 		imms = append(imms, mt)
@@ -146,14 +211,18 @@ func (m *memTable) UpdateSkipList() error {
 
 func (m *memTable) replayFunction(opt *Options) func(*utils.Entry, *utils.ValuePtr) error {
 	return func(e *utils.Entry, _ *utils.ValuePtr) error { // Function for replaying.
-		if ts := inmemory.ParseTs(e.Key); ts > m.maxVersion {
-			m.maxVersion = ts
-		}
+		m.updateMaxVersion(e)
+		m.addRangeTombstone(e)
 		m.sl.Set(e)
 		return nil
 	}
 }
 
+// arenaSize the memory reserved for the skiplist of a memTable
+func arenaSize(opt *Options) int64 {
+	return opt.MemTableSize + int64(inmemory.MaxNodeSize)
+}
+
 func mtFilePath(dir string, fid uint64) string {
 	return filepath.Join(dir, fmt.Sprintf("%05d%s", fid, persistent.WalFileExt))
 }
@@ -0,0 +1,183 @@
+package lsm
+
+import (
+	"bytes"
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/pb"
+	"github.com/Kirov7/FayKV/utils"
+	"log"
+	"math"
+	"sync/atomic"
+)
+
+// A range deletion is written as one entry at its start key, with BitDelete and BitRangeDelete
+// set and the end key as the value. The entry hides its start key like any tombstone and carries
+// the range through the wal, the memTables and the compactions. The tables keep the ranges of
+// their entries in the index as well, so that the reads find them without reading any block.
+
+// newRangeTombstone returns the range deletion of the entry, nil if it's not one
+func newRangeTombstone(e *utils.Entry) *pb.RangeTombstone {
+	if e.Meta&utils.BitRangeDelete == 0 {
+		return nil
+	}
+	return &pb.RangeTombstone{
+		Start:   append([]byte{}, inmemory.ParseKey(e.Key)...),
+		End:     append([]byte{}, e.Value...),
+		Version: inmemory.ParseTs(e.Key),
+	}
+}
+
+// covers returns true if the range deletion hides the version of the user key
+func covers(rt *pb.RangeTombstone, userKey []byte, version uint64) bool {
+	return version < rt.Version && bytes.Compare(userKey, rt.Start) >= 0 && bytes.Compare(userKey, rt.End) < 0
+}
+
+// coveredBy returns true if one of the range deletions hides the version of the user key
+func coveredBy(rts []*pb.RangeTombstone, userKey []byte, version uint64) bool {
+	return coveredAt(rts, userKey, version, math.MaxUint64)
+}
+
+// coveredAt returns true if one of the range deletions written at or below readTs hides
+// the version of the user key
+func coveredAt(rts []*pb.RangeTombstone, userKey []byte, version, readTs uint64) bool {
+	for _, rt := range rts {
+		if rt.Version <= readTs && covers(rt, userKey, version) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeDeleted returns true if the entry found by the lookup of the key is hidden by a range
+// deletion which the reader of the key sees. Only the range deletions holding the key are looked at,
+// nothing is collected
+func (lsm *LSM) rangeDeleted(key []byte, entry *utils.Entry) bool {
+	userKey, version, readTs := inmemory.ParseKey(key), inmemory.ParseTs(entry.Key), inmemory.ParseTs(key)
+	lsm.RLock()
+	covered := coveredAt(lsm.memTable.rangeTombstones, userKey, version, readTs)
+	for _, mt := range lsm.immutables {
+		covered = covered || coveredAt(mt.rangeTombstones, userKey, version, readTs)
+	}
+	lsm.RUnlock()
+	return covered || lsm.levels.rangeDeleted(userKey, version, readTs)
+}
+
+// rangeDeleted returns true if a range deletion of the tables written at or below readTs
+// hides the version of the user key
+func (lm *levelManager) rangeDeleted(userKey []byte, version, readTs uint64) bool {
+	if atomic.LoadInt64(&lm.numRangeTombstones) == 0 {
+		return false
+	}
+	for _, lh := range lm.levels {
+		lh.RLock()
+		covered := coveredAt(lh.rangeTombstones, userKey, version, readTs)
+		lh.RUnlock()
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeTombstones returns the range deletions of the memTables and the tables written at or below readTs
+func (lsm *LSM) rangeTombstones(readTs uint64) []*pb.RangeTombstone {
+	lsm.RLock()
+	rts := lsm.memTable.appendRangeTombstones(nil, readTs)
+	for _, mt := range lsm.immutables {
+		rts = mt.appendRangeTombstones(rts, readTs)
+	}
+	lsm.RUnlock()
+	return append(rts, lsm.levels.rangeTombstones(readTs)...)
+}
+
+// rangeTombstones returns the range deletions of the tables written at or below readTs
+func (lm *levelManager) rangeTombstones(readTs uint64) []*pb.RangeTombstone {
+	if atomic.LoadInt64(&lm.numRangeTombstones) == 0 {
+		return nil
+	}
+	var rts []*pb.RangeTombstone
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, rt := range lh.rangeTombstones {
+			if rt.Version <= readTs {
+				rts = append(rts, rt)
+			}
+		}
+		lh.RUnlock()
+	}
+	return rts
+}
+
+// overlapsOutside returns true if a table which is not part of the compaction may hold
+// a key of the range deletion
+func (lm *levelManager) overlapsOutside(rt *pb.RangeTombstone, cd compactDef) bool {
+	inCompaction := make(map[uint64]struct{}, len(cd.top)+len(cd.bot))
+	for _, t := range append(cd.top[:len(cd.top):len(cd.top)], cd.bot...) {
+		inCompaction[t.fid] = struct{}{}
+	}
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			if _, ok := inCompaction[t.fid]; ok {
+				continue
+			}
+			if bytes.Compare(inmemory.ParseKey(t.sst.MinKey()), rt.End) < 0 &&
+				bytes.Compare(inmemory.ParseKey(t.sst.MaxKey()), rt.Start) >= 0 {
+				lh.RUnlock()
+				return true
+			}
+		}
+		lh.RUnlock()
+	}
+	return false
+}
+
+// coveredByRange returns true if all the keys of the table are hidden by one of the range deletions,
+// a table holding range deletions itself is never covered
+func (t *table) coveredByRange(rts []*pb.RangeTombstone) bool {
+	idx := t.sst.Indexs()
+	if len(idx.RangeTombstones) > 0 {
+		return false
+	}
+	minKey, maxKey := inmemory.ParseKey(t.sst.MinKey()), inmemory.ParseKey(t.sst.MaxKey())
+	for _, rt := range rts {
+		if idx.MaxVersion < rt.Version && bytes.Compare(minKey, rt.Start) >= 0 && bytes.Compare(maxKey, rt.End) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dropCoveredTables deletes the tables whose keys are all hidden by a range deletion which every
+// reader sees, they are removed from the manifest without being rewritten
+func (lm *levelManager) dropCoveredTables() {
+	rts := lm.rangeTombstones(lm.discardTs())
+	if len(rts) == 0 {
+		return
+	}
+	for _, lh := range lm.levels {
+		cd := compactDef{thisLevel: lh, nextLevel: lh}
+		cd.lockLevels()
+		for _, t := range lh.tables {
+			if t.coveredByRange(rts) {
+				cd.top = append(cd.top, t)
+			}
+		}
+		if len(cd.top) == 0 {
+			cd.unlockLevels()
+			continue
+		}
+		// Registered like a compaction, so that no compacter picks the tables meanwhile
+		cd.thisRange = getKeyRange(cd.top...)
+		cd.nextRange = cd.thisRange
+		ok := lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, cd)
+		cd.unlockLevels()
+		if !ok {
+			continue
+		}
+		if err := lm.dropTables(cd); err != nil {
+			log.Printf("while dropping the tables covered by a range deletion on level %d: %v", lh.levelNum, err)
+		}
+		lm.compactState.delete(cd)
+	}
+}
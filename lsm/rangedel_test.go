@@ -0,0 +1,104 @@
+package lsm
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// rangeDeletion the entry deleting [key(start), key(end)) at version
+func rangeDeletion(start, end int, version uint64) *utils.Entry {
+	return &utils.Entry{
+		Key:   inmemory.KeyWithTs(key(start), version),
+		Value: key(end),
+		Meta:  utils.BitDelete | utils.BitRangeDelete,
+	}
+}
+
+func TestRangeDeletionReads(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	mustSet(t, lsm, rangeDeletion(10, 20, 2))
+	mustSet(t, lsm, entry(15, 3))
+	check := func() {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			want := value(i)
+			if i >= 10 && i < 20 && i != 15 {
+				want = nil
+			}
+			mustGet(t, lsm, key(i), 3, want)
+			// The readers before the deletion still see the keys
+			mustGet(t, lsm, key(i), 1, value(i))
+		}
+	}
+	// From the memTable, then from the tables
+	check()
+	mustFlush(t, lsm)
+	check()
+	// The ranges of the tables are read back from their index
+	lsm = openTestLSM(t, testOptions(crashCopy(t, lsm)))
+	check()
+}
+
+func TestCompactionDropsRangeDeleted(t *testing.T) {
+	discardTs := uint64(1)
+	lsm := openTestLSM(t, withDiscardTs(testOptions(t.TempDir()), &discardTs))
+	for i := 0; i < 100; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	mustSet(t, lsm, rangeDeletion(10, 20, 2))
+	// A reader at version 1 still sees the keys of the range
+	compactAll(t, lsm)
+	mustVersions(t, lsm, key(12), 1)
+	mustVersions(t, lsm, key(10), 2, 1)
+	mustGet(t, lsm, key(12), 1, value(12))
+	mustGet(t, lsm, key(12), 2, nil)
+
+	atomic.StoreUint64(&discardTs, math.MaxUint64)
+	compactAll(t, lsm)
+	for i := 10; i < 20; i++ {
+		mustVersions(t, lsm, key(i))
+		mustGet(t, lsm, key(i), 2, nil)
+	}
+	mustVersions(t, lsm, key(20), 1)
+	mustGet(t, lsm, key(20), 2, value(20))
+	if n := atomic.LoadInt64(&lsm.levels.numRangeTombstones); n != 0 {
+		t.Fatalf("range tombstones left: %d", n)
+	}
+}
+
+// TestRangeDeletionDropsTables the tables holding only deleted keys are dropped without
+// being rewritten
+func TestRangeDeletionDropsTables(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	for i := 0; i < 2000; i++ {
+		mustSet(t, lsm, entry(i, 1))
+	}
+	compactAll(t, lsm)
+	last := lsm.levels.lastLevel()
+	before := last.numTables()
+	if before < 2 {
+		t.Fatalf("got %d tables in the last level, want several", before)
+	}
+	// Some tables are covered whole, the ones at the ends only partly
+	mustSet(t, lsm, rangeDeletion(100, 1900, 2))
+	mustFlush(t, lsm)
+	lsm.levels.dropCoveredTables()
+	after := last.numTables()
+	if after >= before {
+		t.Fatalf("got %d tables in the last level, want less than %d", after, before)
+	}
+	for i := 0; i < 2000; i += 50 {
+		want := value(i)
+		if i >= 100 && i < 1900 {
+			want = nil
+		}
+		mustGet(t, lsm, key(i), 2, want)
+	}
+}
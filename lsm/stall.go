@@ -0,0 +1,71 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// updateDebt refreshes the debt of the compaction the writers are throttled by
+func (lm *levelManager) updateDebt() {
+	l0Tables, pendingBytes := lm.opt.CompactionStrategy.debt(lm)
+	atomic.StoreInt64(&lm.debtTables, int64(l0Tables))
+	atomic.StoreInt64(&lm.debtBytes, pendingBytes)
+}
+
+// throttleWrites blocks the write while the compaction is too far behind, and delays it while
+// the flush or the compaction falls behind, so that level 0 and the debt stay bounded
+func (lsm *LSM) throttleWrites() {
+	if lsm.writeStopped() {
+		start := time.Now()
+	wait:
+		for lsm.writeStopped() {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-lsm.stopStalls:
+				// The db is closed, the queued writes go through
+				break wait
+			}
+		}
+		atomic.AddInt64(&lsm.stopNanos, int64(time.Since(start)))
+	}
+	if lsm.writeSlowedDown() {
+		time.Sleep(lsm.option.SlowdownDelay)
+		atomic.AddInt64(&lsm.slowdownNanos, int64(lsm.option.SlowdownDelay))
+	}
+}
+
+// StopStalls lets the writes through without waiting for the compaction any more, the db calls
+// it once it's closed so that its queued writes can't hang. A write which still finds no room
+// in the memTables fails with ErrBlockedWrites
+func (lsm *LSM) StopStalls() {
+	lsm.stopStallsOnce.Do(func() {
+		close(lsm.stopStalls)
+	})
+}
+
+func (lsm *LSM) writeStopped() bool {
+	opt := lsm.option
+	l0Tables, pendingBytes := atomic.LoadInt64(&lsm.levels.debtTables), atomic.LoadInt64(&lsm.levels.debtBytes)
+	return opt.LevelZeroStopTables > 0 && l0Tables >= int64(opt.LevelZeroStopTables) ||
+		opt.PendingBytesStop > 0 && pendingBytes >= opt.PendingBytesStop
+}
+
+func (lsm *LSM) writeSlowedDown() bool {
+	opt := lsm.option
+	l0Tables, pendingBytes := atomic.LoadInt64(&lsm.levels.debtTables), atomic.LoadInt64(&lsm.levels.debtBytes)
+	if opt.LevelZeroSlowdownTables > 0 && l0Tables >= int64(opt.LevelZeroSlowdownTables) ||
+		opt.PendingBytesSlowdown > 0 && pendingBytes >= opt.PendingBytesSlowdown {
+		return true
+	}
+	if opt.ImmutablesSlowdown <= 0 {
+		return false
+	}
+	lsm.RLock()
+	defer lsm.RUnlock()
+	return len(lsm.immutables) >= opt.ImmutablesSlowdown
+}
+
+// WriteStalls returns the time the writes were delayed by a slowdown and blocked by a stop
+func (lsm *LSM) WriteStalls() (slowdown, stop time.Duration) {
+	return time.Duration(atomic.LoadInt64(&lsm.slowdownNanos)), time.Duration(atomic.LoadInt64(&lsm.stopNanos))
+}
@@ -0,0 +1,91 @@
+package lsm
+
+import (
+	"testing"
+	"time"
+)
+
+// setAsync writes the entry of key i in the background, the error is sent once it returns
+func setAsync(lsm *LSM, i int) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- lsm.Set(entry(i, 2))
+	}()
+	return done
+}
+
+func mustBlock(t testing.TB, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		t.Fatalf("the write went through the stop: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func mustReturn(t testing.TB, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("the write is still blocked")
+		return nil
+	}
+}
+
+// TestWriteStop the writes wait while level 0 holds LevelZeroStopTables tables, until the
+// compaction catches up
+func TestWriteStop(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.LevelZeroStopTables = 2
+	lsm := openTestLSM(t, opt)
+	fillLevelZero(t, lsm, 100, 2)
+	done := setAsync(lsm, 1)
+	mustBlock(t, done)
+	compactAll(t, lsm)
+	if err := mustReturn(t, done); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, lsm, key(1), 2, value(1))
+	if _, stop := lsm.WriteStalls(); stop < 100*time.Millisecond {
+		t.Fatalf("the writes were stopped for %v, want at least 100ms", stop)
+	}
+}
+
+// TestWriteStopClose a write blocked by the stop doesn't keep the lsm from closing
+func TestWriteStopClose(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.LevelZeroStopTables = 2
+	lsm := openTestLSM(t, opt)
+	fillLevelZero(t, lsm, 100, 2)
+	done := setAsync(lsm, 1)
+	mustBlock(t, done)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- lsm.Close()
+	}()
+	mustReturn(t, done)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("close hangs on the blocked write")
+	}
+}
+
+func TestWriteSlowdown(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.LevelZeroSlowdownTables = 2
+	opt.SlowdownDelay = 10 * time.Millisecond
+	lsm := openTestLSM(t, opt)
+	fillLevelZero(t, lsm, 100, 2)
+	for i := 0; i < 5; i++ {
+		mustSet(t, lsm, entry(i, 3))
+	}
+	if slowdown, stop := lsm.WriteStalls(); slowdown != 5*opt.SlowdownDelay || stop != 0 {
+		t.Fatalf("got a slowdown of %v and a stop of %v, want %v and none", slowdown, stop, 5*opt.SlowdownDelay)
+	}
+}
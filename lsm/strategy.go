@@ -0,0 +1,310 @@
+package lsm
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// CompactionStrategy decides which tables are merged and where the result goes. Every strategy
+// keeps the layout of the levels, the memTables are flushed to level 0 and each level below it
+// holds one sorted run whose tables don't overlap, so the reads don't depend on the strategy.
+// The compactions are installed through the change sets of the manifest like the leveled ones
+type CompactionStrategy interface {
+	// compact runs one compaction of the compacter id, it returns false if none was due
+	compact(lm *levelManager, id int) bool
+	// debt returns the tables of level 0 and the bytes waiting for a compaction,
+	// the writes are throttled while there are too many of them
+	debt(lm *levelManager) (l0Tables int, pendingBytes int64)
+}
+
+// leveledCompaction keeps every level under its target size by merging its tables
+// into the overlapping ones of the level below
+type leveledCompaction struct{}
+
+// NewLeveledCompaction returns the leveled strategy, the default one. It keeps the read and the
+// space amplification low, at the cost of rewriting the keys once per level
+func NewLeveledCompaction() CompactionStrategy {
+	return leveledCompaction{}
+}
+
+func (leveledCompaction) compact(lm *levelManager, id int) bool {
+	prios := lm.pickCompactLevels()
+	if id == 0 {
+		// Worker 0 always prefers level 0, it keeps the read amplification low
+		prios = moveL0toFront(prios)
+	}
+	for _, p := range prios {
+		if id == 0 && p.level == 0 {
+			// Allow worker zero to run level 0, irrespective of its adjusted score.
+		} else if p.adjusted < 1.0 {
+			break
+		}
+		if lm.run(id, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// debt the tables of level 0 count once the level is due, and the bytes the levels
+// below it are over their targets
+func (leveledCompaction) debt(lm *levelManager) (int, int64) {
+	t := lm.levelTargets()
+	l0Tables := lm.levels[0].numTables()
+	var pendingBytes int64
+	if l0Tables >= lm.opt.NumLevelZeroTables {
+		pendingBytes += lm.levels[0].getTotalSize()
+	}
+	for i := 1; i < len(lm.levels)-1; i++ {
+		if sz := lm.levels[i].getTotalSize(); sz > t.targetSz[i] {
+			pendingBytes += sz - t.targetSz[i]
+		}
+	}
+	return l0Tables, pendingBytes
+}
+
+// tieredCompaction the universal strategy, it merges the consecutive sorted runs of a similar
+// size. A key is rewritten about once each time the size of the data it's part of doubles,
+// instead of once per level
+type tieredCompaction struct {
+	sizeRatio     float64
+	minMergeWidth int
+	maxSizeAmp    float64
+}
+
+// NewTieredCompaction returns the size tiered strategy. A run is merged into the newer ones
+// before it while it's at most sizeRatio bigger than their sum, a merge takes at least
+// minMergeWidth runs. All the runs are merged into one once the newer runs are maxSizeAmp
+// times as big as the oldest one, which bounds the space taken by the stale versions
+func NewTieredCompaction(sizeRatio float64, minMergeWidth int, maxSizeAmp float64) CompactionStrategy {
+	if minMergeWidth < 2 {
+		minMergeWidth = 2
+	}
+	return tieredCompaction{sizeRatio: sizeRatio, minMergeWidth: minMergeWidth, maxSizeAmp: maxSizeAmp}
+}
+
+// sortedRun a table of level 0 or all the tables of a level below it
+type sortedRun struct {
+	level  *levelHandler
+	tables []*table
+	size   int64
+}
+
+func (s tieredCompaction) compact(lm *levelManager, id int) bool {
+	// The runs overlap each other, only one compacter merges them
+	if id != 0 {
+		return false
+	}
+	t := lm.levelTargets()
+	lm.rlockLevels()
+	cd, ok := s.pick(lm, lm.sortedRuns())
+	if ok {
+		cd.compactorId = id
+		cd.t = t
+		ok = lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, cd)
+	}
+	lm.runlockLevels()
+	if !ok {
+		return false
+	}
+	defer lm.compactState.delete(cd)
+	if _, err := lm.runCompactDef(id, cd.thisLevel.levelNum, cd); err != nil {
+		log.Printf("[Compactor: %d] LOG Tiered compact FAILED with error: %+v: %+v", id, err, cd)
+		return false
+	}
+	return true
+}
+
+// debt the tables of level 0 are the runs which are not merged into a level yet
+func (tieredCompaction) debt(lm *levelManager) (int, int64) {
+	return lm.levels[0].numTables(), lm.levels[0].getTotalSize()
+}
+
+// pick returns the compaction of the consecutive runs to merge, the levels must be read locked
+func (s tieredCompaction) pick(lm *levelManager, runs []sortedRun) (compactDef, bool) {
+	if len(runs) < s.minMergeWidth {
+		return compactDef{}, false
+	}
+	var newer int64
+	for _, r := range runs[:len(runs)-1] {
+		newer += r.size
+	}
+	if oldest := runs[len(runs)-1].size; float64(newer) >= s.maxSizeAmp*float64(oldest) {
+		return s.compactDef(lm, runs, 0, len(runs)), true
+	}
+	for from := 0; from+s.minMergeWidth <= len(runs); from++ {
+		sum := runs[from].size
+		to := from + 1
+		for ; to < len(runs) && float64(runs[to].size) <= float64(sum)*(1+s.sizeRatio); to++ {
+			sum += runs[to].size
+		}
+		if to-from < s.minMergeWidth {
+			continue
+		}
+		return s.compactDef(lm, runs, from, validRunsEnd(runs, to)), true
+	}
+	return compactDef{}, false
+}
+
+// validRunsEnd extends the end of the runs to merge so that the result has a level of its own.
+// A table of level 0 is never merged without the older ones, they would end up newer than it,
+// and level 1 is taken as well if nothing is left between level 0 and it
+func validRunsEnd(runs []sortedRun, to int) int {
+	if runs[to-1].level.levelNum > 0 {
+		return to
+	}
+	for to < len(runs) && runs[to].level.levelNum == 0 {
+		to++
+	}
+	if to < len(runs) && runs[to].level.levelNum == 1 {
+		to++
+	}
+	return to
+}
+
+// compactDef returns the compaction merging runs[from:to] into the level of the oldest one,
+// or into the lowest empty level above the runs left if it's a table of level 0
+func (s tieredCompaction) compactDef(lm *levelManager, runs []sortedRun, from, to int) compactDef {
+	cd := compactDef{thisLevel: runs[from].level}
+	oldest := runs[to-1]
+	switch {
+	case oldest.level.levelNum > 0:
+		cd.nextLevel = oldest.level
+		cd.bot = append([]*table{}, oldest.tables...)
+		to--
+	case to < len(runs):
+		cd.nextLevel = lm.levels[runs[to].level.levelNum-1]
+	default:
+		cd.nextLevel = lm.lastLevel()
+	}
+	// The oldest tables go first, the newest run is the last one
+	for i := to - 1; i >= from; i-- {
+		cd.top = append(cd.top, runs[i].tables...)
+		if lh := runs[i].level; lh != cd.thisLevel && (len(cd.runs) == 0 || cd.runs[len(cd.runs)-1] != lh) {
+			cd.runs = append(cd.runs, lh)
+		}
+	}
+	cd.thisRange = getKeyRange(cd.top...)
+	if len(cd.bot) == 0 {
+		cd.nextRange = cd.thisRange
+	} else {
+		cd.nextRange = getKeyRange(cd.bot...)
+	}
+	return cd
+}
+
+// sortedRuns returns the runs from the newest to the oldest, the tables of level 0 one by one
+// and then the levels below it which hold some tables. The levels must be read locked
+func (lm *levelManager) sortedRuns() []sortedRun {
+	var runs []sortedRun
+	l0 := lm.levels[0]
+	for i := len(l0.tables) - 1; i >= 0; i-- {
+		runs = append(runs, sortedRun{level: l0, tables: []*table{l0.tables[i]}, size: l0.tables[i].Size()})
+	}
+	for _, lh := range lm.levels[1:] {
+		if len(lh.tables) > 0 {
+			runs = append(runs, sortedRun{level: lh, tables: lh.tables, size: lh.totalSize})
+		}
+	}
+	return runs
+}
+
+// fifoCompaction never merges anything, the oldest tables are dropped once the tables
+// take more than maxSize bytes or once they are older than ttl
+type fifoCompaction struct {
+	maxSize int64
+	ttl     time.Duration
+}
+
+// NewFIFOCompaction returns the strategy for the data which is only kept for a while, like logs
+// or metrics. A zero maxSize or ttl leaves the budget open. The dropped keys are gone for good,
+// the older versions of them are dropped first. All the tables stay in level 0, the writes are
+// never slowed down or blocked for the tables of level 0, only for the bytes over maxSize
+func NewFIFOCompaction(maxSize int64, ttl time.Duration) CompactionStrategy {
+	return fifoCompaction{maxSize: maxSize, ttl: ttl}
+}
+
+func (s fifoCompaction) compact(lm *levelManager, id int) bool {
+	// The oldest tables must go first, only one compacter drops them
+	if id != 0 {
+		return false
+	}
+	var total int64
+	for _, lh := range lm.levels {
+		total += lh.getTotalSize()
+	}
+	var dropped bool
+	// The last level holds the oldest tables and level 0 the newest ones, at its end
+	for i := len(lm.levels) - 1; i >= 0; i-- {
+		lh := lm.levels[i]
+		cd := compactDef{thisLevel: lh, nextLevel: lh}
+		cd.lockLevels()
+		tables := append([]*table{}, lh.tables...)
+		if i > 0 {
+			sort.Slice(tables, func(i, j int) bool {
+				return tables[i].sst.Indexs().MaxVersion < tables[j].sst.Indexs().MaxVersion
+			})
+		}
+		for _, t := range tables {
+			if !s.expired(t, total) {
+				break
+			}
+			cd.top = append(cd.top, t)
+			total -= t.Size()
+		}
+		kept := len(cd.top) < len(tables)
+		ok := len(cd.top) > 0
+		if ok {
+			cd.thisRange = getKeyRange(cd.top...)
+			cd.nextRange = cd.thisRange
+			ok = lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, cd)
+		}
+		cd.unlockLevels()
+		if ok {
+			if err := lm.dropTables(cd); err != nil {
+				log.Printf("while dropping the oldest tables of level %d: %v", lh.levelNum, err)
+				ok = false
+			}
+			lm.compactState.delete(cd)
+			dropped = dropped || ok
+		}
+		if kept || len(cd.top) > 0 && !ok {
+			// The newer tables stay as long as an older one does
+			return dropped
+		}
+	}
+	return dropped
+}
+
+// debt reports no tables of level 0 on purpose, every flushed table stays there until it's
+// dropped and the real count would block the writes for good. The bytes over maxSize wait for
+// the compaction like for the other strategies
+func (s fifoCompaction) debt(lm *levelManager) (int, int64) {
+	var total int64
+	for _, lh := range lm.levels {
+		total += lh.getTotalSize()
+	}
+	if s.maxSize == 0 || total <= s.maxSize {
+		return 0, 0
+	}
+	return 0, total - s.maxSize
+}
+
+// expired returns true if the table must be dropped, total the size of all the tables left
+func (s fifoCompaction) expired(t *table, total int64) bool {
+	return s.maxSize > 0 && total > s.maxSize || s.ttl > 0 && time.Since(t.sst.CreatedAt()) > s.ttl
+}
+
+// rlockLevels read locks all the levels, from the top
+func (lm *levelManager) rlockLevels() {
+	for _, lh := range lm.levels {
+		lh.RLock()
+	}
+}
+
+func (lm *levelManager) runlockLevels() {
+	for i := len(lm.levels) - 1; i >= 0; i-- {
+		lm.levels[i].RUnlock()
+	}
+}
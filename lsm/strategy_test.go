@@ -0,0 +1,226 @@
+package lsm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Kirov7/FayKV/inmemory"
+)
+
+// compactUntilDone runs the compactions of the strategy until none is due
+func compactUntilDone(t testing.TB, lsm *LSM) int {
+	t.Helper()
+	for n := 0; n < 1000; n++ {
+		if !lsm.levels.runOnce(0) {
+			return n
+		}
+	}
+	t.Fatal("the compactions never end")
+	return 0
+}
+
+// mustSortedRuns fails if a level below level 0 holds tables which are out of order or overlap
+func mustSortedRuns(t testing.TB, lsm *LSM) {
+	t.Helper()
+	lm := lsm.levels
+	lm.rlockLevels()
+	defer lm.runlockLevels()
+	for _, lh := range lm.levels[1:] {
+		for i := 1; i < len(lh.tables); i++ {
+			prev, next := lh.tables[i-1].sst.MaxKey(), lh.tables[i].sst.MinKey()
+			if bytes.Compare(inmemory.ParseKey(prev), inmemory.ParseKey(next)) >= 0 {
+				t.Fatalf("level %d: table %d ends at %s after table %d starts at %s", lh.levelNum,
+					lh.tables[i-1].fid, inmemory.ParseKey(prev), lh.tables[i].fid, inmemory.ParseKey(next))
+			}
+		}
+	}
+}
+
+// writeRounds writes the keys of [0, n) rounds times, every round a new version flushed
+// to level 0, and runs the compactions after each of them
+func writeRounds(t testing.TB, lsm *LSM, n, rounds int) {
+	t.Helper()
+	for v := 1; v <= rounds; v++ {
+		for i := 0; i < n; i++ {
+			mustSet(t, lsm, entry(i, uint64(v)))
+		}
+		mustFlush(t, lsm)
+		compactUntilDone(t, lsm)
+		mustSortedRuns(t, lsm)
+	}
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	writeRounds(t, lsm, 1000, 8)
+	lm := lsm.levels
+	if n := lm.levels[0].numTables(); n >= lm.opt.NumLevelZeroTables {
+		t.Fatalf("level 0 holds %d tables, want less than %d", n, lm.opt.NumLevelZeroTables)
+	}
+	tg := lm.levelTargets()
+	for i := 1; i < len(lm.levels)-1; i++ {
+		if sz := lm.levels[i].getTotalSize(); sz > tg.targetSz[i] {
+			t.Fatalf("level %d holds %d bytes, over its target of %d", i, sz, tg.targetSz[i])
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		mustGet(t, lsm, key(i), 8, value(i))
+	}
+}
+
+func TestTieredCompaction(t *testing.T) {
+	// No version is stale, the merges keep all of them
+	var discardTs uint64
+	opt := withDiscardTs(testOptions(t.TempDir()), &discardTs)
+	opt.CompactionStrategy = NewTieredCompaction(1, 2, 2)
+	lsm := openTestLSM(t, opt)
+	writeRounds(t, lsm, 1000, 8)
+	lm := lsm.levels
+	lm.rlockLevels()
+	runs := len(lm.sortedRuns())
+	lm.runlockLevels()
+	// Every merge of two runs halves them, a few are left at most
+	if runs > 3 {
+		t.Fatalf("got %d sorted runs, want at most 3", runs)
+	}
+	for i := 0; i < 1000; i++ {
+		mustGet(t, lsm, key(i), 8, value(i))
+		mustGet(t, lsm, key(i), 1, value(i))
+	}
+}
+
+// TestTieredCompactionSizeAmp all the runs are merged once the newer ones outgrow the oldest
+func TestTieredCompactionSizeAmp(t *testing.T) {
+	discardTs := uint64(8)
+	opt := withDiscardTs(testOptions(t.TempDir()), &discardTs)
+	// A size ratio no run satisfies, only the size amplification merges them
+	opt.CompactionStrategy = NewTieredCompaction(-1, 2, 1)
+	lsm := openTestLSM(t, opt)
+	writeRounds(t, lsm, 1000, 4)
+	lm := lsm.levels
+	lm.rlockLevels()
+	runs := lm.sortedRuns()
+	lm.runlockLevels()
+	if len(runs) != 1 || runs[0].level != lm.lastLevel() {
+		t.Fatalf("got %d sorted runs, want all the tables in the last level", len(runs))
+	}
+	// The stale versions are dropped by the full merge
+	mustVersions(t, lsm, key(7), 4)
+}
+
+// TestFIFOCompaction the oldest tables are dropped once the tables take more than maxSize
+func TestFIFOCompaction(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	// A round of 500 keys takes a few KB, about four of them fit
+	const maxSize = 24 << 10
+	opt.CompactionStrategy = NewFIFOCompaction(maxSize, 0)
+	lsm := openTestLSM(t, opt)
+	for round := 0; round < 10; round++ {
+		for i := round * 500; i < (round+1)*500; i++ {
+			mustSet(t, lsm, entry(i, uint64(round+1)))
+		}
+		mustFlush(t, lsm)
+		compactUntilDone(t, lsm)
+	}
+	var total int64
+	for _, lh := range lsm.levels.levels {
+		total += lh.getTotalSize()
+	}
+	if total > maxSize {
+		t.Fatalf("the tables take %d bytes, over %d", total, maxSize)
+	}
+	// Nothing is merged, the tables are dropped whole from the oldest
+	if n := lsm.levels.levels[0].numTables(); n == 0 {
+		t.Fatal("level 0 holds no tables")
+	}
+	mustGet(t, lsm, key(0), 10, nil)
+	mustGet(t, lsm, key(4999), 10, value(4999))
+	var seen bool
+	for i := 0; i < 5000; i++ {
+		found := get(t, lsm, key(i), 10) != nil
+		if seen && !found {
+			t.Fatalf("%s was dropped before the older keys", key(i))
+		}
+		seen = seen || found
+	}
+}
+
+func TestFIFOCompactionTTL(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.CompactionStrategy = NewFIFOCompaction(0, time.Hour)
+	lsm := openTestLSM(t, opt)
+	writeRounds(t, lsm, 500, 2)
+	mustGet(t, lsm, key(7), 2, value(7))
+
+	// Every table is older than the ttl
+	lsm.levels.opt.CompactionStrategy = NewFIFOCompaction(0, time.Nanosecond)
+	compactUntilDone(t, lsm)
+	for _, lh := range lsm.levels.levels {
+		if n := lh.numTables(); n != 0 {
+			t.Fatalf("level %d holds %d tables after the ttl", lh.levelNum, n)
+		}
+	}
+	mustGet(t, lsm, key(7), 2, nil)
+}
+
+// TestFIFOCompactionTTLAfterCopy the ttl counts from the time the data was written, a copy of
+// the tables keeps their age
+func TestFIFOCompactionTTLAfterCopy(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.CompactionStrategy = NewFIFOCompaction(0, time.Hour)
+	lsm := openTestLSM(t, opt)
+	writeRounds(t, lsm, 500, 2)
+	written := make(map[uint64]time.Time)
+	for _, tbl := range lsm.levels.levels[0].tables {
+		written[tbl.fid] = tbl.sst.CreatedAt()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	opt = testOptions(crashCopy(t, lsm))
+	opt.CompactionStrategy = NewFIFOCompaction(0, time.Hour)
+	copied := openTestLSM(t, opt)
+	tables := copied.levels.levels[0].tables
+	if len(tables) != len(written) {
+		t.Fatalf("got %d tables in the copy, want %d", len(tables), len(written))
+	}
+	for _, tbl := range tables {
+		if got := tbl.sst.CreatedAt(); !got.Equal(written[tbl.fid]) {
+			t.Fatalf("table %d: created at %v in the copy, want %v", tbl.fid, got, written[tbl.fid])
+		}
+	}
+	compactUntilDone(t, copied)
+	mustGet(t, copied, key(7), 2, value(7))
+}
+
+// TestCompactionKeepsCreatedAt the tables written by a compaction are as old as the newest
+// table merged
+func TestCompactionKeepsCreatedAt(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	var newest time.Time
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			mustSet(t, lsm, entry(i, uint64(round+1)))
+		}
+		mustFlush(t, lsm)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, tbl := range lsm.levels.levels[0].tables {
+		if c := tbl.sst.CreatedAt(); c.After(newest) {
+			newest = c
+		}
+	}
+	compactAll(t, lsm)
+	if n := lsm.levels.levels[0].numTables(); n != 0 {
+		t.Fatalf("level 0 holds %d tables after the compaction", n)
+	}
+	var tables []*table
+	for _, lh := range lsm.levels.levels {
+		tables = append(tables, lh.tables...)
+	}
+	for _, tbl := range tables {
+		if got := tbl.sst.CreatedAt(); !got.Equal(newest) {
+			t.Fatalf("table %d: created at %v, want %v", tbl.fid, got, newest)
+		}
+	}
+}
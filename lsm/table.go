@@ -1,6 +1,7 @@
 package lsm
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"github.com/Kirov7/FayKV/cache"
@@ -25,27 +26,29 @@ type table struct {
 }
 
 func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table {
-	sstSize := int(lm.opt.SSTableMaxSize)
-	// if builder not nil ,we need to flush skiplist to sstable
-	if builder != nil {
-		sstSize = builder.done().size
-	}
 	var (
 		t   *table
 		err error
 	)
 	fid := utils.FID(tableName)
+	// if builder not nil ,we need to flush skiplist to sstable, it's built once by the flush
 	if builder != nil {
 		if t, err = builder.flush(lm, tableName); err != nil {
 			return nil
 		}
 	} else {
+		// Only the tables of the manifest are opened without a builder
+		dk, err := lm.opt.KeyRegistry.DataKey(lm.manifestFile.GetManifest().Tables[fid].KeyID)
+		if err != nil {
+			return nil
+		}
 		t = &table{lm: lm, fid: fid}
 		t.sst = persistent.OpenSSTable(&persistent.Options{
 			FileName: tableName,
 			Dir:      lm.opt.WorkDir,
 			Flag:     os.O_CREATE | os.O_RDWR,
-			MaxSize:  sstSize,
+			MaxSize:  int(lm.opt.SSTableMaxSize),
+			DataKey:  dk,
 		})
 	}
 	t.IncrRef()
@@ -69,10 +72,11 @@ func (t *table) Search(key []byte, maxVs *uint64) (entry *utils.Entry, err error
 	defer t.DecrRef()
 	idx := t.sst.Indexs()
 	bloomFilter := cache.Filter(idx.BloomFilter)
-	if t.sst.HasBloomFilter() && !bloomFilter.BlContains(key) {
+	// The filter holds the user keys without their version, a miss skips reading any block
+	if t.sst.HasBloomFilter() && !bloomFilter.BlContains(inmemory.ParseKey(key)) {
 		return nil, utils.ErrKeyNotFound
 	}
-	iter := t.NewIterator(&utils.Options{})
+	iter := t.NewIterator(&utils.Options{IsAsc: true})
 	defer iter.Close()
 
 	iter.Seek(key)
@@ -83,12 +87,57 @@ func (t *table) Search(key []byte, maxVs *uint64) (entry *utils.Entry, err error
 	if inmemory.SameKey(key, iter.Item().Entry().Key) {
 		if version := inmemory.ParseTs(iter.Item().Entry().Key); *maxVs < version {
 			*maxVs = version
-			return iter.Item().Entry(), nil
+			// The block may be a slice of the mmap of the file, which is unmapped once
+			// the compaction drops the table
+			return copyEntry(iter.Item().Entry()), nil
 		}
 	}
 	return nil, utils.ErrKeyNotFound
 }
 
+// overlapsRange returns false if no key of the table is in [lower, upper), a nil bound is open
+func (t *table) overlapsRange(lower, upper []byte) bool {
+	if lower != nil && bytes.Compare(inmemory.ParseKey(t.sst.MaxKey()), lower) < 0 {
+		return false
+	}
+	if upper != nil && bytes.Compare(inmemory.ParseKey(t.sst.MinKey()), upper) >= 0 {
+		return false
+	}
+	return true
+}
+
+// mayContainPrefix returns false if no key of the table starts with the prefix,
+// the prefix scans skip such a table without opening an iterator on it
+func (t *table) mayContainPrefix(prefix []byte) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+	// The keys of the prefix are in [prefix, the first key after the prefix)
+	if !t.overlapsRange(prefix, prefixEnd(prefix)) {
+		return false
+	}
+	idx := t.sst.Indexs()
+	ex := t.lm.opt.PrefixExtractor
+	if ex == nil || len(idx.PrefixBloomFilter) == 0 || idx.PrefixExtractor != ex.Name() {
+		return true
+	}
+	// A key starting with the prefix has the same extracted prefix as the prefix itself
+	p := ex.Prefix(prefix)
+	return p == nil || cache.Filter(idx.PrefixBloomFilter).MayContain(cache.MixedHash(p))
+}
+
+// tablesOf returns the tables which may hold a key of the iteration, the prefix and the bounds
+// of opt exclude the others
+func tablesOf(tables []*table, opt *utils.Options) []*table {
+	out := make([]*table, 0, len(tables))
+	for _, t := range tables {
+		if t.mayContainPrefix(opt.Prefix) && t.overlapsRange(opt.LowerBound, opt.UpperBound) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
 // blockCacheKey is used to store blocks in the block TableCache.
 func (t *table) blockCacheKey(idx int) []byte {
 	utils.CondPanic(t.fid >= math.MaxUint32, fmt.Errorf("t.fid >= math.MaxUint32"))
@@ -181,6 +230,22 @@ func (t *table) block(idx int) (*block, error) {
 		return nil, err
 	}
 
+	if dk := t.sst.DataKey(); dk != nil {
+		// Decrypted into a new buffer, the mmap of the table is left as it is
+		if b.data, err = utils.XORBlockAllocate(b.data, dk.Data, bo.GetIv()); err != nil {
+			return nil, errors.Wrapf(err, "failed to decrypt block %d of sstable: %d", idx, t.sst.FID())
+		}
+		readPos = len(b.data)
+	}
+
+	// The block is cached decompressed, so it is decoded only once
+	if ct := utils.CompressionType(t.sst.Indexs().GetCompression()); ct != utils.NoCompression {
+		if b.data, err = utils.Decompress(ct, b.data); err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress block %d of sstable: %d", idx, t.sst.FID())
+		}
+		readPos = len(b.data)
+	}
+
 	readPos -= 4
 	numEntries := int(utils.BytesToU32(b.data[readPos : readPos+4]))
 	entriesIndexStart := readPos - (numEntries * 4)
@@ -232,12 +297,20 @@ func (t *table) NewIterator(options *utils.Options) utils.Iterator {
 }
 
 func (itr *tableIterator) Next() {
+	if !itr.opt.IsAsc {
+		itr.prev()
+		return
+	}
 	itr.err = nil
 	if itr.blockPos >= len(itr.t.sst.Indexs().GetOffsets()) {
 		itr.err = io.EOF
 		return
 	}
 	if len(itr.bi.data) == 0 {
+		if itr.blockOutOfBounds(itr.blockPos) {
+			itr.err = io.EOF
+			return
+		}
 		block, err := itr.t.block(itr.blockPos)
 		if err != nil {
 			itr.err = err
@@ -248,6 +321,7 @@ func (itr *tableIterator) Next() {
 		itr.bi.setBlock(block)
 		itr.bi.seekToFirst()
 		itr.err = itr.bi.Error()
+		itr.it = itr.bi.Item()
 		return
 	}
 	itr.bi.Next()
@@ -260,6 +334,51 @@ func (itr *tableIterator) Next() {
 	itr.it = itr.bi.it
 }
 
+// prev moves to the previous entry, the previous block is loaded once the current one is exhausted
+func (itr *tableIterator) prev() {
+	itr.err = nil
+	if itr.blockPos < 0 || len(itr.bi.data) == 0 && itr.blockOutOfBounds(itr.blockPos) {
+		itr.err = io.EOF
+		return
+	}
+	if len(itr.bi.data) == 0 {
+		block, err := itr.t.block(itr.blockPos)
+		if err != nil {
+			itr.err = err
+			return
+		}
+		itr.bi.tableID = itr.t.fid
+		itr.bi.blockID = itr.blockPos
+		itr.bi.setBlock(block)
+		itr.bi.seekToLast()
+		itr.err = itr.bi.Error()
+		itr.it = itr.bi.Item()
+		return
+	}
+	itr.bi.prev()
+	if !itr.bi.Valid() {
+		itr.blockPos--
+		itr.bi.data = nil
+		itr.prev()
+		return
+	}
+	itr.it = itr.bi.it
+}
+
+// blockOutOfBounds returns true if neither the block nor the blocks after it in the order of the
+// iteration hold a key in the bounds of opt, they are not loaded at all
+func (itr *tableIterator) blockOutOfBounds(idx int) bool {
+	offsets := itr.t.sst.Indexs().GetOffsets()
+	if itr.opt.IsAsc {
+		// The blocks from idx on start at or after the upper bound
+		return itr.opt.UpperBound != nil &&
+			bytes.Compare(inmemory.ParseKey(offsets[idx].GetKey()), itr.opt.UpperBound) >= 0
+	}
+	// The keys of the blocks up to idx are before the first key of the block after it
+	return itr.opt.LowerBound != nil && idx+1 < len(offsets) &&
+		bytes.Compare(inmemory.ParseKey(offsets[idx+1].GetKey()), itr.opt.LowerBound) < 0
+}
+
 func (itr *tableIterator) Valid() bool {
 	return itr.err != io.EOF
 }
@@ -281,7 +400,13 @@ func (itr *tableIterator) Close() error {
 	return itr.t.DecrRef()
 }
 
+// Seek in ascending order it moves to the first key >= key, in descending order
+// to the last key <= key
 func (itr *tableIterator) Seek(key []byte) {
+	if !itr.opt.IsAsc {
+		itr.seekForPrev(key)
+		return
+	}
 	var bo pb.BlockOffset
 	idx := sort.Search(len(itr.t.sst.Indexs().GetOffsets()), func(idx int) bool {
 		utils.CondPanic(!itr.t.offsets(&bo, idx), fmt.Errorf("tableutils.Seek idx < 0 || idx > len(index.GetOffsets()"))
@@ -309,6 +434,39 @@ func (itr *tableIterator) seekHelper(blockIdx int, key []byte) {
 	itr.bi.setBlock(block)
 	itr.bi.Seek(key)
 	itr.err = itr.bi.Error()
+	// All keys of this block are smaller than the key, the next block starts with a bigger one
+	if itr.err == io.EOF && blockIdx+1 < len(itr.t.sst.Indexs().GetOffsets()) {
+		itr.blockPos++
+		itr.bi.data = nil
+		itr.Next()
+		return
+	}
+	itr.it = itr.bi.Item()
+}
+
+// seekForPrev moves to the last key <= key, it's in the last block whose first key is <= key
+func (itr *tableIterator) seekForPrev(key []byte) {
+	var bo pb.BlockOffset
+	idx := sort.Search(len(itr.t.sst.Indexs().GetOffsets()), func(idx int) bool {
+		utils.CondPanic(!itr.t.offsets(&bo, idx), fmt.Errorf("tableutils.Seek idx < 0 || idx > len(index.GetOffsets()"))
+		return inmemory.CompareKeys(bo.GetKey(), key) > 0
+	})
+	if idx == 0 {
+		// All the keys of the table are bigger
+		itr.err = io.EOF
+		return
+	}
+	itr.blockPos = idx - 1
+	block, err := itr.t.block(itr.blockPos)
+	if err != nil {
+		itr.err = err
+		return
+	}
+	itr.bi.tableID = itr.t.fid
+	itr.bi.blockID = itr.blockPos
+	itr.bi.setBlock(block)
+	itr.bi.seekForPrev(key)
+	itr.err = itr.bi.Error()
 	itr.it = itr.bi.Item()
 }
 
@@ -0,0 +1,114 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/Kirov7/FayKV/cache"
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// TestTableCompression the blocks are written with the codec of the lsm, and recorded in the index
+func TestTableCompression(t *testing.T) {
+	sizes := make(map[utils.CompressionType]int64)
+	for _, ct := range []utils.CompressionType{utils.NoCompression, utils.SnappyCompression, utils.ZSTDCompression} {
+		opt := testOptions(t.TempDir())
+		opt.Compression = ct
+		lsm := openTestLSM(t, opt)
+		for i := 0; i < 1000; i++ {
+			mustSet(t, lsm, utils.NewEntry(inmemory.KeyWithTs(key(i), 1), bytes.Repeat(value(i), 10)))
+		}
+		compactAll(t, lsm)
+		for _, tbl := range lsm.levels.lastLevel().tables {
+			if got := utils.CompressionType(tbl.sst.Indexs().GetCompression()); got != ct {
+				t.Fatalf("codec %d: the table records %d", ct, got)
+			}
+			sizes[ct] += tbl.Size()
+		}
+		for i := 0; i < 1000; i += 7 {
+			mustGet(t, lsm, key(i), 1, bytes.Repeat(value(i), 10))
+		}
+	}
+	if sizes[utils.SnappyCompression] >= sizes[utils.NoCompression] || sizes[utils.ZSTDCompression] >= sizes[utils.NoCompression] {
+		t.Fatalf("the compressed tables are not smaller: %v", sizes)
+	}
+}
+
+// fillLevelZero writes the even keys of [0, 2*n) rounds times, every round is flushed
+// to level 0 so that its tables cover the whole range
+func fillLevelZero(t testing.TB, lsm *LSM, n, rounds int) {
+	t.Helper()
+	for v := 1; v <= rounds; v++ {
+		for i := 0; i < 2*n; i += 2 {
+			mustSet(t, lsm, entry(i, uint64(v)))
+		}
+		mustFlush(t, lsm)
+	}
+}
+
+func TestBloomFilterFalsePositive(t *testing.T) {
+	lsm := openTestLSM(t, testOptions(t.TempDir()))
+	fillLevelZero(t, lsm, 500, 1)
+	tbl := lsm.levels.levels[0].tables[0]
+	if !tbl.sst.HasBloomFilter() {
+		t.Fatal("the table has no bloom filter")
+	}
+	filter := cache.Filter(tbl.sst.Indexs().BloomFilter)
+	var passed int
+	for i := 0; i < 1000; i++ {
+		contains := filter.BlContains(key(i))
+		if i%2 == 0 && !contains {
+			t.Fatalf("the filter misses %s", key(i))
+		}
+		if i%2 == 1 && contains {
+			passed++
+		}
+	}
+	// 1% expected, a few times more is still fine for 500 lookups
+	if passed > 25 {
+		t.Fatalf("%d of the 500 missing keys pass the filter", passed)
+	}
+}
+
+// TestBloomFilterPerLevel a level can have filters of its own rate, or none
+func TestBloomFilterPerLevel(t *testing.T) {
+	opt := testOptions(t.TempDir())
+	opt.LevelBloomFalsePositive = map[int]float64{opt.MaxLevelNum - 1: 0}
+	lsm := openTestLSM(t, opt)
+	fillLevelZero(t, lsm, 500, 1)
+	if !lsm.levels.levels[0].tables[0].sst.HasBloomFilter() {
+		t.Fatal("the table of level 0 has no bloom filter")
+	}
+	compactAll(t, lsm)
+	for _, tbl := range lsm.levels.lastLevel().tables {
+		if tbl.sst.HasBloomFilter() {
+			t.Fatalf("table %d of the last level has a bloom filter", tbl.fid)
+		}
+	}
+	mustGet(t, lsm, key(10), 1, value(10))
+	mustGet(t, lsm, key(11), 1, nil)
+}
+
+// BenchmarkGetMissing looks up the keys which fall into the range of every table of level 0
+// but are in none of them, only the bloom filters spare reading a block of every table
+func BenchmarkGetMissing(b *testing.B) {
+	for _, fp := range []float64{0, 0.01} {
+		b.Run(fmt.Sprintf("bloom=%v", fp), func(b *testing.B) {
+			opt := testOptions(b.TempDir())
+			opt.BloomFalsePositive = fp
+			opt.NumLevelZeroTables = 100
+			lsm := openTestLSM(b, opt)
+			fillLevelZero(b, lsm, 2000, 8)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				k := inmemory.KeyWithTs(key(2*(i%2000)+1), math.MaxUint64)
+				if e, _ := lsm.Get(k); e != nil {
+					b.Fatalf("found the missing key %s", inmemory.ParseKey(k))
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,11 @@
 package FayKV
 
-import "github.com/Kirov7/FayKV/utils"
+import (
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/lsm"
+	"github.com/Kirov7/FayKV/utils"
+	"time"
+)
 
 type Options struct {
 	ValueThreshold      int64
@@ -14,11 +19,96 @@ type Options struct {
 	ValueLogMaxEntries  uint32
 	LogRotatesToFlush   int32
 	MaxTableSize        int64
+	SyncMode            utils.SyncMode
+	SyncInterval        time.Duration         // The interval of the fsync in SyncEveryInterval mode
+	Compression         utils.CompressionType // The codec of the sstable blocks, none by default
+	// BloomFalsePositive the false positive rate of the bloom filters of the tables,
+	// 0.01 by default and a negative rate builds none
+	BloomFalsePositive float64
+	// LevelBloomFalsePositive overrides BloomFalsePositive for a level, 0 builds no filter for
+	// the level. The last level holds most of the keys, its filters take the most memory
+	LevelBloomFalsePositive map[int]float64
+	// PrefixExtractor builds a prefix filter into every table, a scan with utils.Options.Prefix
+	// skips the tables which can't hold its keys. Use utils.NewFixedPrefixExtractor for the
+	// scans of a fixed prefix length
+	PrefixExtractor utils.PrefixExtractor
+	// VerifyChecksumsOnOpen reads every table in full on Open to verify its checksum, the startup
+	// takes as long as reading all the data. The blocks are verified once they are read anyway
+	VerifyChecksumsOnOpen bool
+	// CompactionStrategy leveled by default, lsm.NewTieredCompaction writes the keys fewer times
+	// for the write heavy workloads and lsm.NewFIFOCompaction drops the oldest tables, it
+	// ignores the level 0 thresholds below
+	CompactionStrategy lsm.CompactionStrategy
+	// The writes are delayed by SlowdownDelay each once level 0 holds LevelZeroSlowdownTables
+	// tables, ImmutablesSlowdown memTables wait for the flush or the compaction is
+	// PendingBytesSlowdown bytes behind, and blocked once level 0 holds LevelZeroStopTables
+	// tables or the compaction is PendingBytesStop bytes behind. A negative threshold is disabled
+	LevelZeroSlowdownTables int
+	LevelZeroStopTables     int
+	ImmutablesSlowdown      int
+	PendingBytesSlowdown    int64
+	PendingBytesStop        int64
+	SlowdownDelay           time.Duration
+	// EncryptionKey the aes master key of 16, 24 or 32 bytes, the files are encrypted if it's set
+	EncryptionKey []byte
+	// EncryptionKeyRotationDuration the age of the data key after which a new one is generated
+	EncryptionKeyRotationDuration time.Duration
+}
+
+// fillDefaults sets the options which are left zero
+func (opt *Options) fillDefaults() {
+	if opt.ValueThreshold == 0 {
+		opt.ValueThreshold = utils.DefaultValueThreshold
+	}
+	if opt.ValueLogFileSize == 0 {
+		opt.ValueLogFileSize = utils.DefaultValueLogFileSize
+	}
+	if opt.ValueLogMaxEntries == 0 {
+		opt.ValueLogMaxEntries = utils.DefaultValueLogMaxEntries
+	}
+	// A batch must fit into one memTable with room to spare
+	if opt.MaxBatchSize == 0 {
+		opt.MaxBatchSize = (15 * opt.MemTableSize) / 100
+	}
+	if opt.MaxBatchCount == 0 {
+		opt.MaxBatchCount = opt.MaxBatchSize / int64(inmemory.MaxNodeSize)
+	}
+	if opt.SyncInterval == 0 {
+		opt.SyncInterval = utils.DefaultSyncInterval
+	}
+	if opt.BloomFalsePositive == 0 {
+		opt.BloomFalsePositive = utils.DefaultBloomFalsePositive
+	}
+	if opt.EncryptionKeyRotationDuration == 0 {
+		opt.EncryptionKeyRotationDuration = utils.DefaultKeyRotationDuration
+	}
+	if opt.LevelZeroSlowdownTables == 0 {
+		opt.LevelZeroSlowdownTables = utils.DefaultLevelZeroSlowdownTables
+	}
+	if opt.LevelZeroStopTables == 0 {
+		opt.LevelZeroStopTables = utils.DefaultLevelZeroStopTables
+	}
+	if opt.ImmutablesSlowdown == 0 {
+		opt.ImmutablesSlowdown = utils.DefaultImmutablesSlowdown
+	}
+	if opt.PendingBytesSlowdown == 0 {
+		opt.PendingBytesSlowdown = utils.DefaultPendingBytesSlowdown
+	}
+	if opt.PendingBytesStop == 0 {
+		opt.PendingBytesStop = utils.DefaultPendingBytesStop
+	}
+	if opt.SlowdownDelay == 0 {
+		opt.SlowdownDelay = utils.DefaultSlowdownDelay
+	}
 }
 
 type Stats struct {
 	closer   *utils.Closer
 	EntryNum int64 // Number of stored entries
+	// WriteSlowdown, WriteStop the time the writes were delayed and blocked because the flush
+	// or the compaction fell behind
+	WriteSlowdown time.Duration
+	WriteStop     time.Duration
 }
 
 // NewStats
@@ -0,0 +1,155 @@
+package FayKV
+
+import (
+	"bytes"
+	"math"
+	"sync"
+)
+
+// oracle hands out the commit timestamps and keeps the read timestamps in use.
+// A commit is only visible to the reads once all the commits before it are applied
+type oracle struct {
+	sync.Mutex
+	nextTxnTs     uint64 // the commit timestamp of the next write
+	lastCommitted uint64 // every write at or below it is applied
+	// readTs the read timestamps pinned by the snapshots and the running reads,
+	// with the number of readers of each
+	readTs map[uint64]int
+	// committedTxns the commits a transaction which is still open may conflict with
+	committedTxns []committedTxn
+}
+
+type committedTxn struct {
+	ts uint64
+	// conflictKeys the fingerprints of the keys written by the commit
+	conflictKeys map[uint64]struct{}
+	// conflictRanges the ranges deleted by the commit, a fingerprint can't cover them
+	conflictRanges []conflictRange
+}
+
+// conflictRange the keys of [start, end)
+type conflictRange struct {
+	start, end []byte
+}
+
+func (r conflictRange) contains(key []byte) bool {
+	return bytes.Compare(key, r.start) >= 0 && bytes.Compare(key, r.end) < 0
+}
+
+func newOracle(maxVersion uint64) *oracle {
+	return &oracle{
+		nextTxnTs:     maxVersion + 1,
+		lastCommitted: maxVersion,
+		readTs:        make(map[uint64]int),
+	}
+}
+
+// newCommitTs is only called by the writer goroutine, the timestamps are applied in order
+func (o *oracle) newCommitTs() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	ts := o.nextTxnTs
+	o.nextTxnTs++
+	return ts
+}
+
+// doneCommit makes the writes up to ts visible
+func (o *oracle) doneCommit(ts uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if ts > o.lastCommitted {
+		o.lastCommitted = ts
+	}
+}
+
+// pinReadTs returns the read timestamp of a new reader, the versions it can see are
+// kept by the compaction until unpinReadTs is called
+func (o *oracle) pinReadTs() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	ts := o.lastCommitted
+	o.readTs[ts]++
+	return ts
+}
+
+// pin pins a read timestamp which is already in use, by a snapshot for example
+func (o *oracle) pin(ts uint64) {
+	o.Lock()
+	defer o.Unlock()
+	o.readTs[ts]++
+}
+
+func (o *oracle) unpinReadTs(ts uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if o.readTs[ts]--; o.readTs[ts] <= 0 {
+		delete(o.readTs, ts)
+	}
+}
+
+// hasConflict returns true if a key read by the transaction was written or deleted
+// by a range deletion of a commit after the transaction started
+func (o *oracle) hasConflict(txn *Txn) bool {
+	if len(txn.reads) == 0 {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+	for _, committed := range o.committedTxns {
+		if committed.ts <= txn.readTs {
+			continue
+		}
+		for _, ro := range txn.reads {
+			if _, has := committed.conflictKeys[ro]; has {
+				return true
+			}
+		}
+		for _, r := range committed.conflictRanges {
+			for _, key := range txn.readKeys {
+				if r.contains(key) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// addCommitted records the keys written at ts, and forgets the commits which
+// no transaction can conflict with any more
+func (o *oracle) addCommitted(ts uint64, conflictKeys map[uint64]struct{}, conflictRanges []conflictRange) {
+	o.Lock()
+	defer o.Unlock()
+	// Only a transaction which started before a commit can conflict with it. Every open
+	// transaction pins its read timestamp, and the next ones read at lastCommitted or later
+	minReadTs := o.lastCommitted
+	for readTs := range o.readTs {
+		if readTs < minReadTs {
+			minReadTs = readTs
+		}
+	}
+	kept := o.committedTxns[:0]
+	for _, committed := range o.committedTxns {
+		if committed.ts > minReadTs {
+			kept = append(kept, committed)
+		}
+	}
+	o.committedTxns = append(kept, committedTxn{ts: ts, conflictKeys: conflictKeys, conflictRanges: conflictRanges})
+}
+
+// discardAtOrBelow returns the timestamp below which only the newest version of
+// a key is visible to the readers
+func (o *oracle) discardAtOrBelow() uint64 {
+	o.Lock()
+	defer o.Unlock()
+	ts := uint64(math.MaxUint64)
+	for readTs := range o.readTs {
+		if readTs < ts {
+			ts = readTs
+		}
+	}
+	if o.lastCommitted < ts {
+		ts = o.lastCommitted
+	}
+	return ts
+}
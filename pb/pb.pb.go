@@ -243,6 +243,7 @@ type ManifestChange struct {
 	Op                   ManifestChange_Operation `protobuf:"varint,2,opt,name=Op,proto3,enum=pb.ManifestChange_Operation" json:"Op,omitempty"`
 	Level                uint32                   `protobuf:"varint,3,opt,name=Level,proto3" json:"Level,omitempty"`
 	Checksum             []byte                   `protobuf:"bytes,4,opt,name=Checksum,proto3" json:"Checksum,omitempty"`
+	KeyId                uint64                   `protobuf:"varint,5,opt,name=KeyId,proto3" json:"KeyId,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}                 `json:"-"`
 	XXX_unrecognized     []byte                   `json:"-"`
 	XXX_sizecache        int32                    `json:"-"`
@@ -309,15 +310,27 @@ func (m *ManifestChange) GetChecksum() []byte {
 	return nil
 }
 
+func (m *ManifestChange) GetKeyId() uint64 {
+	if m != nil {
+		return m.KeyId
+	}
+	return 0
+}
+
 type TableIndex struct {
-	Offsets              []*BlockOffset `protobuf:"bytes,1,rep,name=offsets,proto3" json:"offsets,omitempty"`
-	BloomFilter          []byte         `protobuf:"bytes,2,opt,name=bloomFilter,proto3" json:"bloomFilter,omitempty"`
-	MaxVersion           uint64         `protobuf:"varint,3,opt,name=maxVersion,proto3" json:"maxVersion,omitempty"`
-	KeyCount             uint32         `protobuf:"varint,4,opt,name=keyCount,proto3" json:"keyCount,omitempty"`
-	StaleDataSize        uint32         `protobuf:"varint,5,opt,name=staleDataSize,proto3" json:"staleDataSize,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	Offsets              []*BlockOffset    `protobuf:"bytes,1,rep,name=offsets,proto3" json:"offsets,omitempty"`
+	BloomFilter          []byte            `protobuf:"bytes,2,opt,name=bloomFilter,proto3" json:"bloomFilter,omitempty"`
+	MaxVersion           uint64            `protobuf:"varint,3,opt,name=maxVersion,proto3" json:"maxVersion,omitempty"`
+	KeyCount             uint32            `protobuf:"varint,4,opt,name=keyCount,proto3" json:"keyCount,omitempty"`
+	StaleDataSize        uint32            `protobuf:"varint,5,opt,name=staleDataSize,proto3" json:"staleDataSize,omitempty"`
+	Compression          uint32            `protobuf:"varint,6,opt,name=compression,proto3" json:"compression,omitempty"`
+	PrefixBloomFilter    []byte            `protobuf:"bytes,7,opt,name=prefixBloomFilter,proto3" json:"prefixBloomFilter,omitempty"`
+	PrefixExtractor      string            `protobuf:"bytes,8,opt,name=prefixExtractor,proto3" json:"prefixExtractor,omitempty"`
+	RangeTombstones      []*RangeTombstone `protobuf:"bytes,9,rep,name=rangeTombstones,proto3" json:"rangeTombstones,omitempty"`
+	CreatedAt            int64             `protobuf:"varint,10,opt,name=createdAt,proto3" json:"createdAt,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
 }
 
 func (m *TableIndex) Reset()         { *m = TableIndex{} }
@@ -388,10 +401,110 @@ func (m *TableIndex) GetStaleDataSize() uint32 {
 	return 0
 }
 
+func (m *TableIndex) GetCompression() uint32 {
+	if m != nil {
+		return m.Compression
+	}
+	return 0
+}
+
+func (m *TableIndex) GetPrefixBloomFilter() []byte {
+	if m != nil {
+		return m.PrefixBloomFilter
+	}
+	return nil
+}
+
+func (m *TableIndex) GetPrefixExtractor() string {
+	if m != nil {
+		return m.PrefixExtractor
+	}
+	return ""
+}
+
+func (m *TableIndex) GetRangeTombstones() []*RangeTombstone {
+	if m != nil {
+		return m.RangeTombstones
+	}
+	return nil
+}
+
+func (m *TableIndex) GetCreatedAt() int64 {
+	if m != nil {
+		return m.CreatedAt
+	}
+	return 0
+}
+
+// RangeTombstone deletes the versions older than version of the keys in [start, end)
+type RangeTombstone struct {
+	Start                []byte   `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"`
+	End                  []byte   `protobuf:"bytes,2,opt,name=end,proto3" json:"end,omitempty"`
+	Version              uint64   `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RangeTombstone) Reset()         { *m = RangeTombstone{} }
+func (m *RangeTombstone) String() string { return proto.CompactTextString(m) }
+func (*RangeTombstone) ProtoMessage()    {}
+func (*RangeTombstone) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f80abaa17e25ccc8, []int{5}
+}
+func (m *RangeTombstone) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *RangeTombstone) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_RangeTombstone.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *RangeTombstone) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RangeTombstone.Merge(m, src)
+}
+func (m *RangeTombstone) XXX_Size() int {
+	return m.Size()
+}
+func (m *RangeTombstone) XXX_DiscardUnknown() {
+	xxx_messageInfo_RangeTombstone.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RangeTombstone proto.InternalMessageInfo
+
+func (m *RangeTombstone) GetStart() []byte {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *RangeTombstone) GetEnd() []byte {
+	if m != nil {
+		return m.End
+	}
+	return nil
+}
+
+func (m *RangeTombstone) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
 type BlockOffset struct {
 	Key                  []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
 	Offset               uint32   `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
 	Len                  uint32   `protobuf:"varint,3,opt,name=len,proto3" json:"len,omitempty"`
+	Iv                   []byte   `protobuf:"bytes,4,opt,name=iv,proto3" json:"iv,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -401,7 +514,7 @@ func (m *BlockOffset) Reset()         { *m = BlockOffset{} }
 func (m *BlockOffset) String() string { return proto.CompactTextString(m) }
 func (*BlockOffset) ProtoMessage()    {}
 func (*BlockOffset) Descriptor() ([]byte, []int) {
-	return fileDescriptor_f80abaa17e25ccc8, []int{5}
+	return fileDescriptor_f80abaa17e25ccc8, []int{6}
 }
 func (m *BlockOffset) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -451,6 +564,84 @@ func (m *BlockOffset) GetLen() uint32 {
 	return 0
 }
 
+func (m *BlockOffset) GetIv() []byte {
+	if m != nil {
+		return m.Iv
+	}
+	return nil
+}
+
+type DataKey struct {
+	KeyId                uint64   `protobuf:"varint,1,opt,name=keyId,proto3" json:"keyId,omitempty"`
+	Data                 []byte   `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Iv                   []byte   `protobuf:"bytes,3,opt,name=iv,proto3" json:"iv,omitempty"`
+	CreatedAt            int64    `protobuf:"varint,4,opt,name=createdAt,proto3" json:"createdAt,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DataKey) Reset()         { *m = DataKey{} }
+func (m *DataKey) String() string { return proto.CompactTextString(m) }
+func (*DataKey) ProtoMessage()    {}
+func (*DataKey) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f80abaa17e25ccc8, []int{7}
+}
+func (m *DataKey) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *DataKey) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_DataKey.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *DataKey) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DataKey.Merge(m, src)
+}
+func (m *DataKey) XXX_Size() int {
+	return m.Size()
+}
+func (m *DataKey) XXX_DiscardUnknown() {
+	xxx_messageInfo_DataKey.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DataKey proto.InternalMessageInfo
+
+func (m *DataKey) GetKeyId() uint64 {
+	if m != nil {
+		return m.KeyId
+	}
+	return 0
+}
+
+func (m *DataKey) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (m *DataKey) GetIv() []byte {
+	if m != nil {
+		return m.Iv
+	}
+	return nil
+}
+
+func (m *DataKey) GetCreatedAt() int64 {
+	if m != nil {
+		return m.CreatedAt
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterEnum("pb.ManifestChange_Operation", ManifestChange_Operation_name, ManifestChange_Operation_value)
 	proto.RegisterType((*KV)(nil), "pb.KV")
@@ -458,44 +649,56 @@ func init() {
 	proto.RegisterType((*ManifestChangeSet)(nil), "pb.ManifestChangeSet")
 	proto.RegisterType((*ManifestChange)(nil), "pb.ManifestChange")
 	proto.RegisterType((*TableIndex)(nil), "pb.TableIndex")
+	proto.RegisterType((*RangeTombstone)(nil), "pb.RangeTombstone")
 	proto.RegisterType((*BlockOffset)(nil), "pb.BlockOffset")
+	proto.RegisterType((*DataKey)(nil), "pb.DataKey")
 }
 
 func init() { proto.RegisterFile("pb.proto", fileDescriptor_f80abaa17e25ccc8) }
 
 var fileDescriptor_f80abaa17e25ccc8 = []byte{
-	// 485 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x52, 0x5d, 0x6e, 0xda, 0x4c,
-	0x14, 0xcd, 0x18, 0x62, 0xe0, 0x12, 0xf3, 0xf1, 0x8d, 0xaa, 0xc8, 0xea, 0x0f, 0xb2, 0xdc, 0x3e,
-	0x50, 0x29, 0xe2, 0x21, 0x5d, 0x01, 0x21, 0x54, 0xb2, 0x20, 0x42, 0x9a, 0x20, 0x5e, 0xd1, 0x18,
-	0x5f, 0x1a, 0xcb, 0xbf, 0xf2, 0x0c, 0x16, 0xe9, 0x4a, 0xba, 0x81, 0xae, 0xa0, 0x8f, 0xdd, 0x40,
-	0x1f, 0xbb, 0x84, 0x8a, 0x6e, 0xa4, 0x9a, 0xc1, 0x20, 0x50, 0xfb, 0x76, 0xcf, 0xb9, 0x77, 0xce,
-	0x9c, 0x39, 0x77, 0xa0, 0x99, 0xfb, 0x83, 0xbc, 0xc8, 0x64, 0x46, 0x8d, 0xdc, 0x77, 0xbf, 0x11,
-	0x30, 0x26, 0x0b, 0xda, 0x85, 0x5a, 0x84, 0xcf, 0x36, 0x71, 0x48, 0xff, 0x8a, 0xa9, 0x92, 0xbe,
-	0x80, 0xcb, 0x92, 0xc7, 0x1b, 0xb4, 0x0d, 0xcd, 0xed, 0x01, 0x7d, 0x05, 0xad, 0x8d, 0xc0, 0x62,
-	0x99, 0xa0, 0xe4, 0x76, 0x4d, 0x77, 0x9a, 0x8a, 0x78, 0x40, 0xc9, 0xa9, 0x0d, 0x8d, 0x12, 0x0b,
-	0x11, 0x66, 0xa9, 0x5d, 0x77, 0x48, 0xbf, 0xce, 0x0e, 0x90, 0xbe, 0x01, 0xc0, 0x6d, 0x1e, 0x16,
-	0x28, 0x96, 0x5c, 0xda, 0x97, 0xba, 0xd9, 0xaa, 0x98, 0xa1, 0xa4, 0x14, 0xea, 0x5a, 0xd0, 0xd4,
-	0x82, 0xba, 0x56, 0x37, 0x09, 0x59, 0x20, 0x4f, 0x96, 0x61, 0x60, 0x83, 0x43, 0xfa, 0x16, 0x6b,
-	0xee, 0x09, 0x2f, 0x70, 0x1d, 0x30, 0x27, 0x8b, 0x69, 0x28, 0x24, 0xbd, 0x06, 0x23, 0x2a, 0x6d,
-	0xe2, 0xd4, 0xfa, 0xed, 0x5b, 0x73, 0x90, 0xfb, 0x83, 0xc9, 0x82, 0x19, 0x51, 0xe9, 0x0e, 0xe1,
-	0xff, 0x07, 0x9e, 0x86, 0x6b, 0x14, 0x72, 0xf4, 0xc4, 0xd3, 0x4f, 0xf8, 0x88, 0x92, 0xde, 0x40,
-	0x63, 0xa5, 0x81, 0xa8, 0x4e, 0x50, 0x75, 0xe2, 0x7c, 0x8e, 0x1d, 0x46, 0xdc, 0xaf, 0x04, 0x3a,
-	0xe7, 0x3d, 0xda, 0x01, 0xc3, 0x0b, 0x74, 0x4a, 0x75, 0x66, 0x78, 0x01, 0xbd, 0x01, 0x63, 0x96,
-	0xeb, 0x84, 0x3a, 0xb7, 0xaf, 0xff, 0xd6, 0x1a, 0xcc, 0x72, 0x2c, 0xb8, 0x0c, 0xb3, 0x94, 0x19,
-	0xb3, 0x5c, 0x45, 0x3a, 0xc5, 0x12, 0x63, 0x1d, 0x9c, 0xc5, 0xf6, 0x80, 0xbe, 0x84, 0xe6, 0xe8,
-	0x09, 0x57, 0x91, 0xd8, 0x24, 0x3a, 0xb6, 0x2b, 0x76, 0xc4, 0xee, 0x5b, 0x68, 0x1d, 0x25, 0x28,
-	0x80, 0x39, 0x62, 0xe3, 0xe1, 0x7c, 0xdc, 0xbd, 0x50, 0xf5, 0xfd, 0x78, 0x3a, 0x9e, 0x8f, 0xbb,
-	0xc4, 0xfd, 0x4e, 0x00, 0xe6, 0xdc, 0x8f, 0xd1, 0x4b, 0x03, 0xdc, 0xd2, 0xf7, 0xd0, 0xc8, 0xd6,
-	0x6b, 0x81, 0xf2, 0xf0, 0xc8, 0xff, 0x94, 0xb1, 0xbb, 0x38, 0x5b, 0x45, 0x33, 0xcd, 0xb3, 0x43,
-	0x9f, 0x3a, 0xd0, 0xf6, 0xe3, 0x2c, 0x4b, 0x3e, 0x86, 0xb1, 0xc4, 0xa2, 0xda, 0xf4, 0x29, 0x45,
-	0x7b, 0x00, 0x09, 0xdf, 0x2e, 0xaa, 0xad, 0xd6, 0xf4, 0xc3, 0x4f, 0x18, 0x65, 0x3e, 0xc2, 0xe7,
-	0x51, 0xb6, 0x49, 0xa5, 0x36, 0x6f, 0xb1, 0x23, 0xa6, 0xef, 0xc0, 0x12, 0x92, 0xc7, 0x78, 0xcf,
-	0x25, 0x7f, 0x0c, 0x3f, 0xa3, 0xde, 0xbb, 0xc5, 0xce, 0x49, 0xd7, 0x83, 0xf6, 0x89, 0xb7, 0x7f,
-	0x7c, 0xc4, 0x6b, 0x30, 0xf7, 0x7e, 0xb5, 0x3f, 0x8b, 0x55, 0x48, 0x4d, 0xc6, 0x98, 0x56, 0x59,
-	0xaa, 0xf2, 0xae, 0xfb, 0x63, 0xd7, 0x23, 0x3f, 0x77, 0x3d, 0xf2, 0x6b, 0xd7, 0x23, 0x5f, 0x7e,
-	0xf7, 0x2e, 0x7c, 0x53, 0x7f, 0xf4, 0x0f, 0x7f, 0x02, 0x00, 0x00, 0xff, 0xff, 0x9e, 0xf4, 0xb3,
-	0x68, 0xf4, 0x02, 0x00, 0x00,
+	// 645 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x54, 0xcf, 0x6e, 0xda, 0x4c,
+	0x10, 0xff, 0x6c, 0x13, 0x03, 0x93, 0x40, 0x92, 0xd5, 0xa7, 0xc8, 0xfa, 0xbe, 0x14, 0x21, 0xb7,
+	0x07, 0x2a, 0x45, 0x1c, 0xd2, 0x6b, 0x2f, 0x84, 0x50, 0x09, 0x91, 0x08, 0x69, 0x83, 0x90, 0x7a,
+	0x8a, 0x16, 0x3c, 0x34, 0x96, 0xff, 0xac, 0xb5, 0xbb, 0x58, 0xa4, 0x6f, 0xd1, 0x67, 0xe9, 0xb1,
+	0x2f, 0xd0, 0x63, 0x1f, 0xa1, 0xca, 0x93, 0x54, 0xbb, 0x36, 0x04, 0x27, 0xbd, 0xcd, 0xef, 0x37,
+	0xb3, 0xe3, 0x99, 0xdf, 0xcc, 0x18, 0x1a, 0xd9, 0xa2, 0x9f, 0x09, 0xae, 0x38, 0xb1, 0xb3, 0x85,
+	0xff, 0xdd, 0x02, 0x7b, 0x32, 0x27, 0x27, 0xe0, 0x44, 0xf8, 0xe8, 0x59, 0x5d, 0xab, 0x77, 0x44,
+	0xb5, 0x49, 0xfe, 0x85, 0x83, 0x9c, 0xc5, 0x6b, 0xf4, 0x6c, 0xc3, 0x15, 0x80, 0xfc, 0x0f, 0xcd,
+	0xb5, 0x44, 0x71, 0x9f, 0xa0, 0x62, 0x9e, 0x63, 0x3c, 0x0d, 0x4d, 0xdc, 0xa2, 0x62, 0xc4, 0x83,
+	0x7a, 0x8e, 0x42, 0x86, 0x3c, 0xf5, 0x6a, 0x5d, 0xab, 0x57, 0xa3, 0x5b, 0x48, 0xde, 0x00, 0xe0,
+	0x26, 0x0b, 0x05, 0xca, 0x7b, 0xa6, 0xbc, 0x03, 0xe3, 0x6c, 0x96, 0xcc, 0x40, 0x11, 0x02, 0x35,
+	0x93, 0xd0, 0x35, 0x09, 0x8d, 0xad, 0xbf, 0x24, 0x95, 0x40, 0x96, 0xdc, 0x87, 0x81, 0x07, 0x5d,
+	0xab, 0xd7, 0xa2, 0x8d, 0x82, 0x18, 0x07, 0x7e, 0x17, 0xdc, 0xc9, 0xfc, 0x26, 0x94, 0x8a, 0x9c,
+	0x81, 0x1d, 0xe5, 0x9e, 0xd5, 0x75, 0x7a, 0x87, 0x97, 0x6e, 0x3f, 0x5b, 0xf4, 0x27, 0x73, 0x6a,
+	0x47, 0xb9, 0x3f, 0x80, 0xd3, 0x5b, 0x96, 0x86, 0x2b, 0x94, 0x6a, 0xf8, 0xc0, 0xd2, 0x2f, 0x78,
+	0x87, 0x8a, 0x5c, 0x40, 0x7d, 0x69, 0x80, 0x2c, 0x5f, 0x10, 0xfd, 0xa2, 0x1a, 0x47, 0xb7, 0x21,
+	0xfe, 0x0f, 0x0b, 0xda, 0x55, 0x1f, 0x69, 0x83, 0x3d, 0x0e, 0x8c, 0x4a, 0x35, 0x6a, 0x8f, 0x03,
+	0x72, 0x01, 0xf6, 0x34, 0x33, 0x0a, 0xb5, 0x2f, 0xcf, 0x5f, 0xe7, 0xea, 0x4f, 0x33, 0x14, 0x4c,
+	0x85, 0x3c, 0xa5, 0xf6, 0x34, 0xd3, 0x92, 0xde, 0x60, 0x8e, 0xb1, 0x11, 0xae, 0x45, 0x0b, 0x40,
+	0xfe, 0x83, 0xc6, 0xf0, 0x01, 0x97, 0x91, 0x5c, 0x27, 0x46, 0xb6, 0x23, 0xba, 0xc3, 0xfa, 0xc5,
+	0x04, 0x1f, 0xc7, 0x41, 0x29, 0x59, 0x01, 0xfc, 0xb7, 0xd0, 0xdc, 0x25, 0x26, 0x00, 0xee, 0x90,
+	0x8e, 0x06, 0xb3, 0xd1, 0xc9, 0x3f, 0xda, 0xbe, 0x1e, 0xdd, 0x8c, 0x66, 0xa3, 0x13, 0xcb, 0xff,
+	0xe6, 0x00, 0xcc, 0xd8, 0x22, 0xc6, 0x71, 0x1a, 0xe0, 0x86, 0xbc, 0x87, 0x3a, 0x5f, 0xad, 0x24,
+	0xaa, 0x6d, 0xeb, 0xc7, 0xba, 0xdc, 0xab, 0x98, 0x2f, 0xa3, 0xa9, 0xe1, 0xe9, 0xd6, 0x4f, 0xba,
+	0x70, 0xb8, 0x88, 0x39, 0x4f, 0x3e, 0x85, 0xb1, 0x42, 0x51, 0xce, 0x7f, 0x9f, 0x22, 0x1d, 0x80,
+	0x84, 0x6d, 0xe6, 0xe5, 0xac, 0x1d, 0x53, 0xdb, 0x1e, 0xa3, 0x5b, 0x8a, 0xf0, 0x71, 0xc8, 0xd7,
+	0xa9, 0x32, 0x2d, 0xb5, 0xe8, 0x0e, 0x93, 0x77, 0xd0, 0x92, 0x8a, 0xc5, 0x78, 0xcd, 0x14, 0xbb,
+	0x0b, 0xbf, 0xa2, 0x69, 0xad, 0x45, 0xab, 0xa4, 0xae, 0x61, 0xc9, 0x93, 0x4c, 0xa0, 0x34, 0x9f,
+	0x70, 0x4d, 0xcc, 0x3e, 0x45, 0x2e, 0xe0, 0x34, 0x13, 0xb8, 0x0a, 0x37, 0x57, 0x7b, 0xb5, 0xd6,
+	0x4d, 0xad, 0xaf, 0x1d, 0xa4, 0x07, 0xc7, 0x05, 0x39, 0xda, 0x28, 0xc1, 0x96, 0x8a, 0x0b, 0xaf,
+	0xd1, 0xb5, 0x7a, 0x4d, 0xfa, 0x92, 0x26, 0x1f, 0xe1, 0x58, 0xe8, 0xd9, 0xcd, 0x78, 0xb2, 0x90,
+	0x8a, 0xa7, 0x28, 0xbd, 0xe6, 0xf3, 0xae, 0xd0, 0x8a, 0x8b, 0xbe, 0x0c, 0x25, 0xe7, 0xd0, 0x5c,
+	0x0a, 0x64, 0x0a, 0x83, 0x81, 0x32, 0x5b, 0xeb, 0xd0, 0x67, 0xc2, 0xa7, 0xd0, 0xae, 0x26, 0xd0,
+	0x03, 0x96, 0x8a, 0x09, 0x55, 0x5e, 0x5e, 0x01, 0xf4, 0x35, 0x62, 0x1a, 0x94, 0xca, 0x6b, 0x73,
+	0xff, 0xb4, 0x9c, 0xca, 0x69, 0xf9, 0x9f, 0xe1, 0x70, 0x6f, 0x8a, 0x7f, 0x39, 0xe4, 0x33, 0x70,
+	0x8b, 0xc9, 0x9a, 0x7c, 0x2d, 0xea, 0xf2, 0x5d, 0x64, 0x8c, 0x69, 0xb9, 0x8b, 0xda, 0xd4, 0xdb,
+	0x1d, 0xe6, 0xe5, 0x0e, 0xda, 0x61, 0xee, 0x33, 0xa8, 0xeb, 0x81, 0x4c, 0x8a, 0xbf, 0x41, 0x64,
+	0x16, 0xb1, 0xd8, 0xfd, 0x02, 0xe8, 0xbb, 0x0d, 0x98, 0x62, 0x65, 0xa1, 0xc6, 0x2e, 0x93, 0x38,
+	0xdb, 0x24, 0x55, 0x45, 0x6a, 0x2f, 0x14, 0xb9, 0x3a, 0xfa, 0xf9, 0xd4, 0xb1, 0x7e, 0x3d, 0x75,
+	0xac, 0xdf, 0x4f, 0x1d, 0x6b, 0xe1, 0x9a, 0xff, 0xd2, 0x87, 0x3f, 0x03, 0x00, 0x72, 0x4b, 0x53,
+	0xd3, 0xa3, 0x04, 0x00, 0x00,
 }
 
 func (m *KV) Marshal() (dAtA []byte, err error) {
@@ -674,6 +877,11 @@ func (m *ManifestChange) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.KeyId != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.KeyId))
+		i--
+		dAtA[i] = 0x28
+	}
 	if len(m.Checksum) > 0 {
 		i -= len(m.Checksum)
 		copy(dAtA[i:], m.Checksum)
@@ -723,6 +931,44 @@ func (m *TableIndex) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.CreatedAt != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.CreatedAt))
+		i--
+		dAtA[i] = 0x50
+	}
+	if len(m.RangeTombstones) > 0 {
+		for iNdEx := len(m.RangeTombstones) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RangeTombstones[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintPb(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x4a
+		}
+	}
+	if len(m.PrefixExtractor) > 0 {
+		i -= len(m.PrefixExtractor)
+		copy(dAtA[i:], m.PrefixExtractor)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.PrefixExtractor)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if len(m.PrefixBloomFilter) > 0 {
+		i -= len(m.PrefixBloomFilter)
+		copy(dAtA[i:], m.PrefixBloomFilter)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.PrefixBloomFilter)))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if m.Compression != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.Compression))
+		i--
+		dAtA[i] = 0x30
+	}
 	if m.StaleDataSize != 0 {
 		i = encodeVarintPb(dAtA, i, uint64(m.StaleDataSize))
 		i--
@@ -762,6 +1008,52 @@ func (m *TableIndex) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *RangeTombstone) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *RangeTombstone) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *RangeTombstone) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.Version != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.Version))
+		i--
+		dAtA[i] = 0x18
+	}
+	if len(m.End) > 0 {
+		i -= len(m.End)
+		copy(dAtA[i:], m.End)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.End)))
+		i--
+		dAtA[i] = 0x12
+	}
+	if len(m.Start) > 0 {
+		i -= len(m.Start)
+		copy(dAtA[i:], m.Start)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.Start)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *BlockOffset) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -786,6 +1078,13 @@ func (m *BlockOffset) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.Iv) > 0 {
+		i -= len(m.Iv)
+		copy(dAtA[i:], m.Iv)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.Iv)))
+		i--
+		dAtA[i] = 0x22
+	}
 	if m.Len != 0 {
 		i = encodeVarintPb(dAtA, i, uint64(m.Len))
 		i--
@@ -806,6 +1105,57 @@ func (m *BlockOffset) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *DataKey) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *DataKey) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *DataKey) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.CreatedAt != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.CreatedAt))
+		i--
+		dAtA[i] = 0x20
+	}
+	if len(m.Iv) > 0 {
+		i -= len(m.Iv)
+		copy(dAtA[i:], m.Iv)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.Iv)))
+		i--
+		dAtA[i] = 0x1a
+	}
+	if len(m.Data) > 0 {
+		i -= len(m.Data)
+		copy(dAtA[i:], m.Data)
+		i = encodeVarintPb(dAtA, i, uint64(len(m.Data)))
+		i--
+		dAtA[i] = 0x12
+	}
+	if m.KeyId != 0 {
+		i = encodeVarintPb(dAtA, i, uint64(m.KeyId))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintPb(dAtA []byte, offset int, v uint64) int {
 	offset -= sovPb(v)
 	base := offset
@@ -909,6 +1259,9 @@ func (m *ManifestChange) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovPb(uint64(l))
 	}
+	if m.KeyId != 0 {
+		n += 1 + sovPb(uint64(m.KeyId))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -940,6 +1293,49 @@ func (m *TableIndex) Size() (n int) {
 	if m.StaleDataSize != 0 {
 		n += 1 + sovPb(uint64(m.StaleDataSize))
 	}
+	if m.Compression != 0 {
+		n += 1 + sovPb(uint64(m.Compression))
+	}
+	l = len(m.PrefixBloomFilter)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	l = len(m.PrefixExtractor)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	if len(m.RangeTombstones) > 0 {
+		for _, e := range m.RangeTombstones {
+			l = e.Size()
+			n += 1 + l + sovPb(uint64(l))
+		}
+	}
+	if m.CreatedAt != 0 {
+		n += 1 + sovPb(uint64(m.CreatedAt))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *RangeTombstone) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Start)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	l = len(m.End)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	if m.Version != 0 {
+		n += 1 + sovPb(uint64(m.Version))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -962,13 +1358,43 @@ func (m *BlockOffset) Size() (n int) {
 	if m.Len != 0 {
 		n += 1 + sovPb(uint64(m.Len))
 	}
+	l = len(m.Iv)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
 	return n
 }
 
-func sovPb(x uint64) (n int) {
+func (m *DataKey) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.KeyId != 0 {
+		n += 1 + sovPb(uint64(m.KeyId))
+	}
+	l = len(m.Data)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	l = len(m.Iv)
+	if l > 0 {
+		n += 1 + l + sovPb(uint64(l))
+	}
+	if m.CreatedAt != 0 {
+		n += 1 + sovPb(uint64(m.CreatedAt))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func sovPb(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
 func sozPb(x uint64) (n int) {
@@ -1508,6 +1934,25 @@ func (m *ManifestChange) Unmarshal(dAtA []byte) error {
 				m.Checksum = []byte{}
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KeyId", wireType)
+			}
+			m.KeyId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.KeyId |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
@@ -1684,6 +2129,282 @@ func (m *TableIndex) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Compression", wireType)
+			}
+			m.Compression = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Compression |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PrefixBloomFilter", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PrefixBloomFilter = append(m.PrefixBloomFilter[:0], dAtA[iNdEx:postIndex]...)
+			if m.PrefixBloomFilter == nil {
+				m.PrefixBloomFilter = []byte{}
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PrefixExtractor", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PrefixExtractor = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RangeTombstones", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RangeTombstones = append(m.RangeTombstones, &RangeTombstone{})
+			if err := m.RangeTombstones[len(m.RangeTombstones)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CreatedAt", wireType)
+			}
+			m.CreatedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.CreatedAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPb(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthPb
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *RangeTombstone) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPb
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: RangeTombstone: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: RangeTombstone: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Start", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Start = append(m.Start[:0], dAtA[iNdEx:postIndex]...)
+			if m.Start == nil {
+				m.Start = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field End", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.End = append(m.End[:0], dAtA[iNdEx:postIndex]...)
+			if m.End == nil {
+				m.End = []byte{}
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			m.Version = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Version |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
@@ -1807,6 +2528,197 @@ func (m *BlockOffset) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Iv", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Iv = append(m.Iv[:0], dAtA[iNdEx:postIndex]...)
+			if m.Iv == nil {
+				m.Iv = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPb(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthPb
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *DataKey) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPb
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: DataKey: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: DataKey: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field KeyId", wireType)
+			}
+			m.KeyId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.KeyId |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Data", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Data = append(m.Data[:0], dAtA[iNdEx:postIndex]...)
+			if m.Data == nil {
+				m.Data = []byte{}
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Iv", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthPb
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPb
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Iv = append(m.Iv[:0], dAtA[iNdEx:postIndex]...)
+			if m.Iv == nil {
+				m.Iv = []byte{}
+			}
+			iNdEx = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CreatedAt", wireType)
+			}
+			m.CreatedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPb
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.CreatedAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPb(dAtA[iNdEx:])
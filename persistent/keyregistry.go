@@ -0,0 +1,305 @@
+package persistent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/Kirov7/FayKV/pb"
+	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sanityText is encrypted by the master key at the head of the registry, it tells a wrong key
+var sanityText = []byte("Hello FayKV")
+
+// KeyRegistry keeps the data keys which encrypt the files, the data keys are stored encrypted
+// by the master key. A new data key is generated once the latest one is older than the rotation
+// duration, the old ones are kept to read the files they encrypted.
+// | iv | sanity text | len | crc32 | DataKey | len | crc32 | DataKey | ...
+type KeyRegistry struct {
+	sync.RWMutex
+	dataKeys    map[uint64]*pb.DataKey // The decrypted data keys by their id
+	lastCreated int64                  // The creation time of the latest data key, unix seconds
+	nextKeyID   uint64
+	plain       bool // The registry was created without a master key
+	fp          *os.File
+	opt         *Options
+}
+
+// OpenKeyRegistry opens the registry of opt.Dir or creates it, the master key must be the one
+// the registry was created with
+func OpenKeyRegistry(opt *Options) (*KeyRegistry, error) {
+	if !utils.ValidEncryptionKey(opt.EncryptionKey) {
+		return nil, utils.ErrInvalidEncryptionKey
+	}
+	if opt.KeyRotationDuration == 0 {
+		opt.KeyRotationDuration = utils.DefaultKeyRotationDuration
+	}
+	kr := &KeyRegistry{dataKeys: make(map[uint64]*pb.DataKey), nextKeyID: 1, opt: opt}
+	path := filepath.Join(opt.Dir, utils.KeyRegistryFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeKeyRegistry(opt.Dir, kr.dataKeys, opt.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	fp, err := os.OpenFile(path, os.O_RDWR, utils.DefaultFileMode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while opening key registry: %s", path)
+	}
+	truncOffset, err := kr.replay(fp)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if kr.plain && len(opt.EncryptionKey) > 0 {
+		// The encryption is enabled on an existing db, the files written so far stay plain
+		// until they are rewritten
+		fp.Close()
+		if err := writeKeyRegistry(opt.Dir, kr.dataKeys, opt.EncryptionKey); err != nil {
+			return nil, err
+		}
+		kr.plain = false
+		return kr, kr.openForAppend(path)
+	}
+	// Truncate the half written data key at the end
+	if err := fp.Truncate(truncOffset); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if _, err := fp.Seek(0, io.SeekEnd); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	kr.fp = fp
+	return kr, nil
+}
+
+// openForAppend opens the registry which was just written
+func (kr *KeyRegistry) openForAppend(path string) error {
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, utils.DefaultFileMode)
+	if err != nil {
+		return errors.Wrapf(err, "while opening key registry: %s", path)
+	}
+	kr.fp = fp
+	return nil
+}
+
+// replay reads the data keys of the registry and returns the end of the last valid one
+func (kr *KeyRegistry) replay(fp *os.File) (int64, error) {
+	r := &bufReader{reader: bufio.NewReader(fp)}
+	iv := make([]byte, len(sanityText)+16)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return 0, errors.Wrap(utils.ErrBadMagic, "while reading key registry")
+	}
+	iv, sanity := iv[:16], iv[16:]
+	// A registry created without the master key holds the text as it is
+	if bytes.Equal(sanity, sanityText) {
+		kr.plain = true
+	} else if len(kr.opt.EncryptionKey) > 0 {
+		if err := utils.XORBlock(sanity, sanity, kr.opt.EncryptionKey, iv); err != nil {
+			return 0, err
+		}
+	}
+	if !bytes.Equal(sanity, sanityText) {
+		return 0, utils.ErrEncryptionKeyMismatch
+	}
+	var offset int64
+	for {
+		offset = r.count
+		var lenCrcBuf [8]byte
+		if _, err := io.ReadFull(r, lenCrcBuf[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return 0, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(lenCrcBuf[0:4]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return 0, err
+		}
+		if crc32.Checksum(buf, utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenCrcBuf[4:8]) {
+			return 0, utils.ErrBadChecksum
+		}
+		dk := &pb.DataKey{}
+		if err := dk.Unmarshal(buf); err != nil {
+			return 0, err
+		}
+		var err error
+		if dk.Data, err = utils.XORBlockAllocate(dk.Data, kr.opt.EncryptionKey, dk.Iv); err != nil {
+			return 0, err
+		}
+		kr.add(dk)
+	}
+	return offset, nil
+}
+
+// add must be called with kr.Lock held or before the registry is shared
+func (kr *KeyRegistry) add(dk *pb.DataKey) {
+	kr.dataKeys[dk.KeyId] = dk
+	if dk.KeyId >= kr.nextKeyID {
+		kr.nextKeyID = dk.KeyId + 1
+	}
+	if dk.CreatedAt > kr.lastCreated {
+		kr.lastCreated = dk.CreatedAt
+	}
+}
+
+// LatestDataKey returns the data key the new files are encrypted by, nil if the encryption is disabled
+func (kr *KeyRegistry) LatestDataKey() (*pb.DataKey, error) {
+	if kr == nil || len(kr.opt.EncryptionKey) == 0 {
+		return nil, nil
+	}
+	valid := func() bool {
+		return time.Since(time.Unix(kr.lastCreated, 0)) < kr.opt.KeyRotationDuration
+	}
+	kr.RLock()
+	if valid() {
+		defer kr.RUnlock()
+		return kr.dataKeys[kr.nextKeyID-1], nil
+	}
+	kr.RUnlock()
+
+	kr.Lock()
+	defer kr.Unlock()
+	// Another writer may have rotated it meanwhile
+	if valid() {
+		return kr.dataKeys[kr.nextKeyID-1], nil
+	}
+	key := make([]byte, len(kr.opt.EncryptionKey))
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	iv, err := utils.GenerateIV()
+	if err != nil {
+		return nil, err
+	}
+	dk := &pb.DataKey{KeyId: kr.nextKeyID, Data: key, Iv: iv, CreatedAt: time.Now().Unix()}
+	buf, err := encodeDataKey(dk, kr.opt.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := kr.fp.Write(buf); err != nil {
+		return nil, errors.Wrap(err, "while writing key registry")
+	}
+	// The data key must be on disk before any file is encrypted by it
+	if err := kr.fp.Sync(); err != nil {
+		return nil, errors.Wrap(err, "while syncing key registry")
+	}
+	kr.add(dk)
+	return dk, nil
+}
+
+// DataKey returns the data key of the id, nil for 0 which marks the files which are not encrypted
+func (kr *KeyRegistry) DataKey(id uint64) (*pb.DataKey, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	if kr == nil {
+		return nil, errors.Wrapf(utils.ErrInvalidDataKeyID, "key id: %d", id)
+	}
+	kr.RLock()
+	defer kr.RUnlock()
+	dk, ok := kr.dataKeys[id]
+	if !ok {
+		return nil, errors.Wrapf(utils.ErrInvalidDataKeyID, "key id: %d", id)
+	}
+	return dk, nil
+}
+
+// Close _
+func (kr *KeyRegistry) Close() error {
+	if kr == nil || kr.fp == nil {
+		return nil
+	}
+	return kr.fp.Close()
+}
+
+// RotateMasterKey encrypts the data keys of the registry in opt.Dir by newKey instead of
+// opt.EncryptionKey. The db must be closed, the files keep their data keys
+func RotateMasterKey(opt *Options, newKey []byte) error {
+	if !utils.ValidEncryptionKey(newKey) {
+		return utils.ErrInvalidEncryptionKey
+	}
+	kr, err := OpenKeyRegistry(opt)
+	if err != nil {
+		return err
+	}
+	defer kr.Close()
+	if len(kr.dataKeys) > 0 && len(newKey) == 0 {
+		return errors.Wrap(utils.ErrInvalidEncryptionKey, "the data keys can't be stored without a master key")
+	}
+	return writeKeyRegistry(opt.Dir, kr.dataKeys, newKey)
+}
+
+// writeKeyRegistry writes the data keys to a new registry which replaces the old one atomically
+func writeKeyRegistry(dir string, dataKeys map[uint64]*pb.DataKey, masterKey []byte) error {
+	iv, err := utils.GenerateIV()
+	if err != nil {
+		return err
+	}
+	sanity := append([]byte{}, sanityText...)
+	if len(masterKey) > 0 {
+		if err := utils.XORBlock(sanity, sanity, masterKey, iv); err != nil {
+			return err
+		}
+	}
+	buf := append(iv, sanity...)
+	for _, dk := range dataKeys {
+		// The iv is renewed, it belongs to the master key which encrypts the data key
+		if dk.Iv, err = utils.GenerateIV(); err != nil {
+			return err
+		}
+		rec, err := encodeDataKey(dk, masterKey)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, rec...)
+	}
+	rewritePath := filepath.Join(dir, utils.KeyRegistryRewriteFileName)
+	fp, err := os.OpenFile(rewritePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, utils.DefaultFileMode)
+	if err != nil {
+		return errors.Wrapf(err, "while creating key registry: %s", rewritePath)
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(rewritePath, filepath.Join(dir, utils.KeyRegistryFileName)); err != nil {
+		return err
+	}
+	return SyncDir(dir)
+}
+
+// encodeDataKey returns the record of the data key, its data is encrypted by the master key
+func encodeDataKey(dk *pb.DataKey, masterKey []byte) ([]byte, error) {
+	data, err := utils.XORBlockAllocate(dk.Data, masterKey, dk.Iv)
+	if err != nil {
+		return nil, err
+	}
+	enc := &pb.DataKey{KeyId: dk.KeyId, Data: data, Iv: dk.Iv, CreatedAt: dk.CreatedAt}
+	buf, err := enc.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	var lenCrcBuf [8]byte
+	binary.BigEndian.PutUint32(lenCrcBuf[0:4], uint32(len(buf)))
+	binary.BigEndian.PutUint32(lenCrcBuf[4:8], crc32.Checksum(buf, utils.CastagnoliCrcTable))
+	return append(lenCrcBuf[:], buf...), nil
+}
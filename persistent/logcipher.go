@@ -0,0 +1,140 @@
+package persistent
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"github.com/Kirov7/FayKV/pb"
+	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"os"
+)
+
+// LogHeaderSize the wal and the vlog files start with the data key their records are encrypted by,
+// the first record is written after it
+// | key id uint64 | base iv [12]byte |
+const LogHeaderSize = 8 + 12
+
+// logCipher encrypts the key and the value of the records of a log file. The iv of a record is
+// the base iv of the file followed by the offset of the record, so no two records share it
+type logCipher struct {
+	dataKey *pb.DataKey // nil if the file is not encrypted
+	block   cipher.Block
+	baseIV  []byte
+}
+
+// newLogCipher returns the cipher of a new file, it's encrypted by the latest data key
+func newLogCipher(kr *KeyRegistry) (*logCipher, error) {
+	dk, err := kr.LatestDataKey()
+	if err != nil {
+		return nil, err
+	}
+	lc := &logCipher{dataKey: dk, baseIV: make([]byte, 12)}
+	if dk == nil {
+		return lc, nil
+	}
+	iv, err := utils.GenerateIV()
+	if err != nil {
+		return nil, err
+	}
+	copy(lc.baseIV, iv)
+	return lc, lc.init()
+}
+
+// decodeLogCipher returns the cipher which the header of the file records
+func decodeLogCipher(kr *KeyRegistry, header []byte) (*logCipher, error) {
+	if len(header) < LogHeaderSize {
+		return nil, utils.ErrTruncate
+	}
+	dk, err := kr.DataKey(binary.BigEndian.Uint64(header[:8]))
+	if err != nil {
+		return nil, err
+	}
+	lc := &logCipher{dataKey: dk, baseIV: append([]byte{}, header[8:LogHeaderSize]...)}
+	if dk == nil {
+		return lc, nil
+	}
+	return lc, lc.init()
+}
+
+// openLogCipher writes the header of a new file, the header of an existing one is read
+func openLogCipher(kr *KeyRegistry, mf *MmapFile, isNew bool) (*logCipher, error) {
+	if !isNew {
+		lc, err := decodeLogCipher(kr, mf.Data)
+		return lc, errors.WithMessagef(err, "while reading the header of %s", mf.Fd.Name())
+	}
+	lc, err := newLogCipher(kr)
+	if err != nil {
+		return nil, err
+	}
+	return lc, mf.AppendBuffer(0, lc.encodeHeader())
+}
+
+func (lc *logCipher) init() error {
+	var err error
+	lc.block, err = aes.NewCipher(lc.dataKey.Data)
+	return err
+}
+
+func (lc *logCipher) encodeHeader() []byte {
+	buf := make([]byte, LogHeaderSize)
+	if lc.dataKey != nil {
+		binary.BigEndian.PutUint64(buf[:8], lc.dataKey.KeyId)
+	}
+	copy(buf[8:], lc.baseIV)
+	return buf
+}
+
+func (lc *logCipher) encrypted() bool {
+	return lc.dataKey != nil
+}
+
+// stream the key stream of the record at offset
+func (lc *logCipher) stream(offset uint32) cipher.Stream {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, lc.baseIV)
+	binary.BigEndian.PutUint32(iv[12:], offset)
+	return cipher.NewCTR(lc.block, iv)
+}
+
+// encryptEntry returns a copy of the entry whose key and value are encrypted for the record at
+// offset, the entry itself is returned if the file is not encrypted
+func (lc *logCipher) encryptEntry(e *utils.Entry, offset uint32) *utils.Entry {
+	if !lc.encrypted() {
+		return e
+	}
+	enc := *e
+	enc.Key = make([]byte, len(e.Key))
+	enc.Value = make([]byte, len(e.Value))
+	stream := lc.stream(offset)
+	stream.XORKeyStream(enc.Key, e.Key)
+	stream.XORKeyStream(enc.Value, e.Value)
+	return &enc
+}
+
+// decryptEntry decrypts the key and the value of the record at offset in place
+func (lc *logCipher) decryptEntry(e *utils.Entry, offset uint32) {
+	if !lc.encrypted() {
+		return
+	}
+	stream := lc.stream(offset)
+	stream.XORKeyStream(e.Key, e.Key)
+	stream.XORKeyStream(e.Value, e.Value)
+}
+
+// decrypt returns the decrypted copy of the key and the value of the record at offset,
+// they are contiguous in the record
+func (lc *logCipher) decrypt(kv []byte, offset uint32) []byte {
+	if !lc.encrypted() {
+		return kv
+	}
+	dst := make([]byte, len(kv))
+	lc.stream(offset).XORKeyStream(dst, kv)
+	return dst
+}
+
+// isNewFile returns true if the file doesn't exist yet or is empty
+func isNewFile(filename string) bool {
+	fi, err := os.Stat(filename)
+	return err != nil || fi.Size() == 0
+}
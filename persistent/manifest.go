@@ -3,6 +3,7 @@ package persistent
 import (
 	"bufio"
 	"bytes"
+	"crypto/aes"
 	"encoding/binary"
 	"fmt"
 	"github.com/Kirov7/FayKV/pb"
@@ -15,6 +16,9 @@ import (
 	"sync"
 )
 
+// plainManifestVersion the records of the first format hold the change sets as they are
+const plainManifestVersion = 1
+
 // ManifestFile The sst file is used to maintain the SST file meta information
 type ManifestFile struct {
 	opt                       *Options
@@ -29,11 +33,13 @@ type Manifest struct {
 	Tables    map[uint64]TableManifest // Quickly query a table which layer
 	Creations int                      // Count the number of sst creation times
 	Deletions int                      // Count the number of sst deletion times
+	version   uint32                   // The format of the file it was replayed from
 }
 
 type TableManifest struct {
 	Level    uint8
 	Checksum []byte
+	KeyID    uint64 // The data key of the table, 0 if it's not encrypted
 }
 
 type levelManifest struct {
@@ -43,6 +49,7 @@ type levelManifest struct {
 type TableMeta struct {
 	ID       uint64
 	Checksum []byte
+	KeyID    uint64
 }
 
 func OpenManifestFile(opt *Options) (*ManifestFile, error) {
@@ -56,7 +63,7 @@ func OpenManifestFile(opt *Options) (*ManifestFile, error) {
 		}
 		m := createManifest()
 		// Create a new ManifestFile
-		fp, netCreations, err := helpRewrite(opt.Dir, m)
+		fp, netCreations, err := helpRewrite(opt.Dir, m, opt.KeyRegistry)
 		utils.CondPanic(netCreations == 0, errors.Wrap(err, utils.ErrReWriteFailure.Error()))
 		if err != nil {
 			return mf, err
@@ -67,7 +74,7 @@ func OpenManifestFile(opt *Options) (*ManifestFile, error) {
 		return mf, nil
 	}
 	// if opened then replay manifest file
-	manifest, truncOffset, err := ReplayManifestFile(f)
+	manifest, truncOffset, err := ReplayManifestFile(f, opt.KeyRegistry)
 	if err != nil {
 		f.Close()
 		return mf, err
@@ -83,6 +90,12 @@ func OpenManifestFile(opt *Options) (*ManifestFile, error) {
 	}
 	mf.f = f
 	mf.manifest = manifest
+	if manifest.version != utils.MagicVersion {
+		// The records of the older format can't be encrypted, the file is moved to the current one
+		if err := mf.rewrite(); err != nil {
+			return mf, err
+		}
+	}
 	return mf, nil
 }
 
@@ -94,15 +107,20 @@ func (mf *ManifestFile) Close() error {
 }
 
 func (mf *ManifestFile) AddTableMeta(levelNum int, t *TableMeta) (err error) {
-	mf.addChanges([]*pb.ManifestChange{
-		newCreateChange(t.ID, levelNum, t.Checksum),
+	err = mf.addChanges([]*pb.ManifestChange{
+		newCreateChange(t.ID, levelNum, t.Checksum, t.KeyID),
 	})
 	return err
 }
 
+// AddChanges applies a set of changes to the manifest atomically
+func (mf *ManifestFile) AddChanges(changesParam []*pb.ManifestChange) error {
+	return mf.addChanges(changesParam)
+}
+
 func (mf *ManifestFile) addChanges(changesParam []*pb.ManifestChange) error {
 	changes := pb.ManifestChangeSet{Changes: changesParam}
-	buf, err := changes.Marshal()
+	buf, err := encodeChangeSet(&changes, mf.opt.KeyRegistry)
 	if err != nil {
 		return err
 	}
@@ -129,8 +147,30 @@ func (mf *ManifestFile) addChanges(changesParam []*pb.ManifestChange) error {
 			return err
 		}
 	}
-	err = mf.f.Sync()
-	return err
+	// The changes are rare, they are synced at once unless the syncs are disabled. The tables
+	// a change set deletes are gone right after it, so it's synced even then: a manifest which
+	// still holds them after a crash could not be opened
+	if mf.opt.SyncMode == utils.SyncNever && !deletesTables(changesParam) {
+		return nil
+	}
+	return mf.f.Sync()
+}
+
+// deletesTables returns true if one of the changes deletes a table
+func deletesTables(changes []*pb.ManifestChange) bool {
+	for _, change := range changes {
+		if change.Op == pb.ManifestChange_DELETE {
+			return true
+		}
+	}
+	return false
+}
+
+// Sync _
+func (mf *ManifestFile) Sync() error {
+	mf.lock.Lock()
+	defer mf.lock.Unlock()
+	return mf.f.Sync()
 }
 
 // Must be called while appendLock is held.
@@ -139,7 +179,7 @@ func (mf *ManifestFile) rewrite() error {
 	if err := mf.f.Close(); err != nil {
 		return err
 	}
-	fp, nextCreations, err := helpRewrite(mf.opt.Dir, mf.manifest)
+	fp, nextCreations, err := helpRewrite(mf.opt.Dir, mf.manifest, mf.opt.KeyRegistry)
 	if err != nil {
 		return err
 	}
@@ -191,8 +231,9 @@ func (r *bufReader) Read(p []byte) (n int, err error) {
 	return
 }
 
-// ReplayManifestFile Reapply all state changes to the existing manifest file
-func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err error) {
+// ReplayManifestFile Reapply all state changes to the existing manifest file, the data keys of
+// the encrypted records are looked up in kr
+func ReplayManifestFile(fp *os.File, kr *KeyRegistry) (ret *Manifest, truncOffset int64, err error) {
 	r := &bufReader{reader: bufio.NewReader(fp)}
 	var magicBuf [8]byte
 	if _, err := io.ReadFull(r, magicBuf[:]); err != nil {
@@ -204,12 +245,13 @@ func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err erro
 	}
 	version := binary.BigEndian.Uint32(magicBuf[4:8])
 	// Verification version number
-	if version != uint32(utils.MagicVersion) {
+	if version != utils.MagicVersion && version != plainManifestVersion {
 		return &Manifest{}, 0,
 			fmt.Errorf("manifest has unsupported version: %d (we support %d)", version, utils.MagicVersion)
 	}
 
 	build := createManifest()
+	build.version = version
 	var offset int64
 	// Loop through the resolution of the change object
 	for {
@@ -237,7 +279,12 @@ func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err erro
 		}
 
 		var changeSet pb.ManifestChangeSet
-		if err := changeSet.Unmarshal(buf); err != nil {
+		if version == plainManifestVersion {
+			err = changeSet.Unmarshal(buf)
+		} else {
+			err = decodeChangeSet(buf, kr, &changeSet)
+		}
+		if err != nil {
 			return &Manifest{}, 0, err
 		}
 
@@ -270,6 +317,7 @@ func applyManifestChange(build *Manifest, tc *pb.ManifestChange) error {
 		build.Tables[tc.Id] = TableManifest{
 			Level:    uint8(tc.Level),
 			Checksum: append([]byte{}, tc.Checksum...),
+			KeyID:    tc.KeyId,
 		}
 		for len(build.Levels) <= int(tc.Level) {
 			build.Levels = append(build.Levels, levelManifest{make(map[uint64]struct{})})
@@ -290,7 +338,7 @@ func applyManifestChange(build *Manifest, tc *pb.ManifestChange) error {
 	return nil
 }
 
-func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
+func helpRewrite(dir string, m *Manifest, kr *KeyRegistry) (*os.File, int, error) {
 	rewritePath := filepath.Join(dir, utils.ManifestRewriteFilename)
 	// We explicitly sync.
 	fp, err := os.OpenFile(rewritePath, utils.DefaultFileFlag, utils.DefaultFileMode)
@@ -306,7 +354,7 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 	changes := m.asChanges()
 	set := pb.ManifestChangeSet{Changes: changes}
 
-	changeBuf, err := set.Marshal()
+	changeBuf, err := encodeChangeSet(&set, kr)
 	if err != nil {
 		fp.Close()
 		return nil, 0, err
@@ -354,17 +402,78 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 func (m *Manifest) asChanges() []*pb.ManifestChange {
 	changes := make([]*pb.ManifestChange, 0, len(m.Tables))
 	for id, tm := range m.Tables {
-		changes = append(changes, newCreateChange(id, int(tm.Level), tm.Checksum))
+		changes = append(changes, newCreateChange(id, int(tm.Level), tm.Checksum, tm.KeyID))
 	}
 	return changes
 }
 
-func newCreateChange(id uint64, level int, checksum []byte) *pb.ManifestChange {
+func newCreateChange(id uint64, level int, checksum []byte, keyID uint64) *pb.ManifestChange {
 	return &pb.ManifestChange{
 		Id:       id,
 		Op:       pb.ManifestChange_CREATE,
 		Level:    uint32(level),
 		Checksum: checksum,
+		KeyId:    keyID,
+	}
+}
+
+// NewCreateChange returns a change which adds the table to the level
+func NewCreateChange(id uint64, level int, checksum []byte, keyID uint64) *pb.ManifestChange {
+	return newCreateChange(id, level, checksum, keyID)
+}
+
+// encodeChangeSet returns the payload of a record, the change set is encrypted by the latest
+// data key of kr. The iv is only there if the key id isn't 0
+// | key id uint64 | iv | change set |
+func encodeChangeSet(set *pb.ManifestChangeSet, kr *KeyRegistry) ([]byte, error) {
+	data, err := set.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	dk, err := kr.LatestDataKey()
+	if err != nil {
+		return nil, err
+	}
+	if dk == nil {
+		return append(make([]byte, 8), data...), nil
+	}
+	iv, err := utils.GenerateIV()
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.XORBlock(data, data, dk.Data, iv); err != nil {
+		return nil, err
+	}
+	buf := append(utils.U64ToBytes(dk.KeyId), iv...)
+	return append(buf, data...), nil
+}
+
+// decodeChangeSet decodes the payload written by encodeChangeSet
+func decodeChangeSet(buf []byte, kr *KeyRegistry, set *pb.ManifestChangeSet) error {
+	if len(buf) < 8 {
+		return utils.ErrTruncate
+	}
+	dk, err := kr.DataKey(utils.BytesToU64(buf[:8]))
+	if err != nil {
+		return err
+	}
+	buf = buf[8:]
+	if dk != nil {
+		if len(buf) < aes.BlockSize {
+			return utils.ErrTruncate
+		}
+		if buf, err = utils.XORBlockAllocate(buf[aes.BlockSize:], dk.Data, buf[:aes.BlockSize]); err != nil {
+			return err
+		}
+	}
+	return set.Unmarshal(buf)
+}
+
+// NewDeleteChange returns a change which removes the table
+func NewDeleteChange(id uint64) *pb.ManifestChange {
+	return &pb.ManifestChange{
+		Id: id,
+		Op: pb.ManifestChange_DELETE,
 	}
 }
 
@@ -72,7 +72,8 @@ func (m *MmapFile) AppendBuffer(offset uint32, buf []byte) error {
 		if growBy < needSize {
 			growBy = needSize
 		}
-		if err := m.Truncature(int64(end)); err != nil {
+		// Grow by the size of the file at least, the appends don't remap every time
+		if err := m.Truncature(int64(size + growBy)); err != nil {
 			return err
 		}
 	}
@@ -1,5 +1,11 @@
 package persistent
 
+import (
+	"github.com/Kirov7/FayKV/pb"
+	"github.com/Kirov7/FayKV/utils"
+	"time"
+)
+
 type Options struct {
 	FID      uint64
 	FileName string
@@ -7,4 +13,10 @@ type Options struct {
 	Path     string
 	Flag     int
 	MaxSize  int
+	SyncMode utils.SyncMode
+
+	EncryptionKey       []byte        // The master key of the key registry
+	KeyRotationDuration time.Duration // The age of the latest data key before a new one is generated
+	KeyRegistry         *KeyRegistry  // The data keys of the wal, the vlog and the manifest
+	DataKey             *pb.DataKey   // The data key of the sstable, nil if it's not encrypted
 }
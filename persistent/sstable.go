@@ -1,6 +1,7 @@
 package persistent
 
 import (
+	"crypto/aes"
 	"fmt"
 	"github.com/Kirov7/FayKV/pb"
 	"github.com/Kirov7/FayKV/utils"
@@ -25,6 +26,7 @@ type SSTable struct {
 	idxStart       int
 	fid            uint64
 	createdAt      time.Time
+	dataKey        *pb.DataKey // nil if the table is not encrypted
 }
 
 func OpenSSTable(opt *Options) *SSTable {
@@ -32,9 +34,10 @@ func OpenSSTable(opt *Options) *SSTable {
 	utils.Panic(err)
 
 	return &SSTable{
-		f:   f,
-		fid: opt.FID,
-		m:   &sync.RWMutex{},
+		f:       f,
+		fid:     opt.FID,
+		m:       &sync.RWMutex{},
+		dataKey: opt.DataKey,
 	}
 }
 
@@ -43,9 +46,14 @@ func (ss *SSTable) Init() error {
 	if err != nil {
 		return err
 	}
-	stat, _ := ss.f.Fd.Stat()
-	statType := stat.Sys().(*syscall.Stat_t)
-	ss.createdAt = time.Unix(statType.Ctim.Sec, statType.Ctim.Nsec)
+	if createdAt := ss.idxTables.CreatedAt; createdAt != 0 {
+		ss.createdAt = time.Unix(0, createdAt)
+	} else {
+		// The tables written before the index held the time, the file may have been copied since
+		stat, _ := ss.f.Fd.Stat()
+		statType := stat.Sys().(*syscall.Stat_t)
+		ss.createdAt = time.Unix(statType.Ctim.Sec, statType.Ctim.Nsec)
+	}
 	keyBytes := blockOffset.GetKey()
 	// init min key
 	minKey := make([]byte, len(keyBytes))
@@ -84,6 +92,17 @@ func (ss *SSTable) initTable() (blockOffset *pb.BlockOffset, err error) {
 	if err := utils.VerifyChecksum(data, expectedCks); err != nil {
 		return nil, errors.Wrapf(err, "failed to verify checksum for table: %s", ss.f.Fd.Name())
 	}
+	if ss.dataKey != nil {
+		// | encrypted index | iv |
+		if len(data) < aes.BlockSize {
+			return nil, errors.Errorf("encrypted index of table: %s is too short", ss.f.Fd.Name())
+		}
+		iv := data[len(data)-aes.BlockSize:]
+		var err error
+		if data, err = utils.XORBlockAllocate(data[:len(data)-aes.BlockSize], ss.dataKey.Data, iv); err != nil {
+			return nil, err
+		}
+	}
 	indexTable := &pb.TableIndex{}
 	if err := proto.Unmarshal(data, indexTable); err != nil {
 		return nil, err
@@ -115,6 +134,29 @@ func (ss *SSTable) read(off, sz int) ([]byte, error) {
 	return res, err
 }
 
+// Sync flushes the table to the disk
+func (ss *SSTable) Sync() error {
+	return ss.f.Sync()
+}
+
+// Checksum returns the crc32 of the whole table, the manifest records it with the table
+func (ss *SSTable) Checksum() []byte {
+	return utils.U64ToBytes(utils.CalculateChecksum(ss.f.Data))
+}
+
+// VerifyTableChecksum checks the table file against the checksum recorded in the manifest,
+// a table which was not fully written before a crash doesn't match it
+func VerifyTableChecksum(filename string, expected []byte) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "while reading table: %s", filename)
+	}
+	if err := utils.VerifyChecksum(data, expected); err != nil {
+		return errors.Wrapf(err, "table: %s", filename)
+	}
+	return nil
+}
+
 // Detele _
 func (ss *SSTable) Detele() error {
 	return ss.f.Delete()
@@ -149,6 +191,25 @@ func (ss *SSTable) MinKey() []byte {
 	return ss.minKey
 }
 
+// CreatedAt the time the data of the table was written, a compaction keeps the time of the
+// newest table it merged
+func (ss *SSTable) CreatedAt() time.Time {
+	return ss.createdAt
+}
+
+// KeyID the id of the data key which encrypts the table, 0 if it's not encrypted
+func (ss *SSTable) KeyID() uint64 {
+	if ss.dataKey == nil {
+		return 0
+	}
+	return ss.dataKey.KeyId
+}
+
+// DataKey _
+func (ss *SSTable) DataKey() *pb.DataKey {
+	return ss.dataKey
+}
+
 // HasBloomFilter _
 func (ss *SSTable) HasBloomFilter() bool {
 	return ss.hasBloomFilter
@@ -0,0 +1,198 @@
+package persistent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// LogFile a value log file, the records have the same layout as the wal
+// | log header | header | key | value | crc32 | header | key | value | crc32 | ...
+type LogFile struct {
+	sync.RWMutex // Guards f, the mmap is remapped when the file grows
+	FID          uint32
+	size         uint32 // the end of the written records
+	f            *MmapFile
+	buf          *bytes.Buffer
+	lc           *logCipher
+}
+
+// FileNameVlog vlog file name
+func FileNameVlog(dir string, fid uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%05d%s", fid, utils.VlogFileExt))
+}
+
+// OpenLogFile opens the vlog file of opt.FID, a new file is preallocated to opt.MaxSize
+func OpenLogFile(opt *Options) (*LogFile, error) {
+	isNew := isNewFile(opt.FileName)
+	mf, err := OpenMmapFile(opt.FileName, opt.Flag, opt.MaxSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while opening vlog: %s", opt.FileName)
+	}
+	lf := &LogFile{FID: uint32(opt.FID), size: LogHeaderSize, f: mf, buf: &bytes.Buffer{}}
+	if lf.lc, err = openLogCipher(opt.KeyRegistry, mf, isNew); err != nil {
+		mf.Close()
+		return nil, err
+	}
+	return lf, nil
+}
+
+// Name _
+func (lf *LogFile) Name() string {
+	return lf.f.Fd.Name()
+}
+
+// Size the end of the written records
+func (lf *LogFile) Size() uint32 {
+	return atomic.LoadUint32(&lf.size)
+}
+
+// Empty returns true if no record has been written
+func (lf *LogFile) Empty() bool {
+	return lf.Size() <= LogHeaderSize
+}
+
+// SetSize _
+func (lf *LogFile) SetSize(sz uint32) {
+	atomic.StoreUint32(&lf.size, sz)
+}
+
+// Append encodes the entry at the end of the file and returns the pointer to it.
+// Appends are not safe for concurrent use, the value log serializes them
+func (lf *LogFile) Append(e *utils.Entry) (*utils.ValuePtr, error) {
+	offset := lf.Size()
+	plen := WalCodec(lf.buf, lf.lc.encryptEntry(e, offset))
+	if int(offset)+plen > len(lf.f.Data) {
+		// Only a record larger than the file itself grows it
+		lf.Lock()
+		err := lf.f.AppendBuffer(offset, lf.buf.Bytes())
+		lf.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		copy(lf.f.Data[offset:], lf.buf.Bytes())
+	}
+	lf.SetSize(offset + uint32(plen))
+	return &utils.ValuePtr{Fid: lf.FID, Offset: offset, Len: uint32(plen)}, nil
+}
+
+// Read returns a copy of the value the pointer refers to
+func (lf *LogFile) Read(vp *utils.ValuePtr, verify bool) ([]byte, error) {
+	lf.RLock()
+	defer lf.RUnlock()
+	if vp.Offset+vp.Len > lf.Size() {
+		return nil, errors.Wrapf(utils.ErrInvalidValuePtr, "vlog %d has %d bytes, pointer %+v", lf.FID, lf.Size(), *vp)
+	}
+	buf, err := lf.f.Bytes(int(vp.Offset), int(vp.Len))
+	if err != nil {
+		return nil, err
+	}
+	kv, klen, err := DecodeRecord(buf, verify)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "while reading vlog %d at offset %d", lf.FID, vp.Offset)
+	}
+	if lf.lc.encrypted() {
+		// The key precedes the value in the key stream of the record
+		return lf.lc.decrypt(kv, vp.Offset)[klen:], nil
+	}
+	return append([]byte{}, kv[klen:]...), nil
+}
+
+// Iterate calls fn for every record from offset on, it stops at the first torn record
+// and returns the end of the last valid one
+func (lf *LogFile) Iterate(offset uint32, fn utils.LogEntry) (uint32, error) {
+	lf.RLock()
+	defer lf.RUnlock()
+	if offset < LogHeaderSize {
+		// The records start after the header
+		offset = LogHeaderSize
+	}
+	reader := bufio.NewReader(lf.f.NewReader(int(offset)))
+	read := SafeRead{
+		K:            make([]byte, 10),
+		V:            make([]byte, 10),
+		RecordOffset: offset,
+	}
+	validEndOffset := offset
+	for {
+		e, err := read.MakeEntry(reader)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF || err == utils.ErrTruncate:
+			return validEndOffset, nil
+		case err != nil:
+			return 0, err
+		case e.IsZero():
+			return validEndOffset, nil
+		}
+		lf.lc.decryptEntry(e, read.RecordOffset)
+		size := uint32(e.LogHeaderLen() + len(e.Key) + len(e.Value) + crc32.Size)
+		vp := &utils.ValuePtr{Fid: lf.FID, Offset: read.RecordOffset, Len: size}
+		read.RecordOffset += size
+		validEndOffset = read.RecordOffset
+		if err := fn(e, vp); err != nil {
+			if err == utils.ErrStop {
+				return validEndOffset, nil
+			}
+			return 0, errors.WithMessage(err, "Iteration function")
+		}
+	}
+}
+
+// Sync _
+func (lf *LogFile) Sync() error {
+	lf.RLock()
+	defer lf.RUnlock()
+	return lf.f.Sync()
+}
+
+// Close truncates the preallocated space which is not used and closes the file,
+// an empty file should be deleted instead
+func (lf *LogFile) Close() error {
+	lf.Lock()
+	defer lf.Unlock()
+	if err := lf.f.Truncature(int64(lf.Size())); err != nil {
+		return err
+	}
+	return lf.f.Close()
+}
+
+// Delete _
+func (lf *LogFile) Delete() error {
+	lf.Lock()
+	defer lf.Unlock()
+	return lf.f.Delete()
+}
+
+// DecodeRecord returns the key followed by the value of a record written by WalCodec and the
+// length of the key, the crc32 is checked if verify
+func DecodeRecord(buf []byte, verify bool) ([]byte, int, error) {
+	var h [4]uint64
+	idx := 0
+	for i := range h {
+		v, n := binary.Uvarint(buf[idx:])
+		if n <= 0 {
+			return nil, 0, utils.ErrTruncate
+		}
+		h[i], idx = v, idx+n
+	}
+	klen, vlen := int(h[0]), int(h[1])
+	end := idx + klen + vlen
+	if end+crc32.Size > len(buf) {
+		return nil, 0, utils.ErrTruncate
+	}
+	if verify {
+		if crc32.Checksum(buf[:end], utils.CastagnoliCrcTable) != utils.BytesToU32(buf[end:]) {
+			return nil, 0, utils.ErrChecksumMismatch
+		}
+	}
+	return buf[idx:end], klen, nil
+}
@@ -10,7 +10,6 @@ import (
 	"hash"
 	"hash/crc32"
 	"io"
-	"log"
 	"os"
 	"sync"
 )
@@ -24,6 +23,7 @@ type WalFile struct {
 	buf     *bytes.Buffer
 	size    uint32
 	writeAt uint32
+	lc      *logCipher
 }
 
 func (wf *WalFile) Fid() uint64 {
@@ -38,6 +38,11 @@ func (wf *WalFile) Close() error {
 	return os.Remove(fileName)
 }
 
+// CloseAndKeep closes the wal without removing it, the next open replays it
+func (wf *WalFile) CloseAndKeep() error {
+	return wf.f.Close()
+}
+
 func (wf *WalFile) Name() string {
 	return wf.f.Fd.Name()
 }
@@ -46,33 +51,96 @@ func (wf *WalFile) Size() uint32 {
 	return wf.writeAt
 }
 
-func OpenWalFile(opt *Options) *WalFile {
+// Empty returns true if no record has been written
+func (wf *WalFile) Empty() bool {
+	return wf.writeAt <= LogHeaderSize
+}
+
+// OpenWalFile opens the wal of opt.FID, the records of a new file are encrypted by the latest
+// data key of opt.KeyRegistry
+func OpenWalFile(opt *Options) (*WalFile, error) {
+	isNew := isNewFile(opt.FileName)
 	fd, err := OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSize)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
 	wf := &WalFile{
-		lock: &sync.RWMutex{},
-		f:    fd,
-		opts: opt,
-		buf:  &bytes.Buffer{},
-		size: uint32(len(fd.Data)),
+		lock:    &sync.RWMutex{},
+		f:       fd,
+		opts:    opt,
+		buf:     &bytes.Buffer{},
+		size:    uint32(len(fd.Data)),
+		writeAt: LogHeaderSize,
 	}
-	return wf
+	if wf.lc, err = openLogCipher(opt.KeyRegistry, fd, isNew); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return wf, nil
 }
 
 func (wf *WalFile) Write(entry *utils.Entry) error {
 	wf.lock.Lock()
-	plen := WalCodec(wf.buf, entry)
-	buf := wf.buf.Bytes()
-	utils.Panic(wf.f.AppendBuffer(wf.writeAt, buf))
-	wf.writeAt = uint32(plen)
-	wf.lock.Unlock()
+	defer wf.lock.Unlock()
+	plen := WalCodec(wf.buf, wf.lc.encryptEntry(entry, wf.writeAt))
+	if err := wf.f.AppendBuffer(wf.writeAt, wf.buf.Bytes()); err != nil {
+		return err
+	}
+	wf.writeAt += uint32(plen)
 	return nil
 }
 
+// Sync flushes the written records to the disk
+func (wf *WalFile) Sync() error {
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	return wf.f.Sync()
+}
+
+// WriteBatch writes the entries as one checksummed record, the replay applies all of them or none
+// | header(meta=BitBatch) | entry | entry | ... | crc32 |
+func (wf *WalFile) WriteBatch(entries []*utils.Entry) error {
+	wf.lock.Lock()
+	defer wf.lock.Unlock()
+	var payload, buf bytes.Buffer
+	for _, e := range entries {
+		WalCodec(&buf, e)
+		payload.Write(buf.Bytes())
+	}
+	batch := &utils.Entry{Value: payload.Bytes(), Meta: utils.BitBatch}
+	plen := WalCodec(wf.buf, wf.lc.encryptEntry(batch, wf.writeAt))
+	if err := wf.f.AppendBuffer(wf.writeAt, wf.buf.Bytes()); err != nil {
+		return err
+	}
+	wf.writeAt += uint32(plen)
+	return nil
+}
+
+// decodeBatch splits the value of a batch record into its entries
+func decodeBatch(payload []byte) ([]*utils.Entry, error) {
+	reader := bytes.NewReader(payload)
+	read := SafeRead{
+		K: make([]byte, 10),
+		V: make([]byte, 10),
+	}
+	var entries []*utils.Entry
+	for reader.Len() > 0 {
+		e, err := read.MakeEntry(reader)
+		if err != nil {
+			// The record passed its checksum, so the batch itself is broken
+			return nil, errors.Wrap(err, "while decoding a batch")
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
 // Iterate Traverse wal from the disk to get the data
 func (wf *WalFile) Iterate(readOnly bool, offset uint32, fn utils.LogEntry) (uint32, error) {
+	if offset < LogHeaderSize {
+		// The records start after the header
+		offset = LogHeaderSize
+	}
 	// For now, read directly from file, because it allows
 	reader := bufio.NewReader(wf.f.NewReader(int(offset)))
 	read := SafeRead{
@@ -92,19 +160,28 @@ loop:
 			break loop
 		case err != nil:
 			return 0, err
-		case e.IsZero():
+		case e.IsZero() && e.Meta&utils.BitBatch == 0:
 			break loop
 		}
 
 		var vp utils.ValuePtr // In order to achieve kv separation
+		wf.lc.decryptEntry(e, read.RecordOffset)
 		size := uint32(int(e.LogHeaderLen()) + len(e.Key) + len(e.Value) + crc32.Size)
 		read.RecordOffset += size
 		validEndOffset = read.RecordOffset
-		if err := fn(e, &vp); err != nil {
-			if err == utils.ErrStop {
-				break
+		entries := []*utils.Entry{e}
+		if e.Meta&utils.BitBatch > 0 {
+			if entries, err = decodeBatch(e.Value); err != nil {
+				return 0, err
+			}
+		}
+		for _, e := range entries {
+			if err := fn(e, &vp); err != nil {
+				if err == utils.ErrStop {
+					break loop
+				}
+				return 0, errors.WithMessage(err, "Iteration function")
 			}
-			return 0, errors.WithMessage(err, "Iteration function")
 		}
 	}
 	return validEndOffset, nil
@@ -115,6 +192,8 @@ func (wf *WalFile) Truncate(end int64) error {
 	if end <= 0 {
 		return nil
 	}
+	// The replayed records are kept, the next ones are appended after them
+	wf.writeAt = uint32(end)
 	if fi, err := wf.f.Fd.Stat(); err != nil {
 		return fmt.Errorf("while file.stat on file: %s, error: %v\n", wf.Name(), err)
 	} else if fi.Size() == end {
@@ -139,11 +218,19 @@ func (r *SafeRead) MakeEntry(reader io.Reader) (*utils.Entry, error) {
 	var h WalHeader
 	hlen, err := h.Decode(tee)
 	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			// A header which was only partly written may not even decode
+			err = utils.ErrTruncate
+		}
 		return nil, err
 	}
 	if h.KeyLen > uint32(1<<16) { // Key length must be below uint16.
 		return nil, utils.ErrTruncate
 	}
+	if r.LF != nil && int64(h.KeyLen)+int64(h.ValueLen) > int64(len(r.LF.f.Data)) {
+		// A torn header may claim more bytes than the whole file holds
+		return nil, utils.ErrTruncate
+	}
 	kl := int(h.KeyLen)
 	if cap(r.K) < kl {
 		r.K = make([]byte, 2*kl)
@@ -177,6 +264,7 @@ func (r *SafeRead) MakeEntry(reader io.Reader) (*utils.Entry, error) {
 		return nil, utils.ErrTruncate
 	}
 	e.ExpiresAt = h.ExpiresAt
+	e.Meta = h.Meta
 	return e, nil
 }
 
@@ -232,6 +320,7 @@ func WalCodec(buf *bytes.Buffer, e *utils.Entry) int {
 	h := WalHeader{
 		KeyLen:    uint32(len(e.Key)),
 		ValueLen:  uint32(len(e.Value)),
+		Meta:      e.Meta,
 		ExpiresAt: e.ExpiresAt,
 	}
 
@@ -0,0 +1,43 @@
+package FayKV
+
+import "github.com/Kirov7/FayKV/utils"
+
+// Snapshot a consistent read only view of the db at the time it was taken. The versions
+// it can see are kept by the compaction and the vlog gc until it's discarded
+type Snapshot struct {
+	db        *DB
+	readTs    uint64
+	discarded bool
+}
+
+// NewSnapshot pins the latest commit, Discard must be called once the snapshot is not used
+func (db *DB) NewSnapshot() *Snapshot {
+	db.vlog.incrReaders()
+	return &Snapshot{db: db, readTs: db.orc.pinReadTs()}
+}
+
+// ReadTs the version the snapshot reads at
+func (s *Snapshot) ReadTs() uint64 {
+	return s.readTs
+}
+
+// Get returns the version of the key the snapshot sees
+func (s *Snapshot) Get(key []byte) (*utils.Entry, error) {
+	return s.db.get(key, s.readTs)
+}
+
+// NewIterator the iterator must be closed before the snapshot is discarded
+func (s *Snapshot) NewIterator(opt *utils.Options) *DBIterator {
+	s.db.orc.pin(s.readTs)
+	return s.db.newIterator(opt, s.readTs)
+}
+
+// Discard releases the versions pinned by the snapshot, it can be called more than once
+func (s *Snapshot) Discard() error {
+	if s.discarded {
+		return nil
+	}
+	s.discarded = true
+	s.db.orc.unpinReadTs(s.readTs)
+	return s.db.vlog.decrReaders()
+}
@@ -0,0 +1,73 @@
+package FayKV
+
+import (
+	"testing"
+
+	"github.com/Kirov7/FayKV/utils"
+)
+
+func TestSnapshotKeepsVersions(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	for i := 0; i < 100; i++ {
+		mustSet(t, db, key(i), value(i))
+	}
+	snap := db.NewSnapshot()
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			mustSet(t, db, key(i), value(i+1000))
+		} else if err := db.Del(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The compaction keeps the versions the snapshot sees
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		e, err := snap.Get(key(i))
+		if err != nil {
+			t.Fatalf("snapshot get %s: %v", key(i), err)
+		}
+		if string(e.Value) != string(value(i)) {
+			t.Fatalf("snapshot get %s: got %q, want %q", key(i), e.Value, value(i))
+		}
+		if i%2 == 0 {
+			mustGet(t, db, key(i), value(i+1000))
+		} else {
+			mustMiss(t, db, key(i))
+		}
+	}
+	if got := scan(t, snap.NewIterator(&utils.Options{IsAsc: true})); len(got) != 100 {
+		t.Fatalf("snapshot scan: got %d keys, want 100", len(got))
+	}
+	if got := scan(t, db.NewIterator(&utils.Options{IsAsc: true})); len(got) != 50 {
+		t.Fatalf("scan: got %d keys, want 50", len(got))
+	}
+	if err := snap.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i += 2 {
+		mustGet(t, db, key(i), value(i+1000))
+	}
+}
+
+func TestSnapshotReadTs(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	mustSet(t, db, key(1), value(1))
+	snap := db.NewSnapshot()
+	defer snap.Discard()
+	mustSet(t, db, key(2), value(2))
+	if _, err := snap.Get(key(2)); err != utils.ErrKeyNotFound {
+		t.Fatalf("snapshot get of a later write: got %v, want ErrKeyNotFound", err)
+	}
+	e, err := snap.Get(key(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Version > snap.ReadTs() {
+		t.Fatalf("version %d above the read ts %d", e.Version, snap.ReadTs())
+	}
+}
@@ -0,0 +1,135 @@
+package FayKV
+
+import (
+	"github.com/Kirov7/FayKV/cache"
+	"github.com/Kirov7/FayKV/utils"
+	"log"
+)
+
+// Txn an optimistic transaction. It reads at the snapshot of its start, and its commit
+// fails with ErrConflict if a key it read was committed by another writer meanwhile
+type Txn struct {
+	db     *DB
+	readTs uint64
+	update bool
+
+	reads         []uint64 // the fingerprints of the keys read
+	readKeys      [][]byte // the keys read, checked against the ranges deleted meanwhile
+	pendingWrites map[string]*utils.Entry
+	count, size   int64
+	discarded     bool
+}
+
+// NewTransaction a read only transaction if update is false. Discard must be
+// called once it's not used, Commit does it as well
+func (db *DB) NewTransaction(update bool) *Txn {
+	txn := &Txn{
+		db:     db,
+		readTs: db.orc.pinReadTs(),
+		update: update,
+	}
+	if update {
+		txn.pendingWrites = make(map[string]*utils.Entry)
+	}
+	db.vlog.incrReaders()
+	return txn
+}
+
+// Get returns the pending write of the key if there is one, otherwise the version
+// of the transaction's snapshot
+func (txn *Txn) Get(key []byte) (*utils.Entry, error) {
+	if len(key) == 0 {
+		return nil, utils.ErrEmptyKey
+	}
+	if txn.discarded {
+		return nil, utils.ErrDiscardedTxn
+	}
+	if txn.update {
+		if e, has := txn.pendingWrites[string(key)]; has {
+			if e.IsDeletedOrExpired() {
+				return nil, utils.ErrKeyNotFound
+			}
+			return &utils.Entry{
+				Key:       key,
+				Value:     e.Value,
+				ExpiresAt: e.ExpiresAt,
+			}, nil
+		}
+		// A missing key is read as well, a later commit of it is a conflict
+		txn.reads = append(txn.reads, cache.MemHash(key))
+		txn.readKeys = append(txn.readKeys, append([]byte{}, key...))
+	}
+	return txn.db.get(key, txn.readTs)
+}
+
+// Set adds the entry to the pending writes of the transaction, it returns ErrTxnTooBig
+// if they would exceed MaxBatchCount or MaxBatchSize
+func (txn *Txn) Set(data *utils.Entry) error {
+	if data == nil || len(data.Key) == 0 {
+		return utils.ErrEmptyKey
+	}
+	switch {
+	case !txn.update:
+		return utils.ErrReadOnlyTxn
+	case txn.discarded:
+		return utils.ErrDiscardedTxn
+	}
+	// Copy the entry, the caller still owns data. The version is set by the writer goroutine
+	entry := &utils.Entry{
+		Key:       append([]byte{}, data.Key...),
+		Value:     append([]byte(nil), data.Value...),
+		ExpiresAt: data.ExpiresAt,
+		Meta:      data.Meta,
+	}
+	count, size := txn.count, txn.size+int64(entry.EstimateSize(int(txn.db.opt.ValueThreshold))+8)
+	old, has := txn.pendingWrites[string(entry.Key)]
+	if has {
+		size -= int64(old.EstimateSize(int(txn.db.opt.ValueThreshold)) + 8)
+	} else {
+		count++
+	}
+	if count > txn.db.opt.MaxBatchCount || size > txn.db.opt.MaxBatchSize {
+		return utils.ErrTxnTooBig
+	}
+	txn.pendingWrites[string(entry.Key)] = entry
+	txn.count, txn.size = count, size
+	return nil
+}
+
+// Delete adds a tombstone of the key to the pending writes
+func (txn *Txn) Delete(key []byte) error {
+	return txn.Set(&utils.Entry{
+		Key:   key,
+		Value: nil,
+		Meta:  utils.BitDelete,
+	})
+}
+
+// Commit writes the pending writes atomically, it returns ErrConflict if a key read by
+// the transaction has been committed after it started. The transaction is discarded
+func (txn *Txn) Commit() error {
+	if txn.discarded {
+		return utils.ErrDiscardedTxn
+	}
+	defer txn.Discard()
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+	entries := make([]*utils.Entry, 0, len(txn.pendingWrites))
+	for _, e := range txn.pendingWrites {
+		entries = append(entries, e)
+	}
+	return txn.db.sendToWriteCh(&request{entries: entries, txn: txn})
+}
+
+// Discard releases the snapshot of the transaction, it can be called more than once
+func (txn *Txn) Discard() {
+	if txn.discarded {
+		return
+	}
+	txn.discarded = true
+	txn.db.orc.unpinReadTs(txn.readTs)
+	if err := txn.db.vlog.decrReaders(); err != nil {
+		log.Printf("while deleting the rewritten vlog files: %v", err)
+	}
+}
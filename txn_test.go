@@ -0,0 +1,159 @@
+package FayKV
+
+import (
+	"testing"
+
+	"github.com/Kirov7/FayKV/utils"
+)
+
+func TestTxnReadYourWrites(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	txn := db.NewTransaction(true)
+	defer txn.Discard()
+	if err := txn.Set(utils.NewEntry(key(1), value(1))); err != nil {
+		t.Fatal(err)
+	}
+	e, err := txn.Get(key(1))
+	if err != nil || string(e.Value) != string(value(1)) {
+		t.Fatalf("get the pending write: got %v, %v", e, err)
+	}
+	// Not visible outside before the commit
+	mustMiss(t, db, key(1))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, key(1), value(1))
+}
+
+func TestTxnConflict(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	mustSet(t, db, key(1), value(1))
+	txn := db.NewTransaction(true)
+	if _, err := txn.Get(key(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set(utils.NewEntry(key(2), value(2))); err != nil {
+		t.Fatal(err)
+	}
+	// Another writer commits the key read by the transaction
+	mustSet(t, db, key(1), value(100))
+	if err := txn.Commit(); err != utils.ErrConflict {
+		t.Fatalf("commit: got %v, want ErrConflict", err)
+	}
+	mustMiss(t, db, key(2))
+}
+
+// TestTxnConflictMissingKey a key which was missing when read conflicts once it's written
+func TestTxnConflictMissingKey(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	txn := db.NewTransaction(true)
+	if _, err := txn.Get(key(1)); err != utils.ErrKeyNotFound {
+		t.Fatalf("get: got %v, want ErrKeyNotFound", err)
+	}
+	if err := txn.Set(utils.NewEntry(key(1), value(1))); err != nil {
+		t.Fatal(err)
+	}
+	mustSet(t, db, key(1), value(100))
+	if err := txn.Commit(); err != utils.ErrConflict {
+		t.Fatalf("commit: got %v, want ErrConflict", err)
+	}
+	mustGet(t, db, key(1), value(100))
+}
+
+func TestTxnNoConflict(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	mustSet(t, db, key(1), value(1))
+	txn := db.NewTransaction(true)
+	if _, err := txn.Get(key(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set(utils.NewEntry(key(1), value(2))); err != nil {
+		t.Fatal(err)
+	}
+	// A key the transaction didn't read, and a commit before it started, don't conflict
+	mustSet(t, db, key(3), value(3))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, key(1), value(2))
+}
+
+// TestTxnBlindWrites the transactions which only write never conflict, the last commit wins
+func TestTxnBlindWrites(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	first, second := db.NewTransaction(true), db.NewTransaction(true)
+	for i, txn := range []*Txn{first, second} {
+		if err := txn.Set(utils.NewEntry(key(1), value(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, key(1), value(1))
+}
+
+func TestTxnConflictDeleteRange(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	mustSet(t, db, key(5), value(5))
+	txn := db.NewTransaction(true)
+	if _, err := txn.Get(key(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set(utils.NewEntry(key(100), value(100))); err != nil {
+		t.Fatal(err)
+	}
+	// The range holds the key read, though it starts before it
+	if err := db.DeleteRange(key(0), key(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != utils.ErrConflict {
+		t.Fatalf("commit: got %v, want ErrConflict", err)
+	}
+
+	// A range which doesn't hold the key read is no conflict
+	txn = db.NewTransaction(true)
+	if _, err := txn.Get(key(50)); err != utils.ErrKeyNotFound {
+		t.Fatalf("get: got %v, want ErrKeyNotFound", err)
+	}
+	if err := txn.Set(utils.NewEntry(key(100), value(100))); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteRange(key(10), key(50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustGet(t, db, key(100), value(100))
+}
+
+func TestTxnSnapshotRead(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	mustSet(t, db, key(1), value(1))
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	mustSet(t, db, key(1), value(2))
+	e, err := txn.Get(key(1))
+	if err != nil || string(e.Value) != string(value(1)) {
+		t.Fatalf("get: got %v, %v, want the version of the start", e, err)
+	}
+	if err := txn.Set(utils.NewEntry(key(2), value(2))); err != utils.ErrReadOnlyTxn {
+		t.Fatalf("set in a read only txn: got %v, want ErrReadOnlyTxn", err)
+	}
+}
+
+func TestTxnDiscarded(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	txn := db.NewTransaction(true)
+	txn.Discard()
+	if err := txn.Set(utils.NewEntry(key(1), value(1))); err != utils.ErrDiscardedTxn {
+		t.Fatalf("set: got %v, want ErrDiscardedTxn", err)
+	}
+	if err := txn.Commit(); err != utils.ErrDiscardedTxn {
+		t.Fatalf("commit: got %v, want ErrDiscardedTxn", err)
+	}
+}
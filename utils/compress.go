@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// CompressionType the codec of the sstable blocks, it is recorded in the index of the table
+type CompressionType uint32
+
+const (
+	// NoCompression stores the blocks as they are
+	NoCompression CompressionType = iota
+	// SnappyCompression is fast and compresses fairly
+	SnappyCompression
+	// ZSTDCompression compresses better at the cost of more cpu
+	ZSTDCompression
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZSTD The encoder and the decoder are safe for the concurrent EncodeAll and DecodeAll
+func initZSTD() {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		Panic(err)
+		zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		Panic(err)
+	})
+}
+
+// Compress encodes data with the codec into a new buffer
+func Compress(ct CompressionType, data []byte) ([]byte, error) {
+	switch ct {
+	case NoCompression:
+		return data, nil
+	case SnappyCompression:
+		return snappy.Encode(nil, data), nil
+	case ZSTDCompression:
+		initZSTD()
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, errors.Errorf("unsupported compression type: %d", ct)
+}
+
+// Decompress decodes the data which was encoded by Compress with the same codec
+func Decompress(ct CompressionType, data []byte) ([]byte, error) {
+	switch ct {
+	case NoCompression:
+		return data, nil
+	case SnappyCompression:
+		return snappy.Decode(nil, data)
+	case ZSTDCompression:
+		initZSTD()
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, errors.Errorf("unsupported compression type: %d", ct)
+}
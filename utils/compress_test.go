@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 100)
+	for _, ct := range []CompressionType{NoCompression, SnappyCompression, ZSTDCompression} {
+		compressed, err := Compress(ct, data)
+		if err != nil {
+			t.Fatalf("codec %d: %v", ct, err)
+		}
+		if ct != NoCompression && len(compressed) >= len(data) {
+			t.Fatalf("codec %d: %d bytes compressed into %d", ct, len(data), len(compressed))
+		}
+		got, err := Decompress(ct, compressed)
+		if err != nil {
+			t.Fatalf("codec %d: %v", ct, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("codec %d: the data changed", ct)
+		}
+	}
+}
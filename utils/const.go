@@ -3,6 +3,7 @@ package utils
 import (
 	"hash/crc32"
 	"os"
+	"time"
 )
 
 // file
@@ -15,10 +16,76 @@ const (
 	DefaultFileMode                   = 0666
 )
 
+// db
+const (
+	KVWriteChCapacity   = 1000
+	DefaultSyncInterval = time.Second
+	// DefaultBloomFalsePositive the rate of the lookups of a missing key which read a block
+	DefaultBloomFalsePositive = 0.01
+)
+
+// write stalls
+const (
+	DefaultLevelZeroSlowdownTables = 20
+	DefaultLevelZeroStopTables     = 30
+	DefaultImmutablesSlowdown      = 4
+	DefaultPendingBytesSlowdown    = 1 << 30
+	DefaultPendingBytesStop        = 4 << 30
+	// DefaultSlowdownDelay the delay of every write while the compaction falls behind
+	DefaultSlowdownDelay = time.Millisecond
+)
+
+// flush
+const (
+	// FlushRetries the attempts to flush a memTable, the writes fail with the error of the last one
+	FlushRetries    = 3
+	FlushRetryDelay = time.Second
+)
+
+// SyncMode when the writes are fsynced to the disk
+type SyncMode int
+
+const (
+	// SyncEveryInterval fsync every SyncInterval from a background goroutine, the default
+	SyncEveryInterval SyncMode = iota
+	// SyncEveryWrite fsync before a write is acknowledged
+	SyncEveryWrite
+	// SyncNever leave it to the os, a crash of the machine may lose the acknowledged writes.
+	// The tables and the manifest changes deleting tables are synced anyway, the db always opens
+	SyncNever
+)
+
+// value log
+const (
+	DiscardStatsFilename      = "DISCARD"
+	VlogFileExt               = ".vlog"
+	DefaultValueThreshold     = 1 << 10
+	DefaultValueLogFileSize   = 1 << 28
+	DefaultValueLogMaxEntries = 1000000
+	// DiscardStatsSaveInterval how often the discard stats are saved if they changed
+	DiscardStatsSaveInterval = time.Minute
+)
+
+// encryption
+const (
+	KeyRegistryFileName        = "KEYREGISTRY"
+	KeyRegistryRewriteFileName = "REWRITE-KEYREGISTRY"
+	// DefaultKeyRotationDuration a new data key is generated once the latest one is older
+	DefaultKeyRotationDuration = 10 * 24 * time.Hour
+)
+
 // codec
 var (
 	MagicText    = [4]byte{'F', 'A', 'Y', 'A'}
-	MagicVersion = uint32(1)
+	MagicVersion = uint32(2) // The manifest records may be encrypted since version 2
 	// CastagnoliCrcTable is a CRC32 polynomial table (You can think of it as a salt)
 	CastagnoliCrcTable = crc32.MakeTable(crc32.Castagnoli)
 )
+
+// meta
+const (
+	BitDelete       byte = 1 << 0 // Set if the key has been deleted.
+	BitValuePointer byte = 1 << 1 // Set if the value is a pointer into the value log.
+	BitBatch        byte = 1 << 2 // Set on the wal record which holds a whole write batch.
+	BitRangeDelete  byte = 1 << 3 // Set with BitDelete on the entry of a range deletion, the value is the end key.
+)
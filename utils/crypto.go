@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+)
+
+// XORBlock encrypts or decrypts src into dst with AES-CTR, both are the same operation.
+// dst must be as long as src, they may be the same slice
+func XORBlock(dst, src, key, iv []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	stream := cipher.NewCTR(block, iv)
+	stream.XORKeyStream(dst, src)
+	return nil
+}
+
+// XORBlockAllocate is XORBlock into a new buffer, src is left as it is
+func XORBlockAllocate(src, key, iv []byte) ([]byte, error) {
+	dst := make([]byte, len(src))
+	if err := XORBlock(dst, src, key, iv); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// GenerateIV returns a random iv of one aes block
+func GenerateIV() ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	_, err := rand.Read(iv)
+	return iv, err
+}
+
+// ValidEncryptionKey an aes key is 16, 24 or 32 bytes, an empty key disables the encryption
+func ValidEncryptionKey(key []byte) bool {
+	switch len(key) {
+	case 0, 16, 24, 32:
+		return true
+	}
+	return false
+}
@@ -40,6 +40,17 @@ func (e *Entry) Entry() *Entry {
 	return e
 }
 
+// IsDeletedOrExpired returns true if the entry is a tombstone or its ttl has passed
+func (e *Entry) IsDeletedOrExpired() bool {
+	if e.Meta&BitDelete > 0 {
+		return true
+	}
+	if e.ExpiresAt == 0 {
+		return false
+	}
+	return e.ExpiresAt <= uint64(time.Now().Unix())
+}
+
 // IsZero _
 func (e *Entry) IsZero() bool {
 	return len(e.Key) == 0
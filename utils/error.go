@@ -11,6 +11,26 @@ var (
 	ErrBadChecksum      = errors.New("bad check sum")
 	ErrTruncate         = errors.New("Do truncate")
 	ErrStop             = errors.New("Stop")
+	ErrFillTables       = errors.New("Unable to fill tables")
+	ErrVlogNotFound     = errors.New("Value log file not found")
+	ErrInvalidValuePtr  = errors.New("Invalid value pointer")
+	ErrNoRewrite        = errors.New("Value log GC attempt didn't result in any cleanup")
+	ErrRejected         = errors.New("Value log GC request rejected")
+	ErrInvalidRequest   = errors.New("Invalid request")
+	ErrBatchTooBig      = errors.New("Batch is too big to fit into one write")
+	ErrBlockedWrites    = errors.New("Writes are blocked, possibly due to DB close")
+	ErrConflict         = errors.New("Transaction Conflict. Please retry")
+	ErrReadOnlyTxn      = errors.New("No sets or deletes are allowed in a read-only transaction")
+	ErrDiscardedTxn     = errors.New("This transaction has been discarded. Create a new one")
+	ErrTxnTooBig        = errors.New("Txn is too big to fit into one request")
+	ErrCompactionStop   = errors.New("Compaction stopped, possibly due to DB close")
+)
+
+// encryption
+var (
+	ErrEncryptionKeyMismatch = errors.New("Encryption key mismatch")
+	ErrInvalidEncryptionKey  = errors.New("Encryption key's length should be either 16, 24, or 32 bytes")
+	ErrInvalidDataKeyID      = errors.New("Invalid data key id")
 )
 
 // Panic if err != nil then panic
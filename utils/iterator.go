@@ -16,4 +16,8 @@ type Item interface {
 type Options struct {
 	Prefix []byte // 前缀
 	IsAsc  bool   // 是否升序
+	// LowerBound the first key of the iteration, UpperBound the key after the last one.
+	// A nil bound leaves the range open, the tables and blocks out of the range are not read
+	LowerBound []byte
+	UpperBound []byte
 }
@@ -0,0 +1,35 @@
+package utils
+
+import "fmt"
+
+// PrefixExtractor takes the prefix of a user key which the prefix bloom filters of the tables
+// are built on. Every key starting with a scan prefix must have the same prefix as the scan
+// prefix itself, otherwise the scan can't be answered by the filters. Prefix returns nil if the
+// key is out of the domain of the extractor
+type PrefixExtractor interface {
+	// Name is stored in the tables, a filter built by an extractor of another name is ignored
+	Name() string
+	Prefix(key []byte) []byte
+}
+
+// fixedPrefixExtractor takes the first n bytes of the key
+type fixedPrefixExtractor struct {
+	n int
+}
+
+// NewFixedPrefixExtractor returns the extractor of the first n bytes of the keys,
+// the keys shorter than n have no prefix
+func NewFixedPrefixExtractor(n int) PrefixExtractor {
+	return fixedPrefixExtractor{n: n}
+}
+
+func (e fixedPrefixExtractor) Name() string {
+	return fmt.Sprintf("fixed:%d", e.n)
+}
+
+func (e fixedPrefixExtractor) Prefix(key []byte) []byte {
+	if e.n <= 0 || len(key) < e.n {
+		return nil
+	}
+	return key[:e.n]
+}
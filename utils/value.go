@@ -14,6 +14,48 @@ type ValuePtr struct {
 	Fid    uint32
 }
 
+const vptrSize = 12
+
+// Less _
+func (p ValuePtr) Less(o *ValuePtr) bool {
+	if o == nil {
+		return false
+	}
+	if p.Fid != o.Fid {
+		return p.Fid < o.Fid
+	}
+	if p.Offset != o.Offset {
+		return p.Offset < o.Offset
+	}
+	return p.Len < o.Len
+}
+
+// IsZero _
+func (p ValuePtr) IsZero() bool {
+	return p.Fid == 0 && p.Offset == 0 && p.Len == 0
+}
+
+// Encode encodes the pointer into the value stored in the lsm
+func (p ValuePtr) Encode() []byte {
+	b := make([]byte, vptrSize)
+	binary.BigEndian.PutUint32(b[0:4], p.Fid)
+	binary.BigEndian.PutUint32(b[4:8], p.Len)
+	binary.BigEndian.PutUint32(b[8:12], p.Offset)
+	return b
+}
+
+// Decode decodes the pointer from the value stored in the lsm
+func (p *ValuePtr) Decode(b []byte) {
+	p.Fid = binary.BigEndian.Uint32(b[0:4])
+	p.Len = binary.BigEndian.Uint32(b[4:8])
+	p.Offset = binary.BigEndian.Uint32(b[8:12])
+}
+
+// IsValuePtr returns true if the value of the entry is a pointer into the value log
+func IsValuePtr(e *Entry) bool {
+	return e.Meta&BitValuePointer > 0
+}
+
 // BytesToU32 converts the given byte slice to uint32
 func BytesToU32(b []byte) uint32 {
 	return binary.BigEndian.Uint32(b)
@@ -0,0 +1,533 @@
+package FayKV
+
+import (
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/persistent"
+	"github.com/Kirov7/FayKV/utils"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// valueLog keeps the values larger than ValueThreshold out of the lsm, the lsm only
+// stores a ValuePtr to them
+type valueLog struct {
+	sync.RWMutex // Guards filesMap and maxFid
+	dirPath      string
+	filesMap     map[uint32]*persistent.LogFile
+	maxFid       uint32 // the fid of the file being written
+
+	writeLock         sync.Mutex // Serializes the appends to the head file
+	numEntriesWritten uint32
+	opt               *Options
+	db                *DB
+
+	// activeReaders the readers and iterators which may still hold old pointers,
+	// the rewritten files are only deleted once there is none
+	activeReaders    int32
+	filesToBeDeleted []uint32
+	discardStats     *discardStats
+	garbageCh        chan struct{} // Only one gc runs at a time
+	closer           *utils.Closer
+}
+
+func openValueLog(db *DB, opt *Options) (*valueLog, error) {
+	vlog := &valueLog{
+		dirPath:   opt.WorkDir,
+		filesMap:  make(map[uint32]*persistent.LogFile),
+		opt:       opt,
+		db:        db,
+		garbageCh: make(chan struct{}, 1),
+		closer:    utils.NewCloser(),
+	}
+	var err error
+	if vlog.discardStats, err = openDiscardStats(opt.WorkDir); err != nil {
+		return nil, err
+	}
+	if err := vlog.populateFilesMap(); err != nil {
+		return nil, err
+	}
+	vlog.discardStats.forgetMissing(vlog.filesMap, vlog.maxFid)
+	// Only the last file can end with a torn record, the records after it are dropped
+	for _, lf := range vlog.filesMap {
+		end, err := lf.Iterate(0, func(_ *utils.Entry, _ *utils.ValuePtr) error { return nil })
+		if err != nil {
+			return nil, errors.WithMessagef(err, "while replaying vlog: %s", lf.Name())
+		}
+		lf.SetSize(end)
+	}
+	// Always write to a new file, the old head may have been truncated when it was closed
+	if _, err := vlog.createVlogFile(vlog.maxFid + 1); err != nil {
+		return nil, err
+	}
+	vlog.closer.Add(1)
+	go vlog.discardStats.run(vlog.closer)
+	return vlog, nil
+}
+
+// populateFilesMap opens all the vlog files of the work dir
+func (vlog *valueLog) populateFilesMap() error {
+	files, err := ioutil.ReadDir(vlog.dirPath)
+	if err != nil {
+		return errors.Wrapf(err, "while reading dir: %s", vlog.dirPath)
+	}
+	var fids []uint32
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), utils.VlogFileExt) {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), utils.VlogFileExt), 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "while parsing vlog name: %s", file.Name())
+		}
+		fids = append(fids, uint32(fid))
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	for _, fid := range fids {
+		lf, err := persistent.OpenLogFile(&persistent.Options{
+			FID:         uint64(fid),
+			FileName:    persistent.FileNameVlog(vlog.dirPath, fid),
+			Dir:         vlog.dirPath,
+			Flag:        os.O_CREATE | os.O_RDWR,
+			MaxSize:     vlog.opt.ValueLogFileSize,
+			KeyRegistry: vlog.db.registry,
+		})
+		if err != nil {
+			return err
+		}
+		vlog.filesMap[fid] = lf
+		vlog.maxFid = fid
+	}
+	return nil
+}
+
+func (vlog *valueLog) createVlogFile(fid uint32) (*persistent.LogFile, error) {
+	lf, err := persistent.OpenLogFile(&persistent.Options{
+		FID:         uint64(fid),
+		FileName:    persistent.FileNameVlog(vlog.dirPath, fid),
+		Dir:         vlog.dirPath,
+		Flag:        os.O_CREATE | os.O_RDWR,
+		MaxSize:     vlog.opt.ValueLogFileSize,
+		KeyRegistry: vlog.db.registry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	vlog.Lock()
+	vlog.filesMap[fid] = lf
+	vlog.maxFid = fid
+	vlog.Unlock()
+	vlog.numEntriesWritten = 0
+	return lf, nil
+}
+
+// shouldWriteValueToLSM the small values are kept inline
+func (vlog *valueLog) shouldWriteValueToLSM(e *utils.Entry) bool {
+	return int64(len(e.Value)) < vlog.opt.ValueThreshold
+}
+
+// write appends the large values to the head file and replaces them with their pointers
+func (vlog *valueLog) write(entries []*utils.Entry) error {
+	vlog.writeLock.Lock()
+	defer vlog.writeLock.Unlock()
+	for _, e := range entries {
+		if e.Meta&utils.BitDelete > 0 || vlog.shouldWriteValueToLSM(e) {
+			continue
+		}
+		lf := vlog.headFile()
+		if !lf.Empty() && (int(lf.Size())+persistent.EstimateWalCodecSize(e) > vlog.opt.ValueLogFileSize ||
+			vlog.numEntriesWritten >= vlog.opt.ValueLogMaxEntries) {
+			// Rotate, the old head keeps its preallocated size until it is closed.
+			// It's synced now since only the head is synced later
+			if err := lf.Sync(); err != nil {
+				return err
+			}
+			var err error
+			if lf, err = vlog.createVlogFile(vlog.maxFid + 1); err != nil {
+				return err
+			}
+		}
+		vp, err := lf.Append(e)
+		if err != nil {
+			return errors.WithMessagef(err, "while writing to vlog: %s", lf.Name())
+		}
+		vlog.numEntriesWritten++
+		e.Value = vp.Encode()
+		e.Meta |= utils.BitValuePointer
+	}
+	return nil
+}
+
+func (vlog *valueLog) headFile() *persistent.LogFile {
+	vlog.RLock()
+	defer vlog.RUnlock()
+	return vlog.filesMap[vlog.maxFid]
+}
+
+// sync flushes the head file to the disk, the older files are synced when they are rotated
+func (vlog *valueLog) sync() error {
+	return vlog.headFile().Sync()
+}
+
+// incrReaders must be called before reading a pointer from the lsm
+func (vlog *valueLog) incrReaders() {
+	atomic.AddInt32(&vlog.activeReaders, 1)
+}
+
+// decrReaders deletes the rewritten files once the last reader is gone
+func (vlog *valueLog) decrReaders() error {
+	if atomic.AddInt32(&vlog.activeReaders, -1) != 0 {
+		return nil
+	}
+	vlog.Lock()
+	defer vlog.Unlock()
+	// A reader which came in meanwhile only sees the new pointers
+	return vlog.deletePendingFiles()
+}
+
+// deletePendingFiles must be called with vlog.Lock held
+func (vlog *valueLog) deletePendingFiles() error {
+	for _, fid := range vlog.filesToBeDeleted {
+		lf := vlog.filesMap[fid]
+		delete(vlog.filesMap, fid)
+		if err := lf.Delete(); err != nil {
+			return errors.WithMessagef(err, "while deleting vlog %d", fid)
+		}
+		vlog.discardStats.remove(fid)
+	}
+	vlog.filesToBeDeleted = nil
+	return nil
+}
+
+// read returns the value the pointer refers to
+func (vlog *valueLog) read(vp *utils.ValuePtr) ([]byte, error) {
+	vlog.RLock()
+	lf, ok := vlog.filesMap[vp.Fid]
+	vlog.RUnlock()
+	if !ok {
+		return nil, errors.Wrapf(utils.ErrVlogNotFound, "fid: %d", vp.Fid)
+	}
+	return lf.Read(vp, vlog.opt.VerifyValueChecksum)
+}
+
+// resolve replaces a pointer in the value of the entry with the value itself
+func (vlog *valueLog) resolve(e *utils.Entry) error {
+	if !utils.IsValuePtr(e) {
+		return nil
+	}
+	var vp utils.ValuePtr
+	vp.Decode(e.Value)
+	val, err := vlog.read(&vp)
+	if err != nil {
+		return err
+	}
+	e.Value = val
+	e.Meta &^= utils.BitValuePointer
+	return nil
+}
+
+func (vlog *valueLog) close() error {
+	vlog.closer.Close()
+	if err := vlog.discardStats.close(); err != nil {
+		return err
+	}
+	vlog.Lock()
+	defer vlog.Unlock()
+	if err := vlog.deletePendingFiles(); err != nil {
+		return err
+	}
+	for fid, lf := range vlog.filesMap {
+		var err error
+		if lf.Empty() {
+			err = lf.Delete()
+		} else {
+			err = lf.Close()
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "while closing vlog %d", fid)
+		}
+	}
+	return nil
+}
+
+// runGC rewrites the file with the largest part of discarded bytes
+func (vlog *valueLog) runGC(discardRatio float64) error {
+	select {
+	case vlog.garbageCh <- struct{}{}:
+		defer func() { <-vlog.garbageCh }()
+	default:
+		return utils.ErrRejected
+	}
+	lf := vlog.pickLog(discardRatio)
+	if lf == nil {
+		return utils.ErrNoRewrite
+	}
+	return vlog.rewrite(lf)
+}
+
+// pickLog returns the file whose discarded bytes are the largest part of it,
+// nil if it's below discardRatio. The head file is never picked
+func (vlog *valueLog) pickLog(discardRatio float64) *persistent.LogFile {
+	vlog.RLock()
+	defer vlog.RUnlock()
+	var picked *persistent.LogFile
+	var maxRatio float64
+	for fid, discard := range vlog.discardStats.snapshot() {
+		lf, ok := vlog.filesMap[fid]
+		if !ok || fid >= vlog.maxFid || lf.Empty() || vlog.isPendingDeletion(fid) {
+			continue
+		}
+		if ratio := float64(discard) / float64(lf.Size()); ratio > maxRatio {
+			picked, maxRatio = lf, ratio
+		}
+	}
+	if maxRatio < discardRatio {
+		return nil
+	}
+	return picked
+}
+
+// isPendingDeletion must be called with vlog.RLock held
+func (vlog *valueLog) isPendingDeletion(fid uint32) bool {
+	for _, id := range vlog.filesToBeDeleted {
+		if id == fid {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite moves the live entries of the file to the head file, then deletes the file
+func (vlog *valueLog) rewrite(lf *persistent.LogFile) error {
+	const batchSize = 1000
+	var batch []*utils.Entry
+	var ptrs []*utils.ValuePtr
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch, ptrs = batch[:0], ptrs[:0] }()
+		// No write of the same keys can come in between the check and the rewrite
+		vlog.db.Lock()
+		defer vlog.db.Unlock()
+		live := make([]*utils.Entry, 0, len(batch))
+		for i, e := range batch {
+			if vlog.isLive(e, ptrs[i]) {
+				live = append(live, e)
+			}
+		}
+		if err := vlog.write(live); err != nil {
+			return err
+		}
+		for _, e := range live {
+			if err := vlog.db.lsm.Set(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, err := lf.Iterate(0, func(e *utils.Entry, vp *utils.ValuePtr) error {
+		batch = append(batch, &utils.Entry{
+			Key:       append([]byte{}, e.Key...),
+			Value:     append([]byte{}, e.Value...),
+			ExpiresAt: e.ExpiresAt,
+			Meta:      e.Meta,
+		})
+		ptrs = append(ptrs, vp)
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return errors.WithMessagef(err, "while rewriting vlog: %s", lf.Name())
+	}
+	// The moved values and their pointers must be on disk before the old copies go away
+	if err := vlog.sync(); err != nil {
+		return err
+	}
+	if err := vlog.db.lsm.Sync(); err != nil {
+		return err
+	}
+	vlog.Lock()
+	defer vlog.Unlock()
+	vlog.filesToBeDeleted = append(vlog.filesToBeDeleted, lf.FID)
+	if atomic.LoadInt32(&vlog.activeReaders) > 0 {
+		// The last reader deletes it
+		return nil
+	}
+	return vlog.deletePendingFiles()
+}
+
+// isLive returns true if the newest version of the key is the record at vp. The older
+// versions are only visible to the snapshots, which keep the file until they are discarded
+func (vlog *valueLog) isLive(e *utils.Entry, vp *utils.ValuePtr) bool {
+	cur, err := vlog.db.lsm.Get(inmemory.KeyWithTs(inmemory.ParseKey(e.Key), math.MaxUint64))
+	if err != nil || cur == nil || !utils.IsValuePtr(cur) || cur.IsDeletedOrExpired() {
+		return false
+	}
+	if inmemory.ParseTs(cur.Key) != inmemory.ParseTs(e.Key) {
+		return false
+	}
+	var curPtr utils.ValuePtr
+	curPtr.Decode(cur.Value)
+	return curPtr.Fid == vp.Fid && curPtr.Offset == vp.Offset
+}
+
+// discardStats the bytes of every vlog file which are not referenced by the lsm any more.
+// They are reported by the compaction and saved in the DISCARD file every
+// DiscardStatsSaveInterval if they changed, and when the db is closed
+type discardStats struct {
+	sync.Mutex
+	path  string
+	stats map[uint32]int64
+	ch    chan map[uint32]int64
+
+	// minFid, deleted the files below minFid and the ones in deleted are gone. The stale
+	// copies of the rewritten values still point to them, their reports are ignored
+	minFid  uint32
+	deleted map[uint32]struct{}
+	// dirty the stats changed since they were saved
+	dirty bool
+}
+
+func openDiscardStats(dir string) (*discardStats, error) {
+	ds := &discardStats{
+		path:    filepath.Join(dir, utils.DiscardStatsFilename),
+		stats:   make(map[uint32]int64),
+		ch:      make(chan map[uint32]int64, 16),
+		deleted: make(map[uint32]struct{}),
+	}
+	buf, err := ioutil.ReadFile(ds.path)
+	if os.IsNotExist(err) {
+		return ds, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "while reading: %s", ds.path)
+	}
+	// | fid uint32 | discarded bytes uint64 | ...
+	for ; len(buf) >= 12; buf = buf[12:] {
+		ds.stats[utils.BytesToU32(buf[:4])] = int64(utils.BytesToU64(buf[4:12]))
+	}
+	return ds, nil
+}
+
+// forgetMissing drops the stats of the files which were deleted before the db was opened,
+// maxFid the newest file
+func (ds *discardStats) forgetMissing(files map[uint32]*persistent.LogFile, maxFid uint32) {
+	ds.Lock()
+	defer ds.Unlock()
+	ds.minFid = maxFid + 1
+	for fid := range files {
+		if fid < ds.minFid {
+			ds.minFid = fid
+		}
+	}
+	for fid := ds.minFid; fid < maxFid; fid++ {
+		if _, ok := files[fid]; !ok {
+			ds.deleted[fid] = struct{}{}
+		}
+	}
+	for fid := range ds.stats {
+		if ds.isDeleted(fid) {
+			delete(ds.stats, fid)
+			ds.dirty = true
+		}
+	}
+}
+
+// isDeleted must be called with ds.Lock held
+func (ds *discardStats) isDeleted(fid uint32) bool {
+	_, ok := ds.deleted[fid]
+	return ok || fid < ds.minFid
+}
+
+// run merges the reports of the compaction and saves the stats once in a while,
+// until the closer is closed
+func (ds *discardStats) run(closer *utils.Closer) {
+	defer closer.Done()
+	ticker := time.NewTicker(utils.DiscardStatsSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case stats := <-ds.ch:
+			ds.merge(stats)
+		case <-ticker.C:
+			if err := ds.save(); err != nil {
+				log.Printf("while saving the discard stats: %v", err)
+			}
+		case <-closer.CloseSignal:
+			return
+		}
+	}
+}
+
+func (ds *discardStats) merge(stats map[uint32]int64) {
+	ds.Lock()
+	defer ds.Unlock()
+	for fid, discard := range stats {
+		if ds.isDeleted(fid) {
+			continue
+		}
+		ds.stats[fid] += discard
+		ds.dirty = true
+	}
+}
+
+func (ds *discardStats) snapshot() map[uint32]int64 {
+	ds.Lock()
+	defer ds.Unlock()
+	stats := make(map[uint32]int64, len(ds.stats))
+	for fid, discard := range ds.stats {
+		stats[fid] = discard
+	}
+	return stats
+}
+
+// remove forgets the file, it's deleted
+func (ds *discardStats) remove(fid uint32) {
+	ds.Lock()
+	delete(ds.stats, fid)
+	ds.deleted[fid] = struct{}{}
+	ds.dirty = true
+	ds.Unlock()
+}
+
+func (ds *discardStats) close() error {
+	return ds.save()
+}
+
+// save writes the stats if they changed, the file is replaced atomically
+func (ds *discardStats) save() error {
+	ds.Lock()
+	defer ds.Unlock()
+	if !ds.dirty {
+		return nil
+	}
+	buf := make([]byte, 0, 12*len(ds.stats))
+	for fid, discard := range ds.stats {
+		buf = append(buf, utils.U32ToBytes(fid)...)
+		buf = append(buf, utils.U64ToBytes(uint64(discard))...)
+	}
+	tmp := ds.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, utils.DefaultFileMode); err != nil {
+		return errors.Wrapf(err, "while writing: %s", tmp)
+	}
+	if err := os.Rename(tmp, ds.path); err != nil {
+		return err
+	}
+	ds.dirty = false
+	return nil
+}
@@ -0,0 +1,112 @@
+package FayKV
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Kirov7/FayKV/inmemory"
+	"github.com/Kirov7/FayKV/utils"
+)
+
+// TestValueLogSeparation the values over ValueThreshold are kept in the vlog, the lsm only
+// holds a pointer to them, and they are found through the pointer after a reopen
+func TestValueLogSeparation(t *testing.T) {
+	dir := t.TempDir()
+	db := Open(testOptions(dir))
+	for i := 0; i < 200; i++ {
+		v := value(i)
+		if i%2 == 0 {
+			v = bigValue(i)
+		}
+		mustSet(t, db, key(i), v)
+	}
+	for i := 0; i < 200; i++ {
+		e, err := db.lsm.Get(inmemory.KeyWithTs(key(i), math.MaxUint64))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if big := i%2 == 0; utils.IsValuePtr(e) != big {
+			t.Fatalf("%s: got a value pointer %v, want %v", key(i), utils.IsValuePtr(e), big)
+		}
+	}
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, testOptions(dir))
+	for i := 0; i < 200; i++ {
+		want := value(i)
+		if i%2 == 0 {
+			want = bigValue(i)
+		}
+		mustGet(t, db, key(i), want)
+	}
+}
+
+// oldFiles returns the vlog files below fid
+func oldFiles(db *DB, fid uint32) int {
+	db.vlog.RLock()
+	defer db.vlog.RUnlock()
+	var n int
+	for f := range db.vlog.filesMap {
+		if f < fid {
+			n++
+		}
+	}
+	return n
+}
+
+// TestValueLogGC the overwritten values are reported by the compaction, the gc moves the live
+// ones out of a vlog file and deletes it
+func TestValueLogGC(t *testing.T) {
+	db := openTestDB(t, testOptions(t.TempDir()))
+	// About 2 MB of values, over two vlog files
+	for i := 0; i < 1000; i++ {
+		mustSet(t, db, key(i), bigValue(i))
+	}
+	// The files before the head only hold the values overwritten below
+	db.vlog.RLock()
+	head := db.vlog.maxFid
+	db.vlog.RUnlock()
+	old := oldFiles(db, head)
+	if old == 0 {
+		t.Fatal("the values fit in one vlog file")
+	}
+	for i := 0; i < 1000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		mustSet(t, db, key(i), bigValue(i+1000))
+	}
+	if err := db.RunValueLogGC(0.5); err != utils.ErrNoRewrite {
+		t.Fatalf("gc before the compaction: got %v, want ErrNoRewrite", err)
+	}
+	if _, err := db.Flatten(1); err != nil {
+		t.Fatal(err)
+	}
+	// The discard stats reach the vlog in the background
+	var err error
+	for n := 0; n < 100; n++ {
+		if err = db.RunValueLogGC(0.5); err != utils.ErrNoRewrite {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("gc after the compaction: %v", err)
+	}
+	if n := oldFiles(db, head); n != old-1 {
+		t.Fatalf("got %d vlog files below %d after the gc, want %d", n, head, old-1)
+	}
+	for i := 0; i < 1000; i++ {
+		want := bigValue(i + 1000)
+		if i%10 == 0 {
+			want = bigValue(i)
+		}
+		mustGet(t, db, key(i), want)
+	}
+}